@@ -7,36 +7,109 @@ var logoot = require('./logoot');
 
 module.exports = Document;
 
-function Document(addr, docId, onLoad) {
-  var that = this;
+// Delay before reconnecting after the connection drops.
+var RECONNECT_DELAY_MS = 1000;
+// Delay before telling the server which patches we've received.
+var RECEIVED_DELAY_MS = 1000;
+
+// meta is optional display metadata for this client, e.g. {name: 'alice'}.
+// dataType is optional, and is either 'crdt.Logoot' (the default) or
+// 'crdt.LogootLSEQ'; they differ only in how the server allocates pids.
+function Document(addr, docId, onLoad, meta, dataType) {
+  this.addr_ = addr;
+  this.docId_ = docId;
+  this.onLoad_ = onLoad;
+  this.meta_ = meta || null;
+  this.dataType_ = dataType || 'crdt.Logoot';
 
   // Initialized by processSnapshotMsg_.
   this.clientId_ = null;
   this.m_ = null;
 
-  // Initialize connection.
-  this.conn_ = new lib.Conn(addr);
+  // Map of client id to metadata for other clients connected to this document.
+  this.collaborators_ = {};
+  this.basePatchId_ = null;  // last patch we've gotten from server
+
+  // Ops sent to the server but not yet acknowledged, one array per Update.
+  this.sentOps_ = [];
+
+  // Whether the server is ready to receive updates, i.e. we've gotten a
+  // Snapshot or Resumed message on the current connection.
+  this.ready_ = false;
+  // Whether the server reported an error. If so, we do not reconnect.
+  this.failed_ = false;
+  // Pending timer for scheduleReceived_, if any.
+  this.receivedTimer_ = null;
+
+  this.connect_();
+}
+
+// Connects to the server. If we've connected before, resumes our previous
+// session so that unacknowledged ops are not lost.
+Document.prototype.connect_ = function() {
+  var that = this;
+  this.conn_ = new lib.Conn(this.addr_);
 
   this.conn_.on('open', function() {
-    that.conn_.send({
+    var msg = {
       Type: 'Init',
-      DocId: docId,
-      DataType: 'crdt.Logoot'
-    });
+      DocId: that.docId_,
+      DataType: that.dataType_,
+      Meta: that.meta_
+    };
+    if (that.clientId_ !== null) {
+      msg.Resume = true;
+      msg.ClientId = that.clientId_;
+      msg.BasePatchId = that.basePatchId_;
+    }
+    that.conn_.send(msg);
+  });
+
+  this.conn_.on('close', function() {
+    that.ready_ = false;
+    if (!that.failed_) {
+      window.setTimeout(that.connect_.bind(that), RECONNECT_DELAY_MS);
+    }
   });
 
   this.conn_.on('recv', function(msg) {
     switch (msg.Type) {
     case 'Snapshot':
+      var loaded = that.m_ !== null;
       that.processSnapshotMsg_(msg);
-      return onLoad(that);
+      if (!loaded) {
+        that.onLoad_(that);
+      }
+      return;
+    case 'Resumed':
+      return that.processResumedMsg_(msg);
+    case 'Joined':
+      that.collaborators_[msg.ClientId] = msg.Meta;
+      return;
+    case 'Left':
+      return that.processLeftMsg_(msg);
+    case 'Ack':
+      return that.processAckMsg_(msg);
     case 'Change':
       return that.processChangeMsg_(msg);
+    case 'Error':
+      // The server closes the connection after sending an Error.
+      if (msg.Code === 'ResyncRequired') {
+        return that.resync_();
+      }
+      that.failed_ = true;
+      throw new Error('server error: ' + msg.Code + ': ' + msg.Message);
     default:
       throw new Error('unknown message type: ' + msg.Type);
     }
   });
-}
+};
+
+// Returns a map of client id to metadata for other clients connected to this
+// document.
+Document.prototype.getCollaborators = function() {
+  return this.collaborators_;
+};
 
 Document.prototype.getModel = function() {
   return this.m_;
@@ -46,15 +119,20 @@ Document.prototype.getModel = function() {
 // Model event handlers
 
 Document.prototype.handleReplaceText = function(pos, len, value) {
-  var ops = new Array(len);
-  for (var i = 0; i < len; i++) {
-    ops[i] = new logoot.Delete(this.logoot_.pid(pos + i));
+  // Convert text positions to atom indices.
+  var start = this.logoot_.index(pos), end = this.logoot_.index(pos + len);
+  var ops = [];
+  // The server accepts only client ops, so even a single atom is deleted as a
+  // range.
+  if (end > start) {
+    ops.push(new logoot.ClientDelete(
+      this.logoot_.pid(start), this.logoot_.pid(end - 1)));
   }
   if (value) {
-    var prevPid = pos === 0 ? '' : this.logoot_.pid(pos - 1);
+    var prevPid = start === 0 ? '' : this.logoot_.pid(start - 1);
     var nextPid = '';
-    if (pos + len < this.logoot_.len()) {
-      nextPid = this.logoot_.pid(pos + len);
+    if (end < this.logoot_.len()) {
+      nextPid = this.logoot_.pid(end);
     }
     ops.push(new logoot.ClientInsert(prevPid, nextPid, value));
   }
@@ -67,13 +145,112 @@ Document.prototype.handleReplaceText = function(pos, len, value) {
 Document.prototype.processSnapshotMsg_ = function(msg) {
   console.assert(this.clientId_ === null);
   this.clientId_ = msg.ClientId;
+  this.basePatchId_ = Number(msg.BasePatchId);
   this.logoot_ = logoot.decode(msg.LogootStr);
-  this.m_ = new eddie.AsyncModel(this, msg.Text);
+  if (this.m_ === null) {
+    this.m_ = new eddie.AsyncModel(this, msg.Text);
+  } else {
+    // We're resyncing, so replace the model's text.
+    this.m_.applyReplaceText(false, 0, this.m_.getText().length, msg.Text);
+  }
+  this.setCollaborators_(msg.Collaborators);
+  this.ready_ = true;
+};
+
+Document.prototype.processResumedMsg_ = function(msg) {
+  console.assert(msg.ClientId === this.clientId_);
+  this.setCollaborators_(msg.Collaborators);
+  this.ready_ = true;
+  // Any ops sent but not acked were lost along with the old connection, so
+  // send them again.
+  for (var i = 0; i < this.sentOps_.length; i++) {
+    this.sendUpdate_(this.sentOps_[i]);
+  }
+};
+
+Document.prototype.processLeftMsg_ = function(msg) {
+  delete this.collaborators_[msg.ClientId];
+};
+
+Document.prototype.processAckMsg_ = function(msg) {
+  this.basePatchId_ = Number(msg.PatchId);
+  // Materialize our acknowledged ops, using the server-assigned pids for
+  // inserted atoms. Our state matches the server's state just before it
+  // applied our ops, so we expand ClientDelete ops just as the server did.
+  var sentOps = this.sentOps_.shift();
+  var ops = [], pidIdx = 0;
+  for (var i = 0; i < sentOps.length; i++) {
+    var op = sentOps[i];
+    if (op.constructor.name === 'ClientDelete') {
+      var pids = this.logoot_.pidsInRange(op.startPid, op.endPid);
+      for (var k = 0; k < pids.length; k++) {
+        ops.push(new logoot.Delete(pids[k]));
+      }
+      continue;
+    } else if (op.constructor.name !== 'ClientInsert') {
+      ops.push(op);
+      continue;
+    }
+    // The server assigns one pid per code point.
+    var values = lib.codePoints(op.value);
+    for (var j = 0; j < values.length; j++) {
+      var pid = logoot.decodePid(msg.Pids[pidIdx++]);
+      ops.push(new logoot.Insert(pid, values[j]));
+    }
+  }
+  console.assert(pidIdx === (msg.Pids || []).length);
+  this.applyOps_(ops, true);
+  this.scheduleReceived_();
 };
 
 Document.prototype.processChangeMsg_ = function(msg) {
+  this.basePatchId_ = Number(msg.PatchId);
+  console.assert(msg.ClientId !== this.clientId_);
+  this.applyOps_(logoot.decodeOps(msg.OpStrs), false);
+  this.scheduleReceived_();
+};
+
+////////////////////////////////////////////////////////////
+// Other private helpers
+
+// Abandons our session because the server no longer has the history needed to
+// continue it, e.g. after a restart. Once the connection closes, we reconnect
+// as a new client and get a fresh Snapshot. Local changes not yet acknowledged
+// by the server are lost.
+Document.prototype.resync_ = function() {
+  this.clientId_ = null;
+  this.basePatchId_ = null;
+  this.sentOps_ = [];
+};
+
+Document.prototype.setCollaborators_ = function(collaborators) {
+  this.collaborators_ = {};
+  for (var i = 0; i < (collaborators || []).length; i++) {
+    var c = collaborators[i];
+    this.collaborators_[c.ClientId] = c.Meta;
+  }
+};
+
+// Reports the patches we've received to the server, so that it can discard
+// history we no longer need. Updates and selections also report this, but a
+// client that is only viewing the document sends neither. Batches reports made
+// within RECEIVED_DELAY_MS of each other.
+Document.prototype.scheduleReceived_ = function() {
+  if (this.receivedTimer_ !== null) {
+    return;
+  }
+  var that = this;
+  this.receivedTimer_ = window.setTimeout(function() {
+    that.receivedTimer_ = null;
+    if (that.ready_) {
+      that.conn_.send({Type: 'Received', BasePatchId: that.basePatchId_});
+    }
+  }, RECEIVED_DELAY_MS);
+};
+
+// Applies the given Insert and Delete ops to the Logoot and the model.
+Document.prototype.applyOps_ = function(ops, isLocal) {
   var that = this;
-  var isLocal = msg.ClientId === this.clientId_;
 
   // Consecutive single-char insertions and deletions are common, and applying
   // lots of point mutations to the model is expensive (e.g. applying 400 point
@@ -86,7 +263,6 @@ Document.prototype.processChangeMsg_ = function(msg) {
     }
   }
 
-  var ops = logoot.decodeOps(msg.OpStrs);
   for (var i = 0; i < ops.length; i++) {
     var op = ops[i];
     switch(op.constructor.name) {
@@ -102,13 +278,13 @@ Document.prototype.processChangeMsg_ = function(msg) {
       }
       break;
     case 'Delete':
-      var deletePos = this.logoot_.applyDeleteText(op);
-      if (deletePos === pos) {
-        len++;
+      var tup = this.logoot_.applyDeleteText(op);
+      if (tup[0] === pos) {
+        len += tup[1];
       } else {
         applyReplaceText();
-        pos = deletePos;
-        len = 1;
+        pos = tup[0];
+        len = tup[1];
         value = '';
       }
       break;
@@ -119,14 +295,18 @@ Document.prototype.processChangeMsg_ = function(msg) {
   applyReplaceText();
 };
 
-////////////////////////////////////////////////////////////
-// Other private helpers
-
 // TODO: Delta encoding; more efficient pid encoding; compression.
 Document.prototype.sendOps_ = function(ops) {
   if (!ops.length) {
     return;
   }
+  this.sentOps_.push(ops);
+  if (this.ready_) {
+    this.sendUpdate_(ops);
+  }
+};
+
+Document.prototype.sendUpdate_ = function(ops) {
   this.conn_.send({
     Type: 'Update',
     ClientId: this.clientId_,
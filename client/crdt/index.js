@@ -2,9 +2,9 @@
 
 var Doc = require('./document');
 
-function load(addr, docId, onLoad) {
+function load(addr, docId, onLoad, meta, dataType) {
   /* jshint nonew: false */
-  new Doc(addr, docId, onLoad);
+  new Doc(addr, docId, onLoad, meta, dataType);
 }
 
 module.exports = {
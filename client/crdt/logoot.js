@@ -34,6 +34,11 @@ Pid.prototype.less = function(other) {
   return true;
 };
 
+// Returns the id of the agent whose clock stamped this pid.
+Pid.prototype.agentId = function() {
+  return this.ids[this.ids.length - 1].agentId;
+};
+
 Pid.prototype.encode = function() {
   return _.map(this.ids, function(id) {
     return [id.pos, id.agentId].join('.');
@@ -76,6 +81,20 @@ ClientInsert.prototype.encode = function() {
   return ['ci', prevPid, nextPid, this.value].join(',');
 };
 
+// The server expands ClientDelete into a Delete for each atom with
+// startPid <= pid <= endPid in its current state, including atoms inserted
+// concurrently inside the range.
+inherits(ClientDelete, Op);
+function ClientDelete(startPid, endPid) {
+  Op.call(this);
+  this.startPid = startPid;
+  this.endPid = endPid;
+}
+
+ClientDelete.prototype.encode = function() {
+  return ['cd', this.startPid.encode(), this.endPid.encode()].join(',');
+};
+
 inherits(Insert, Op);
 function Insert(pid, value) {
   Op.call(this);
@@ -111,6 +130,12 @@ function decodeOp(s) {
       throw newParseError(s);
     }
     return new ClientInsert(decodePid(parts[1]), decodePid(parts[2]), parts[3]);
+  case 'cd':
+    parts = lib.splitN(s, ',', 3);
+    if (parts.length < 3) {
+      throw newParseError(s);
+    }
+    return new ClientDelete(decodePid(parts[1]), decodePid(parts[2]));
   case 'i':
     parts = lib.splitN(s, ',', 3);
     if (parts.length < 3) {
@@ -149,35 +174,95 @@ function Atom(pid, value) {
   this.value = value;
 }
 
-function Logoot(atoms) {
+function Logoot(atoms, clock) {
   this.atoms_ = atoms;
+  // Version vector: the highest pid seq observed for each agent id. Includes
+  // deleted atoms.
+  this.clock_ = clock;
 }
 
 function decode(s) {
-  var atoms = JSON.parse(s);
-  return new Logoot(_.map(atoms, function(atom) {
+  var state = JSON.parse(s);
+  var atoms = _.map(state.Atoms, function(atom) {
     return new Atom(decodePid(atom.Pid), atom.Value);
-  }));
+  });
+  return new Logoot(atoms, _.clone(state.Clock || {}));
 }
 
+// Each atom holds one code point, which may span two UTF-16 code units, so atom
+// indices and text positions (in UTF-16 code units) differ.
+
+// Returns the number of atoms.
 Logoot.prototype.len = function() {
   return this.atoms_.length;
 };
 
+// Returns the pid of the atom at index i.
 Logoot.prototype.pid = function(i) {
   return this.atoms_[i].pid;
 };
 
+// Returns the pids of all atoms with startPid <= pid <= endPid, in order.
+Logoot.prototype.pidsInRange = function(startPid, endPid) {
+  var res = [];
+  for (var i = this.search_(startPid); i < this.atoms_.length; i++) {
+    var pid = this.atoms_[i].pid;
+    if (endPid.less(pid)) {
+      break;
+    }
+    res.push(pid);
+  }
+  return res;
+};
+
+// Returns a copy of the version vector, which maps each agent id to the highest
+// pid seq observed from that agent.
+Logoot.prototype.clock = function() {
+  return _.clone(this.clock_);
+};
+
+// Returns the index of the first atom at or after the given text position.
+Logoot.prototype.index = function(pos) {
+  var i = 0;
+  for (var p = 0; i < this.atoms_.length && p < pos; i++) {
+    p += this.atoms_[i].value.length;
+  }
+  return i;
+};
+
+// Applies the given Insert and returns its text position.
 Logoot.prototype.applyInsertText = function(op) {
+  this.observe_(op.pid);
   var p = this.search_(op.pid);
   this.atoms_.splice(p, 0, {pid: op.pid, value: op.value});
-  return p;
+  return this.pos_(p);
 };
 
+// Applies the given Delete and returns [pos, len], the text position and
+// length of the deleted atom.
 Logoot.prototype.applyDeleteText = function(op) {
+  this.observe_(op.pid);
   var p = this.search_(op.pid);
-  this.atoms_.splice(p, 1);
-  return p;
+  var pos = this.pos_(p);
+  var deleted = this.atoms_.splice(p, 1);
+  return [pos, deleted[0].value.length];
+};
+
+// Returns the text position of the atom at index i.
+Logoot.prototype.pos_ = function(i) {
+  var pos = 0;
+  for (var j = 0; j < i; j++) {
+    pos += this.atoms_[j].value.length;
+  }
+  return pos;
+};
+
+// Advances the clock for the agent that stamped pid to at least pid's seq.
+Logoot.prototype.observe_ = function(pid) {
+  var agentId = pid.agentId();
+  if (!(this.clock_[agentId] >= pid.seq)) {
+    this.clock_[agentId] = pid.seq;
+  }
 };
 
 Logoot.prototype.search_ = function(pid) {
@@ -189,8 +274,10 @@ Logoot.prototype.search_ = function(pid) {
 
 module.exports = {
   ClientInsert: ClientInsert,
+  ClientDelete: ClientDelete,
   Insert: Insert,
   Delete: Delete,
+  decodePid: decodePid,
   encodeOps: encodeOps,
   decodeOps: decodeOps,
   Logoot: Logoot,
@@ -43,4 +43,23 @@ exports.search = function(n, f) {
   return i;
 };
 
+// Splits s into code points, keeping each surrogate pair together. Mimics
+// ranging over a Go string.
+exports.codePoints = function(s) {
+  var res = [];
+  for (var i = 0; i < s.length; i++) {
+    var c = s.charCodeAt(i);
+    if (c >= 0xd800 && c < 0xdc00 && i + 1 < s.length) {
+      var d = s.charCodeAt(i + 1);
+      if (d >= 0xdc00 && d < 0xe000) {
+        res.push(s.substr(i, 2));
+        i++;
+        continue;
+      }
+    }
+    res.push(s.charAt(i));
+  }
+  return res;
+};
+
 exports.Conn = require('./conn');
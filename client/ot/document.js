@@ -1,9 +1,7 @@
 // Document class.
 //
 // TODO:
-// - Track selection ranges at server
 // - Support other ranges (e.g. bold)
-// - Support undo/redo
 // - Maybe add canUndo/canRedo properties
 // - Check for race conditions
 
@@ -14,13 +12,25 @@ var text = require('./text');
 
 module.exports = Document;
 
+// Delay before reconnecting after the connection drops.
+var RECONNECT_DELAY_MS = 1000;
+// Delay before telling the server which patches we've received.
+var RECEIVED_DELAY_MS = 1000;
+
 // Similar to gapi.drive.realtime.Document.
-function Document(addr, docId, onLoad) {
-  var that = this;
+// meta is optional display metadata for this client, e.g. {name: 'alice'}.
+function Document(addr, docId, onLoad, meta) {
+  this.addr_ = addr;
+  this.docId_ = docId;
+  this.onLoad_ = onLoad;
+  this.meta_ = meta || null;
 
   // Initialized by processSnapshotMsg_.
   this.clientId_ = null;
   this.m_ = null;
+
+  // Map of client id to metadata for other clients connected to this document.
+  this.collaborators_ = {};
   this.basePatchId_ = null;  // last patch we've gotten from server
 
   // All past client ops. Bridge from latest server-acked state to client state
@@ -31,38 +41,126 @@ function Document(addr, docId, onLoad) {
   this.sentClientOpIdx_ = -1;
   this.ackedClientOpIdx_ = -1;
 
-  // Initialize connection.
-  this.conn_ = new lib.Conn(addr);
+  // Our selection, if it has not yet been sent to the server. We only send our
+  // selection when client state matches server state.
+  this.selection_ = null;
+  // Map of client id to text.Selection for other clients, in client state
+  // coordinates.
+  this.selections_ = {};
+
+  // Undo and Redo message types not yet sent to the server. Like selections,
+  // we only send these when client state matches server state, so that they
+  // apply to our latest ops.
+  this.undos_ = [];
+
+  // Whether the server is ready to receive updates, i.e. we've gotten a
+  // Snapshot or Resumed message on the current connection.
+  this.ready_ = false;
+  // Whether the server reported an error. If so, we do not reconnect.
+  this.failed_ = false;
+  // Pending timer for scheduleReceived_, if any.
+  this.receivedTimer_ = null;
+
+  this.connect_();
+}
+
+// Connects to the server. If we've connected before, resumes our previous
+// session so that buffered ops are not lost.
+Document.prototype.connect_ = function() {
+  var that = this;
+  this.conn_ = new lib.Conn(this.addr_);
 
   this.conn_.on('open', function() {
-    that.conn_.send({
+    var msg = {
       Type: 'Init',
-      DocId: docId,
-      DataType: 'ot.Text'
-    });
+      DocId: that.docId_,
+      DataType: 'ot.Text',
+      Meta: that.meta_
+    };
+    if (that.clientId_ !== null) {
+      msg.Resume = true;
+      msg.ClientId = that.clientId_;
+      msg.BasePatchId = that.basePatchId_;
+    }
+    that.conn_.send(msg);
+  });
+
+  this.conn_.on('close', function() {
+    that.ready_ = false;
+    if (!that.failed_) {
+      window.setTimeout(that.connect_.bind(that), RECONNECT_DELAY_MS);
+    }
   });
 
   this.conn_.on('recv', function(msg) {
     switch (msg.Type) {
     case 'Snapshot':
+      var loaded = that.m_ !== null;
       that.processSnapshotMsg_(msg);
-      return onLoad(that);
+      if (!loaded) {
+        that.onLoad_(that);
+      }
+      return;
+    case 'Resumed':
+      return that.processResumedMsg_(msg);
+    case 'Joined':
+      that.collaborators_[msg.ClientId] = msg.Meta;
+      return;
+    case 'Left':
+      return that.processLeftMsg_(msg);
+    case 'Ack':
+      return that.processAckMsg_(msg);
     case 'Change':
       return that.processChangeMsg_(msg);
+    case 'Selection':
+      return that.processSelectionMsg_(msg);
+    case 'Error':
+      // The server closes the connection after sending an Error.
+      if (msg.Code === 'ResyncRequired') {
+        return that.resync_();
+      }
+      that.failed_ = true;
+      throw new Error('server error: ' + msg.Code + ': ' + msg.Message);
     default:
       throw new Error('unknown message type: ' + msg.Type);
     }
   });
-}
+};
 
+// Returns a map of client id to metadata for other clients connected to this
+// document.
 Document.prototype.getCollaborators = function() {
-  throw new Error('not implemented');
+  return this.collaborators_;
 };
 
 Document.prototype.getModel = function() {
   return this.m_;
 };
 
+// Returns a map of client id to text.Selection for other clients.
+Document.prototype.getSelections = function() {
+  return this.selections_;
+};
+
+// Publishes our selection to other clients.
+Document.prototype.setSelection = function(start, end) {
+  this.selection_ = new text.Selection(start, end);
+  this.maybeSendSelection_();
+};
+
+// Undoes our most recent op that has not already been undone. The server sends
+// the resulting patch back to us as a Change.
+Document.prototype.undo = function() {
+  this.undos_.push('Undo');
+  this.maybeSendUndos_();
+};
+
+// Redoes our most recent undo, unless we've since made other changes.
+Document.prototype.redo = function() {
+  this.undos_.push('Redo');
+  this.maybeSendUndos_();
+};
+
 ////////////////////////////////////////////////////////////
 // Model event handlers
 
@@ -75,6 +173,7 @@ Document.prototype.handleReplaceText = function(pos, len, value) {
   if (value.length) {
     ops.push(new text.Insert(pos, value));
   }
+  this.transformSelections_(ops);
   this.pushOps_(ops);
 };
 
@@ -85,7 +184,42 @@ Document.prototype.processSnapshotMsg_ = function(msg) {
   console.assert(this.clientId_ === null);
   this.clientId_ = msg.ClientId;
   this.basePatchId_ = Number(msg.BasePatchId);
-  this.m_ = new eddie.AsyncModel(this, msg.Text);
+  if (this.m_ === null) {
+    this.m_ = new eddie.AsyncModel(this, msg.Text);
+  } else {
+    // We're resyncing, so replace the model's text.
+    this.m_.applyReplaceText(false, 0, this.m_.getText().length, msg.Text);
+  }
+  this.setCollaborators_(msg.Collaborators);
+  for (var i = 0; i < (msg.Selections || []).length; i++) {
+    var sel = msg.Selections[i];
+    this.selections_[sel.ClientId] = new text.Selection(sel.Start, sel.End);
+  }
+  this.ready_ = true;
+};
+
+Document.prototype.processResumedMsg_ = function(msg) {
+  console.assert(msg.ClientId === this.clientId_);
+  this.setCollaborators_(msg.Collaborators);
+  this.ready_ = true;
+  // Any ops sent but not acked were lost along with the old connection, so
+  // send them again, along with any ops buffered while disconnected.
+  this.sentClientOpIdx_ = this.ackedClientOpIdx_;
+  this.sendBufferedOps_();
+  this.maybeSendUndos_();
+};
+
+Document.prototype.processAckMsg_ = function(msg) {
+  var newBasePatchId = Number(msg.PatchId);
+  console.assert(newBasePatchId === this.basePatchId_ + 1);
+  this.basePatchId_ = newBasePatchId;
+
+  // Our patch was accepted, so send all buffered ops to server.
+  this.ackedClientOpIdx_ = this.sentClientOpIdx_;
+  this.sendBufferedOps_();
+  this.maybeSendSelection_();
+  this.maybeSendUndos_();
+  this.scheduleReceived_();
 };
 
 Document.prototype.processChangeMsg_ = function(msg) {
@@ -93,13 +227,8 @@ Document.prototype.processChangeMsg_ = function(msg) {
   console.assert(newBasePatchId === this.basePatchId_ + 1);
   this.basePatchId_ = newBasePatchId;
 
-  // If the patch is from this client, send all buffered ops to server.
-  // Otherwise, transform it against all buffered ops and then apply it.
-  if (msg.ClientId === this.clientId_) {
-    this.ackedClientOpIdx_ = this.sentClientOpIdx_;
-    this.sendBufferedOps_();
-    return;
-  }
+  // Transform the patch against all buffered ops and then apply it. Note, the
+  // patch may be from us if it was created by Undo or Redo.
   var ops = text.decodeOps(msg.OpStrs);
   var tup = text.transformPatch(
     this.clientOps_.slice(this.ackedClientOpIdx_ + 1), ops);
@@ -124,24 +253,132 @@ Document.prototype.processChangeMsg_ = function(msg) {
       throw new Error(op.constructor.name);
     }
   }
+  this.transformSelections_(ops);
+  this.scheduleReceived_();
+};
+
+Document.prototype.processLeftMsg_ = function(msg) {
+  delete this.collaborators_[msg.ClientId];
+  delete this.selections_[msg.ClientId];
+};
+
+Document.prototype.processSelectionMsg_ = function(msg) {
+  // The server sends selections relative to the latest patch, which we've
+  // already received. Transform against our buffered ops to get client state
+  // coordinates.
+  console.assert(Number(msg.PatchId) === this.basePatchId_);
+  this.selections_[msg.ClientId] = text.transformSelection(
+    new text.Selection(msg.Start, msg.End),
+    this.clientOps_.slice(this.ackedClientOpIdx_ + 1));
 };
 
 ////////////////////////////////////////////////////////////
 // Other private helpers
 
+// Abandons our session because the server no longer has the history needed to
+// continue it, e.g. after a restart. Once the connection closes, we reconnect
+// as a new client and get a fresh Snapshot. Local changes not yet acknowledged
+// by the server are lost.
+Document.prototype.resync_ = function() {
+  this.clientId_ = null;
+  this.basePatchId_ = null;
+  this.clientOps_ = [];
+  this.sentClientOpIdx_ = -1;
+  this.ackedClientOpIdx_ = -1;
+  this.selection_ = null;
+  this.selections_ = {};
+  this.undos_ = [];
+};
+
+Document.prototype.setCollaborators_ = function(collaborators) {
+  this.collaborators_ = {};
+  for (var i = 0; i < (collaborators || []).length; i++) {
+    var c = collaborators[i];
+    this.collaborators_[c.ClientId] = c.Meta;
+  }
+};
+
 Document.prototype.sendBufferedOps_ = function() {
+  if (!this.ready_) {
+    return;  // will send once reconnected
+  }
   console.assert(this.sentClientOpIdx_ === this.ackedClientOpIdx_);
   if (this.sentClientOpIdx_ === this.clientOps_.length - 1) {
     return;  // no ops to send
   }
+  // Compose the buffered ops, e.g. so that typed characters are sent as one
+  // Insert rather than one Insert each. The server transforms concurrent
+  // patches against the ops we send, so we must transform incoming patches
+  // against the same ops, not the uncomposed ones.
+  var ops = text.compose(
+    this.clientOps_.slice(this.ackedClientOpIdx_ + 1), []);
+  this.clientOps_ = this.clientOps_.slice(0, this.ackedClientOpIdx_ + 1)
+    .concat(ops);
+  if (ops.length === 0) {
+    // The buffered ops canceled out, so client state matches server state.
+    this.maybeSendSelection_();
+    this.maybeSendUndos_();
+    return;
+  }
   this.sentClientOpIdx_ = this.clientOps_.length - 1;
-  // TODO: Compact ops (e.g. combine insertions) before sending.
   this.conn_.send({
     Type: 'Update',
     ClientId: this.clientId_,
     BasePatchId: this.basePatchId_,
-    OpStrs: text.encodeOps(this.clientOps_.slice(this.ackedClientOpIdx_ + 1))
+    OpStrs: text.encodeOps(ops)
+  });
+};
+
+Document.prototype.maybeSendSelection_ = function() {
+  if (!this.ready_ || this.selection_ === null ||
+      this.ackedClientOpIdx_ !== this.clientOps_.length - 1) {
+    return;  // will send once client state matches server state
+  }
+  this.conn_.send({
+    Type: 'Select',
+    ClientId: this.clientId_,
+    BasePatchId: this.basePatchId_,
+    Start: this.selection_.start,
+    End: this.selection_.end
   });
+  this.selection_ = null;
+};
+
+Document.prototype.maybeSendUndos_ = function() {
+  if (!this.ready_ ||
+      this.ackedClientOpIdx_ !== this.clientOps_.length - 1) {
+    return;  // will send once client state matches server state
+  }
+  for (var i = 0; i < this.undos_.length; i++) {
+    this.conn_.send({Type: this.undos_[i]});
+  }
+  this.undos_ = [];
+};
+
+// Reports the patches we've received to the server, so that it can discard
+// history we no longer need. Updates and selections also report this, but a
+// client that is only viewing the document sends neither. Batches reports made
+// within RECEIVED_DELAY_MS of each other.
+Document.prototype.scheduleReceived_ = function() {
+  if (this.receivedTimer_ !== null) {
+    return;
+  }
+  var that = this;
+  this.receivedTimer_ = window.setTimeout(function() {
+    that.receivedTimer_ = null;
+    if (that.ready_) {
+      that.conn_.send({Type: 'Received', BasePatchId: that.basePatchId_});
+    }
+  }, RECEIVED_DELAY_MS);
+};
+
+Document.prototype.transformSelections_ = function(ops) {
+  for (var clientId in this.selections_) {
+    if (this.selections_.hasOwnProperty(clientId)) {
+      this.selections_[clientId] = text.transformSelection(
+        this.selections_[clientId], ops);
+    }
+  }
 };
 
 Document.prototype.pushOps_ = function(ops) {
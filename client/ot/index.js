@@ -5,9 +5,9 @@
 var Doc = require('./document');
 
 // Similar to gapi.drive.realtime.load.
-function load(addr, docId, onLoad) {
+function load(addr, docId, onLoad, meta) {
   /* jshint nonew: false */
-  new Doc(addr, docId, onLoad);
+  new Doc(addr, docId, onLoad, meta);
 }
 
 module.exports = {
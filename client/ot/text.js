@@ -1,4 +1,5 @@
-// Mostly mirrors server/ot/text.go.
+// Mostly mirrors server/ot/text.go. Positions and lengths are in UTF-16 code
+// units, i.e. JavaScript string indices, as on the server.
 // TODO: Shared, data-driven unit tests.
 
 var inherits = require('inherits');
@@ -129,11 +130,127 @@ function transformPatch(a, b) {
   return [aNew, bNew];
 }
 
+// Returns a minimal patch equivalent to applying patch a and then patch b. See
+// Compose in text.go.
+function compose(a, b) {
+  // Components of the delta: {type: 'r' | 'i' | 'd', n: length, value: text}.
+  // Text past the last component is retained.
+  var d = [];
+
+  function width(c) {
+    return c.type === 'd' ? 0 : c.n;
+  }
+
+  // Returns the index of the first component that produces text at or after
+  // pos, splitting or appending components as needed.
+  function boundary(pos) {
+    var out = 0;
+    for (var i = 0; i < d.length; i++) {
+      if (out === pos) {
+        return i;
+      }
+      var c = d[i], w = width(c);
+      if (pos >= out + w) {
+        out += w;
+        continue;
+      }
+      var k = pos - out;
+      var lo = {type: c.type, n: k, value: c.value.slice(0, k)};
+      var hi = {type: c.type, n: c.n - k, value: c.value.slice(k)};
+      d.splice(i, 1, lo, hi);
+      return i + 1;
+    }
+    if (pos > out) {
+      d.push({type: 'r', n: pos - out, value: ''});
+    }
+    return d.length;
+  }
+
+  var ops = a.concat(b), i, j;
+  for (i = 0; i < ops.length; i++) {
+    var op = ops[i];
+    switch (op.constructor.name) {
+    case 'Insert':
+      d.splice(boundary(op.pos), 0,
+               {type: 'i', n: op.value.length, value: op.value});
+      break;
+    case 'Delete':
+      var start = boundary(op.pos), end = boundary(op.pos + op.len);
+      // Deleting retained text deletes it from the original string, while
+      // deleting inserted text cancels the insert.
+      var mid = [];
+      for (j = start; j < end; j++) {
+        if (d[j].type === 'r') {
+          mid.push({type: 'd', n: d[j].n, value: ''});
+        } else if (d[j].type === 'd') {
+          mid.push(d[j]);
+        }
+      }
+      d = d.slice(0, start).concat(mid, d.slice(end));
+      break;
+    default:
+      throw new Error(op.constructor.name);
+    }
+  }
+
+  // Between retained regions, deletes and inserts commute, so each region
+  // becomes one Delete followed by one Insert.
+  var res = [], pos = 0, del = 0, ins = '';
+  function flush() {
+    if (del > 0) {
+      res.push(new Delete(pos, del));
+    }
+    if (ins) {
+      res.push(new Insert(pos, ins));
+      pos += ins.length;
+    }
+    del = 0;
+    ins = '';
+  }
+  for (i = 0; i < d.length; i++) {
+    var c = d[i];
+    if (c.type === 'r') {
+      if (c.n > 0) {
+        flush();
+        pos += c.n;
+      }
+    } else if (c.type === 'i') {
+      ins += c.value;
+    } else {
+      del += c.n;
+    }
+  }
+  flush();
+  return res;
+}
+
+function Selection(start, end) {
+  this.start = start;
+  this.end = end;
+}
+
+// Positions behave like empty inserts, so text inserted at a position ends up
+// before it.
+function transformPos(pos, op) {
+  return transform(new Insert(pos, ''), op)[0].pos;
+}
+
+function transformSelection(sel, ops) {
+  for (var i = 0; i < ops.length; i++) {
+    sel = new Selection(transformPos(sel.start, ops[i]),
+                        transformPos(sel.end, ops[i]));
+  }
+  return sel;
+}
+
 module.exports = {
   Insert: Insert,
   Delete: Delete,
+  Selection: Selection,
   encodeOps: encodeOps,
   decodeOps: decodeOps,
   transform: transform,
   transformPatch: transformPatch,
+  compose: compose,
+  transformSelection: transformSelection,
 };
@@ -18,6 +18,7 @@ var (
 	loopback = flag.Bool("loopback", true, "")
 	port     = flag.Int("port", 4000, "")
 	mode     = flag.String("mode", "ot", "")
+	dataDir  = flag.String("data_dir", "", "if set, directory for persisted documents")
 )
 
 var serve = gosh.RegisterFunc("serve", hub.Serve)
@@ -55,7 +56,7 @@ func main() {
 	}
 	addr := fmt.Sprintf("%s:%d", hostname, *port)
 	httpAddr := fmt.Sprintf("%s:%d", hostname, *port+100)
-	c := sh.FuncCmd(serve, addr)
+	c := sh.FuncCmd(serve, addr, *dataDir)
 	c.AddStderrWriter(os.Stderr)
 	c.Start()
 	c.AwaitVars("ready")
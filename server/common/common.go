@@ -1,9 +1,18 @@
 package common
 
 import (
+	"errors"
 	"strconv"
 )
 
+// ErrResyncRequired is returned by data types when they no longer have the
+// history needed to process a request.
+var ErrResyncRequired = errors.New("resync required")
+
+// ErrNothingToUndo is returned by data types when a client asks to undo or redo
+// but has nothing to undo or redo.
+var ErrNothingToUndo = errors.New("nothing to undo")
+
 func Atoi(s string) (uint32, error) {
 	i, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
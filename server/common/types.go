@@ -9,31 +9,124 @@ type MsgType struct {
 // Sent from client to server.
 type Init struct {
 	Type     string
-	DocId    uint32
-	DataType string // "ot.Text" or "crdt.Logoot"
+	DocId    uint32            // document to subscribe to
+	DataType string            // e.g. "ot.Text" or "crdt.Logoot"; see hub.newDataType
+	Meta     map[string]string // optional display metadata, e.g. user name
+
+	// If Resume is true, the client is reconnecting as ClientId, having seen
+	// all patches up to and including BasePatchId. Instead of a Snapshot, the
+	// server replays all later patches (as Ack or Change messages) and then
+	// sends a Resumed message.
+	Resume      bool
+	ClientId    uint32
+	BasePatchId uint32
+}
+
+// Collaborator describes a client connected to a document.
+type Collaborator struct {
+	ClientId uint32
+	Meta     map[string]string // as specified in Init
 }
 
 // Sent from server to client.
 type Snapshot struct {
-	Type     string
-	ClientId uint32 // id for this client
+	Type          string
+	ClientId      uint32         // id for this client
+	Collaborators []Collaborator // other clients connected to this document
 
 	// Type-specific data.
-	BasePatchId uint32 // initial BasePatchId
-	Text        string // initial text
-	LogootStr   string // encoded crdt.Logoot
+	BasePatchId uint32      // initial BasePatchId
+	Text        string      // initial text
+	LogootStr   string      // encoded crdt.Logoot
+	State       string      // encoded state, for other crdt types
+	Selections  []Selection // other clients' selections, for ot.Text
+}
+
+// Sent from client to server to publish the client's selection.
+type Select struct {
+	Type     string
+	ClientId uint32 // ignored; the server uses the sender's ClientId
+
+	BasePatchId uint32 // PatchId against which Start and End are expressed
+	Start       int
+	End         int
+}
+
+// Sent from server to client when another client's selection changes.
+type Selection struct {
+	Type     string
+	ClientId uint32 // client whose selection this is
+
+	PatchId uint32 // PatchId against which Start and End are expressed
+	Start   int
+	End     int
+}
+
+// Sent from server to client after replaying patches to a resumed client.
+// After receiving Resumed, the client should resend any unacknowledged ops.
+type Resumed struct {
+	Type          string
+	ClientId      uint32         // id for this client, same as in Init
+	Collaborators []Collaborator // other clients connected to this document
+}
+
+// Sent from server to client when another client connects to the document.
+type Joined struct {
+	Type string
+	Collaborator
+}
+
+// Sent from server to client when another client disconnects from the
+// document.
+type Left struct {
+	Type     string
+	ClientId uint32
 }
 
 // Sent from client to server.
 type Update struct {
 	Type     string
-	ClientId uint32 // client that created this patch
+	ClientId uint32 // ignored; the server uses the sender's ClientId
 
 	// Type-specific data.
 	BasePatchId uint32   // PatchId against which this patch was performed
 	OpStrs      []string // encoded ops
 }
 
+// Sent from server to the client that sent an Update, once the Update has been
+// applied. All other clients receive a Change instead.
+type Ack struct {
+	Type string
+
+	// Type-specific data.
+	PatchId uint32   // PatchId assigned to the Update
+	Pids    []string // encoded pids assigned to clientInsert atoms, in order
+}
+
+// Sent from client to server to undo one of the client's own patches. The
+// server applies the inverse patch and sends it to all clients, including the
+// sender, as a Change.
+type Undo struct {
+	Type    string
+	PatchId uint32 // patch to undo; 0 means the client's most recent patch
+}
+
+// Sent from client to server to redo a patch undone by the client. The server
+// sends the resulting patch to all clients, including the sender, as a Change.
+type Redo struct {
+	Type    string
+	PatchId uint32 // patch created by Undo; 0 means the most recent one
+}
+
+// Sent from client to server after applying Acks or Changes, to report that the
+// client has received all patches up to and including BasePatchId. The server
+// discards history that no connected client needs, so clients that do not
+// otherwise send BasePatchId, e.g. read-only viewers, must send Received.
+type Received struct {
+	Type        string
+	BasePatchId uint32
+}
+
 // Sent from server to client.
 type Change struct {
 	Type     string
@@ -43,3 +136,23 @@ type Change struct {
 	PatchId uint32
 	OpStrs  []string // encoded ops
 }
+
+// Sent from server to client when the server rejects a client message. The
+// server closes the connection after sending an Error.
+type Error struct {
+	Type    string
+	Code    string // one of the Code* constants
+	Message string // human-readable description
+}
+
+// Error codes.
+const (
+	CodeBadMessage = "BadMessage" // malformed message or unknown message type
+	CodeBadInit    = "BadInit"    // Init for unknown data type
+	CodeBadState   = "BadState"   // message not valid in current stream state
+	CodeBadUpdate  = "BadUpdate"  // Update rejected by the data type
+	CodeInternal   = "Internal"   // server-side failure
+	// The server no longer has the history needed to process the message. The
+	// client should discard its state and Init without Resume.
+	CodeResyncRequired = "ResyncRequired"
+)
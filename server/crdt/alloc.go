@@ -0,0 +1,84 @@
+package crdt
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Allocator is a strategy for allocating pids for inserted atoms.
+type Allocator int
+
+const (
+	// RandomAllocator picks a uniformly random position between neighbouring
+	// pids, with the same base at every depth.
+	RandomAllocator Allocator = iota
+	// LSEQAllocator implements LSEQ: the base doubles with each depth, and new
+	// positions are picked within lseqBoundary of the previous pid (boundary+)
+	// at even depths and of the next pid (boundary-) at odd depths. This keeps
+	// pids short under both append-heavy and prepend-heavy editing. See "LSEQ:
+	// an adaptive structure for sequences in distributed collaborative editing"
+	// (Nédelec et al., 2013).
+	LSEQAllocator
+)
+
+const (
+	lseqInitialBits = 4  // base at depth 0 is 2^lseqInitialBits
+	lseqBoundary    = 10 // max distance from the neighbouring position
+)
+
+// base returns the exclusive upper bound for positions at the given depth.
+func (alloc Allocator) base(depth int) uint32 {
+	if alloc == LSEQAllocator && lseqInitialBits+depth < 32 {
+		return 1 << uint(lseqInitialBits+depth)
+	}
+	return math.MaxUint32
+}
+
+// between returns a position strictly between lo and hi at the given depth.
+// Requires hi-lo > 1.
+func (alloc Allocator) between(depth int, lo, hi uint32) uint32 {
+	if alloc != LSEQAllocator {
+		return randUint32Between(lo, hi)
+	}
+	step := hi - lo - 1
+	if step > lseqBoundary {
+		step = lseqBoundary
+	}
+	r := 1 + uint32(rand.Int63n(int64(step)))
+	if depth%2 == 0 {
+		return lo + r // boundary+
+	}
+	return hi - r // boundary-
+}
+
+func randUint32Between(prev, next uint32) uint32 {
+	return prev + 1 + uint32(rand.Int63n(int64(next-prev-1)))
+}
+
+// genIds returns ids that sort strictly between prev and next, where empty
+// prev and next mean the start and end of the document. The last id is new and
+// belongs to agentId; the rest are copied from prev. The new id is allocated at
+// depth minDepth or deeper, so the first minDepth ids of prev are kept as a
+// prefix. Requires len(prev) >= minDepth.
+func genIds(alloc Allocator, agentId uint32, prev, next []id, minDepth int) []id {
+	var res []id
+	bounded := true // whether res is a prefix of next
+	for depth := 0; ; depth++ {
+		lo := id{} // past the end of prev, any position is greater than prev
+		if depth < len(prev) {
+			lo = prev[depth]
+		}
+		hi := alloc.base(depth)
+		if bounded && depth < len(next) {
+			hi = next[depth].Pos
+		}
+		if depth >= minDepth && hi > lo.Pos && hi-lo.Pos > 1 {
+			return append(res, id{Pos: alloc.between(depth, lo.Pos, hi), AgentId: agentId})
+		}
+		// No room at this depth, so go deeper.
+		res = append(res, lo)
+		if bounded && (depth >= len(next) || lo != next[depth]) {
+			bounded = false
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package crdt_test
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/crdt"
+)
+
+var allocators = []struct {
+	name  string
+	alloc crdt.Allocator
+}{
+	{"random", crdt.RandomAllocator},
+	{"lseq", crdt.LSEQAllocator},
+}
+
+// traces map trace names to functions that return the position of the i'th
+// insert, given the current document length.
+var traces = []struct {
+	name string
+	pos  func(rng *rand.Rand, n int) int
+}{
+	{"append", func(rng *rand.Rand, n int) int { return n }},
+	{"prepend", func(rng *rand.Rand, n int) int { return 0 }},
+	{"random", func(rng *rand.Rand, n int) int { return rng.Intn(n + 1) }},
+}
+
+// runTrace performs numOps single-character inserts at positions given by pos,
+// returning the final text and the encoded pids of all atoms, in order.
+func runTrace(t testing.TB, alloc crdt.Allocator, pos func(rng *rand.Rand, n int) int, numOps int) (string, []string) {
+	l := crdt.NewLogoot()
+	l.SetAllocator(alloc)
+	rng := rand.New(rand.NewSource(1))
+	var pids []string
+	var text []byte
+	for i := 0; i < numOps; i++ {
+		p := pos(rng, len(pids))
+		var prev, next string
+		if p > 0 {
+			prev = pids[p-1]
+		}
+		if p < len(pids) {
+			next = pids[p]
+		}
+		c := byte('a' + i%26)
+		_, a := applyUpdateAck(t, l, 0, "ci,"+prev+","+next+","+string(c))
+		pids = append(pids[:p], append([]string{a.Pids[0]}, pids[p:]...)...)
+		text = append(text[:p], append([]byte{c}, text[p:]...)...)
+	}
+	if got := snapshot(t, l).Text; got != string(text) {
+		fatalf(t, "got %q, want %q", got, text)
+	}
+	return string(text), pids
+}
+
+func TestAllocators(t *testing.T) {
+	for _, a := range allocators {
+		for _, tr := range traces {
+			// runTrace checks that atoms end up in the intended order.
+			runTrace(t, a.alloc, tr.pos, 500)
+		}
+	}
+}
+
+func TestLSEQPidsAreShort(t *testing.T) {
+	for _, tr := range traces {
+		_, pids := runTrace(t, crdt.LSEQAllocator, tr.pos, 1000)
+		for _, pid := range pids {
+			if depth := pidDepth(pid); depth > 12 {
+				fatalf(t, "%s: pid too deep: %s", tr.name, pid)
+			}
+		}
+	}
+}
+
+// pidDepth returns the number of ids in the given encoded pid.
+func pidDepth(pid string) int {
+	return strings.Count(strings.SplitN(pid, "~", 2)[0], ":") + 1
+}
+
+// BenchmarkAllocators reports the average pid depth and encoded pid size after
+// 1000 single-character inserts.
+func BenchmarkAllocators(b *testing.B) {
+	for _, a := range allocators {
+		for _, tr := range traces {
+			b.Run(a.name+"/"+tr.name, func(b *testing.B) {
+				var depth, size int
+				var numPids int
+				for i := 0; i < b.N; i++ {
+					_, pids := runTrace(b, a.alloc, tr.pos, 1000)
+					for _, pid := range pids {
+						depth += pidDepth(pid)
+						size += len(pid)
+					}
+					numPids += len(pids)
+				}
+				b.ReportMetric(float64(depth)/float64(numPids), "depth/pid")
+				b.ReportMetric(float64(size)/float64(numPids), "bytes/pid")
+			})
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package crdt
+
+import (
+	"math/rand"
+)
+
+// atomTree is an order-statistic tree of atoms, ordered by pid. It supports
+// O(log n) insert, delete, pid-to-index and index-to-atom lookups. It is
+// implemented as a treap, i.e. a binary search tree on pids that is also a heap
+// on randomly assigned node priorities, which keeps it balanced in expectation.
+// The zero value is an empty tree.
+type atomTree struct {
+	root *atomNode
+}
+
+type atomNode struct {
+	atom
+	prio        uint32
+	size        int // number of atoms in this subtree
+	left, right *atomNode
+}
+
+func (n *atomNode) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func (n *atomNode) update() {
+	n.size = n.left.len() + 1 + n.right.len()
+}
+
+// len returns the number of atoms in the tree.
+func (t *atomTree) len() int {
+	return t.root.len()
+}
+
+// find returns the index of the first atom with pid >= p, along with that atom
+// if its pid equals p, else nil.
+func (t *atomTree) find(p *pid) (int, *atom) {
+	i := 0
+	for n := t.root; n != nil; {
+		switch {
+		case p.Less(n.Pid):
+			n = n.left
+		case n.Pid.Less(p):
+			i += n.left.len() + 1
+			n = n.right
+		default:
+			return i + n.left.len(), &n.atom
+		}
+	}
+	return i, nil
+}
+
+// at returns the atom at index i.
+func (t *atomTree) at(i int) *atom {
+	assert(i >= 0 && i < t.len())
+	n := t.root
+	for {
+		switch k := n.left.len(); {
+		case i < k:
+			n = n.left
+		case i > k:
+			i -= k + 1
+			n = n.right
+		default:
+			return &n.atom
+		}
+	}
+}
+
+// insert inserts a, whose pid must not already be present, and returns its
+// index.
+func (t *atomTree) insert(a atom) int {
+	lo, hi := splitNodes(t.root, a.Pid)
+	i := lo.len()
+	n := &atomNode{atom: a, prio: rand.Uint32(), size: 1}
+	t.root = mergeNodes(mergeNodes(lo, n), hi)
+	return i
+}
+
+// delete deletes the atom with pid p and returns its former index, or -1 if
+// there is no such atom.
+func (t *atomTree) delete(p *pid) int {
+	i, a := t.find(p)
+	if a == nil {
+		return -1
+	}
+	t.root = deleteNode(t.root, p)
+	return i
+}
+
+// ascend calls f on each atom with pid >= p, in order, until f returns false.
+func (t *atomTree) ascend(p *pid, f func(a *atom) bool) {
+	ascendNodes(t.root, p, f)
+}
+
+// atoms returns all atoms in order.
+func (t *atomTree) atoms() []atom {
+	res := make([]atom, 0, t.len())
+	var walk func(n *atomNode)
+	walk = func(n *atomNode) {
+		if n == nil {
+			return
+		}
+		walk(n.left)
+		res = append(res, n.atom)
+		walk(n.right)
+	}
+	walk(t.root)
+	return res
+}
+
+// splitNodes splits n into the atoms with pid < p and the atoms with pid >= p.
+func splitNodes(n *atomNode, p *pid) (lo, hi *atomNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if n.Pid.Less(p) {
+		n.right, hi = splitNodes(n.right, p)
+		lo = n
+	} else {
+		lo, n.left = splitNodes(n.left, p)
+		hi = n
+	}
+	n.update()
+	return lo, hi
+}
+
+// mergeNodes joins lo and hi, where every pid in lo is less than every pid in hi.
+func mergeNodes(lo, hi *atomNode) *atomNode {
+	switch {
+	case lo == nil:
+		return hi
+	case hi == nil:
+		return lo
+	case lo.prio > hi.prio:
+		lo.right = mergeNodes(lo.right, hi)
+		lo.update()
+		return lo
+	default:
+		hi.left = mergeNodes(lo, hi.left)
+		hi.update()
+		return hi
+	}
+}
+
+func deleteNode(n *atomNode, p *pid) *atomNode {
+	switch {
+	case p.Less(n.Pid):
+		n.left = deleteNode(n.left, p)
+	case n.Pid.Less(p):
+		n.right = deleteNode(n.right, p)
+	default:
+		return mergeNodes(n.left, n.right)
+	}
+	n.update()
+	return n
+}
+
+func ascendNodes(n *atomNode, p *pid, f func(a *atom) bool) bool {
+	if n == nil {
+		return true
+	}
+	if !n.Pid.Less(p) {
+		if !ascendNodes(n.left, p, f) || !f(&n.atom) {
+			return false
+		}
+	}
+	return ascendNodes(n.right, p, f)
+}
@@ -0,0 +1,147 @@
+package crdt
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// atomSlice is the flat sorted slice that atomTree replaced, kept as a
+// reference implementation for tests and benchmarks.
+type atomSlice struct {
+	atoms []atom
+	text  []rune // text[i] is atoms[i].Value
+}
+
+func (s *atomSlice) search(p *pid) int {
+	return sort.Search(len(s.atoms), func(i int) bool { return !s.atoms[i].Pid.Less(p) })
+}
+
+func (s *atomSlice) insert(a atom) int {
+	i := s.search(a.Pid)
+	s.atoms = append(s.atoms, atom{})
+	copy(s.atoms[i+1:], s.atoms[i:])
+	s.atoms[i] = a
+	s.text = append(s.text, 0)
+	copy(s.text[i+1:], s.text[i:])
+	s.text[i] = a.Value
+	return i
+}
+
+func (s *atomSlice) delete(p *pid) int {
+	i := s.search(p)
+	if i == len(s.atoms) || !s.atoms[i].Pid.Equal(p) {
+		return -1
+	}
+	s.atoms = append(s.atoms[:i], s.atoms[i+1:]...)
+	s.text = append(s.text[:i], s.text[i+1:]...)
+	return i
+}
+
+// randPids returns n distinct pids in random order.
+func randPids(rng *rand.Rand, n int) []*pid {
+	res := make([]*pid, n)
+	for i := range res {
+		res[i] = &pid{Ids: []id{{Pos: uint32(i), AgentId: uint32(rng.Intn(4))}}, Seq: uint32(i)}
+		// Give some pids a second id, so that not all pids have the same depth.
+		if rng.Intn(2) == 0 {
+			res[i].Ids = append(res[i].Ids, id{Pos: rng.Uint32(), AgentId: 0})
+		}
+	}
+	rng.Shuffle(n, func(i, j int) { res[i], res[j] = res[j], res[i] })
+	return res
+}
+
+func TestAtomTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	pids := randPids(rng, 2000)
+	var tr atomTree
+	var sl atomSlice
+	check := func() {
+		if tr.len() != len(sl.atoms) {
+			t.Fatalf("got len %d, want %d", tr.len(), len(sl.atoms))
+		}
+		if len(sl.atoms) > 0 && !reflect.DeepEqual(tr.atoms(), sl.atoms) {
+			t.Fatal("atoms differ")
+		}
+		for i, a := range sl.atoms {
+			if got := tr.at(i); !got.Pid.Equal(a.Pid) {
+				t.Fatalf("at(%d): got %v, want %v", i, got.Pid, a.Pid)
+			}
+			if j, got := tr.find(a.Pid); j != i || got == nil || got.Value != a.Value {
+				t.Fatalf("find(%v): got %d, %v, want %d", a.Pid, j, got, i)
+			}
+		}
+	}
+	for i, p := range pids {
+		a := atom{Pid: p, Value: rune('a' + i%26)}
+		if got, want := tr.insert(a), sl.insert(a); got != want {
+			t.Fatalf("insert: got %d, want %d", got, want)
+		}
+		// Delete a random pid, which may or may not be present.
+		if rng.Intn(3) == 0 {
+			p := pids[rng.Intn(len(pids))]
+			if got, want := tr.delete(p), sl.delete(p); got != want {
+				t.Fatalf("delete: got %d, want %d", got, want)
+			}
+		}
+		if i%100 == 0 {
+			check()
+		}
+	}
+	check()
+
+	// Check ascend, including early termination.
+	for _, p := range pids[:100] {
+		start := sl.search(p)
+		var got []*pid
+		tr.ascend(p, func(a *atom) bool {
+			got = append(got, a.Pid)
+			return len(got) < 10
+		})
+		var want []*pid
+		for i := start; i < len(sl.atoms) && len(want) < 10; i++ {
+			want = append(want, sl.atoms[i].Pid)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("ascend(%v): got %v, want %v", p, got, want)
+		}
+	}
+}
+
+// BenchmarkAtoms measures the cost of inserting and then deleting one atom at
+// a random position in a document of the given size.
+func BenchmarkAtoms(b *testing.B) {
+	for _, n := range []int{1e4, 1e5, 1e6} {
+		rng := rand.New(rand.NewSource(0))
+		pids := randPids(rng, n+1)
+		extra := pids[n]
+		atoms := make([]atom, n)
+		for i, p := range pids[:n] {
+			atoms[i] = atom{Pid: p, Value: 'x'}
+		}
+		sort.Slice(atoms, func(i, j int) bool { return atoms[i].Pid.Less(atoms[j].Pid) })
+
+		b.Run(fmt.Sprintf("slice/n=%d", n), func(b *testing.B) {
+			s := &atomSlice{atoms: append([]atom(nil), atoms...), text: make([]rune, n)}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.insert(atom{Pid: extra, Value: 'y'})
+				s.delete(extra)
+			}
+		})
+		b.Run(fmt.Sprintf("tree/n=%d", n), func(b *testing.B) {
+			var t atomTree
+			for _, a := range atoms {
+				t.insert(a)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t.insert(atom{Pid: extra, Value: 'y'})
+				t.delete(extra)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package crdt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asadovsky/goatee/server/common"
+)
+
+// VersionVector maps agent ids to logical clock values. Each replica keeps a
+// VersionVector recording, for each agent, the highest clock value it has
+// observed from that agent.
+type VersionVector map[uint32]uint32
+
+// Copy returns a copy of v.
+func (v VersionVector) Copy() VersionVector {
+	res := make(VersionVector, len(v))
+	for agentId, x := range v {
+		res[agentId] = x
+	}
+	return res
+}
+
+// maxClockValue is the highest clock value. Tick and Observe fail rather than
+// exceed it, so that clock values never wrap around.
+const maxClockValue = math.MaxUint32 - 1
+
+// Tick increments and returns the clock value for the given agent. Returns an
+// error if the clock value is already maxClockValue.
+func (v VersionVector) Tick(agentId uint32) (uint32, error) {
+	if v[agentId] >= maxClockValue {
+		return 0, fmt.Errorf("clock overflow for agent %d", agentId)
+	}
+	v[agentId]++
+	return v[agentId], nil
+}
+
+// Observe advances the clock value for the given agent to at least x. Returns
+// an error, leaving v unchanged, if x exceeds maxClockValue.
+func (v VersionVector) Observe(agentId, x uint32) error {
+	if x > maxClockValue {
+		return fmt.Errorf("clock overflow for agent %d", agentId)
+	}
+	if x > v[agentId] {
+		v[agentId] = x
+	}
+	return nil
+}
+
+// Merge advances v to the pointwise maximum of v and other.
+func (v VersionVector) Merge(other VersionVector) {
+	for agentId, x := range other {
+		if x > v[agentId] {
+			v[agentId] = x
+		}
+	}
+}
+
+// Descends returns true iff v has observed everything other has, i.e. v is
+// pointwise greater than or equal to other.
+func (v VersionVector) Descends(other VersionVector) bool {
+	for agentId, x := range other {
+		if v[agentId] < x {
+			return false
+		}
+	}
+	return true
+}
+
+// Concurrent returns true iff neither v nor other descends from the other.
+func (v VersionVector) Concurrent(other VersionVector) bool {
+	return !v.Descends(other) && !other.Descends(v)
+}
+
+// Timestamp is a hybrid logical clock timestamp. Timestamps from the same HLC
+// increase strictly monotonically while staying close to physical time, so
+// they order causally related events correctly and concurrent events roughly
+// by when they happened.
+type Timestamp struct {
+	WallTime int64  // milliseconds since the Unix epoch
+	Logical  uint32 // orders timestamps with the same WallTime
+}
+
+// Less returns true iff ts is less than other.
+func (ts Timestamp) Less(other Timestamp) bool {
+	if ts.WallTime != other.WallTime {
+		return ts.WallTime < other.WallTime
+	}
+	return ts.Logical < other.Logical
+}
+
+// Encode encodes this Timestamp.
+func (ts Timestamp) Encode() string {
+	return fmt.Sprintf("%d.%d", ts.WallTime, ts.Logical)
+}
+
+// decodeTimestamp decodes the given string into a Timestamp.
+func decodeTimestamp(s string) (Timestamp, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return Timestamp{}, fmt.Errorf("invalid timestamp: %s", s)
+	}
+	wallTime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || wallTime < 0 {
+		return Timestamp{}, fmt.Errorf("invalid wall time: %s", s)
+	}
+	logical, err := common.Atoi(parts[1])
+	if err != nil {
+		return Timestamp{}, fmt.Errorf("invalid logical time: %s", s)
+	}
+	return Timestamp{WallTime: wallTime, Logical: logical}, nil
+}
+
+// maxClockSkew is how far ahead of local physical time an observed Timestamp
+// may be. Bounding it keeps one bad clock from dragging every HLC into the
+// future.
+const maxClockSkew = time.Minute
+
+// HLC is a hybrid logical clock.
+type HLC struct {
+	now  func() time.Time
+	last Timestamp
+}
+
+// NewHLC returns a new HLC that reads physical time from now, or from time.Now
+// if now is nil.
+func NewHLC(now func() time.Time) *HLC {
+	if now == nil {
+		now = time.Now
+	}
+	return &HLC{now: now}
+}
+
+func (c *HLC) wallTime() int64 {
+	return c.now().UnixNano() / int64(time.Millisecond)
+}
+
+// Now returns a Timestamp greater than any previously returned or observed.
+func (c *HLC) Now() Timestamp {
+	if wallTime := c.wallTime(); wallTime > c.last.WallTime {
+		c.last = Timestamp{WallTime: wallTime}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Observe advances the clock past ts, which was received from another agent.
+// Returns an error if ts is more than maxClockSkew ahead of physical time.
+func (c *HLC) Observe(ts Timestamp) error {
+	if ts.WallTime > c.wallTime()+int64(maxClockSkew/time.Millisecond) {
+		return fmt.Errorf("timestamp too far in the future: %s", ts.Encode())
+	}
+	c.advance(ts)
+	return nil
+}
+
+// advance advances the clock to at least ts, without checking for skew.
+func (c *HLC) advance(ts Timestamp) {
+	if c.last.Less(ts) {
+		c.last = ts
+	}
+}
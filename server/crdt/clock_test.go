@@ -0,0 +1,74 @@
+package crdt_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/goatee/server/crdt"
+)
+
+func TestVersionVector(t *testing.T) {
+	a := crdt.VersionVector{}
+	tick := func(v crdt.VersionVector, agentId uint32) uint32 {
+		x, err := v.Tick(agentId)
+		ok(t, err)
+		return x
+	}
+	eq(t, tick(a, 1), uint32(1))
+	eq(t, tick(a, 1), uint32(2))
+	ok(t, a.Observe(2, 5))
+	ok(t, a.Observe(2, 3))
+	eq(t, a, crdt.VersionVector{1: 2, 2: 5})
+
+	b := a.Copy()
+	eq(t, b.Descends(a) && a.Descends(b), true)
+	eq(t, a.Concurrent(b), false)
+	tick(b, 3)
+	eq(t, b.Descends(a), true)
+	eq(t, a.Descends(b), false)
+	eq(t, a.Concurrent(b), false)
+	tick(a, 1)
+	eq(t, a.Concurrent(b), true)
+
+	a.Merge(b)
+	eq(t, a, crdt.VersionVector{1: 3, 2: 5, 3: 1})
+	eq(t, a.Descends(b), true)
+	// The empty vector descends only from itself.
+	eq(t, crdt.VersionVector{}.Descends(crdt.VersionVector{}), true)
+	eq(t, crdt.VersionVector{}.Descends(a), false)
+
+	// Clock values never wrap around.
+	c := crdt.VersionVector{}
+	if err := c.Observe(1, math.MaxUint32); err == nil {
+		fatal(t, "expected error")
+	}
+	ok(t, c.Observe(1, math.MaxUint32-2))
+	eq(t, tick(c, 1), uint32(math.MaxUint32-1))
+	if _, err := c.Tick(1); err == nil {
+		fatal(t, "expected error")
+	}
+	eq(t, c, crdt.VersionVector{1: math.MaxUint32 - 1})
+}
+
+func TestHLC(t *testing.T) {
+	now := time.Unix(100, 0)
+	c := crdt.NewHLC(func() time.Time { return now })
+	eq(t, c.Now(), crdt.Timestamp{WallTime: 100000})
+	// Physical time stands still or goes backwards.
+	eq(t, c.Now(), crdt.Timestamp{WallTime: 100000, Logical: 1})
+	now = time.Unix(99, 0)
+	eq(t, c.Now(), crdt.Timestamp{WallTime: 100000, Logical: 2})
+	now = time.Unix(101, 0)
+	eq(t, c.Now(), crdt.Timestamp{WallTime: 101000})
+
+	// Observed timestamps push the clock forward, within limits.
+	ok(t, c.Observe(crdt.Timestamp{WallTime: 105000, Logical: 7}))
+	eq(t, c.Now(), crdt.Timestamp{WallTime: 105000, Logical: 8})
+	ok(t, c.Observe(crdt.Timestamp{WallTime: 50000}))
+	eq(t, c.Now(), crdt.Timestamp{WallTime: 105000, Logical: 9})
+	if err := c.Observe(crdt.Timestamp{WallTime: 101000 + 2*60*1000}); err == nil {
+		fatal(t, "Observe should have failed")
+	}
+	eq(t, c.Now(), crdt.Timestamp{WallTime: 105000, Logical: 10})
+}
@@ -0,0 +1,257 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+// clientIncrement represents an increment (or, if Neg is true, a decrement)
+// from a client. The server attributes it to the client's agent id.
+type clientIncrement struct {
+	Neg bool
+	N   uint64
+}
+
+// Encode encodes this op.
+func (op *clientIncrement) Encode() string {
+	if op.Neg {
+		return fmt.Sprintf("cn,%d", op.N)
+	}
+	return fmt.Sprintf("cp,%d", op.N)
+}
+
+// total represents an agent's total increments (or, if Neg is true,
+// decrements). Totals only grow, so applying a total means taking the max of
+// it and the current total.
+type total struct {
+	Neg     bool
+	AgentId uint32
+	N       uint64
+}
+
+// Encode encodes this op.
+func (op *total) Encode() string {
+	if op.Neg {
+		return fmt.Sprintf("n,%d,%d", op.AgentId, op.N)
+	}
+	return fmt.Sprintf("p,%d,%d", op.AgentId, op.N)
+}
+
+// decodeCounterOp decodes the given string into a clientIncrement or total op.
+func decodeCounterOp(s string) (op, error) {
+	parts := strings.Split(s, ",")
+	switch parts[0] {
+	case "cp", "cn":
+		if len(parts) != 2 {
+			return nil, newParseError(s)
+		}
+		n, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &clientIncrement{parts[0] == "cn", n}, nil
+	case "p", "n":
+		if len(parts) != 3 {
+			return nil, newParseError(s)
+		}
+		agentId, err := common.Atoi(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		n, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &total{parts[0] == "n", agentId, n}, nil
+	default:
+		return nil, fmt.Errorf("unknown op type: %s", parts[0])
+	}
+}
+
+// PNCounter is a counter that supports increments and decrements. It tracks
+// each agent's total increments and total decrements separately; merging takes
+// the pointwise max, and the value is the sum of increments minus the sum of
+// decrements.
+//
+// Clients send "cp,<n>" to add n and "cn,<n>" to subtract n. Each Change holds
+// the resulting totals, "p,<agentId>,<n>" or "n,<agentId>,<n>", which only
+// other replicas may send.
+type PNCounter struct {
+	p, n map[uint32]uint64 // total increments and decrements per agent
+	history
+}
+
+// NewPNCounter returns a new PNCounter, whose value is zero.
+func NewPNCounter() *PNCounter {
+	return &PNCounter{p: map[uint32]uint64{}, n: map[uint32]uint64{}}
+}
+
+// pnCounterState is the encoded form of a PNCounter.
+type pnCounterState struct {
+	P, N map[uint32]uint64
+}
+
+// OpenPNCounter returns a PNCounter persisted in snap.
+func OpenPNCounter(snap store.Blob) (*PNCounter, error) {
+	c := NewPNCounter()
+	if err := c.open(snap, c.decodeState); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Value returns the current value.
+func (c *PNCounter) Value() int64 {
+	var v int64
+	for _, n := range c.p {
+		v += int64(n)
+	}
+	for _, n := range c.n {
+		v -= int64(n)
+	}
+	return v
+}
+
+// Encode encodes this PNCounter as JSON.
+func (c *PNCounter) Encode() (string, error) {
+	buf, err := json.Marshal(&pnCounterState{P: c.p, N: c.n})
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (c *PNCounter) encodeState() (string, error) {
+	return c.Encode()
+}
+
+func (c *PNCounter) decodeState(s string) error {
+	var state pnCounterState
+	if err := json.Unmarshal([]byte(s), &state); err != nil {
+		return err
+	}
+	c.Merge(&PNCounter{p: state.P, n: state.N})
+	return nil
+}
+
+// PopulateSnapshot populates s.
+func (c *PNCounter) PopulateSnapshot(s *common.Snapshot) error {
+	state, err := c.Encode()
+	if err != nil {
+		return err
+	}
+	s.BasePatchId = c.lastPatchId
+	s.Text = strconv.FormatInt(c.Value(), 10)
+	s.State = state
+	return nil
+}
+
+// ApplyUpdate applies u, which must hold only client ops, and populates ch and
+// a. Client increments and decrements are attributed to u.ClientId.
+func (c *PNCounter) ApplyUpdate(u *common.Update, ch *common.Change, a *common.Ack) error {
+	return c.applyUpdate(u, ch, a, false)
+}
+
+// ApplyRemoteUpdate is like ApplyUpdate, except that u may also hold the totals
+// of another replica's Changes. A total can raise any agent's count, so u must
+// come from a trusted replica.
+func (c *PNCounter) ApplyRemoteUpdate(u *common.Update, ch *common.Change, a *common.Ack) error {
+	return c.applyUpdate(u, ch, a, true)
+}
+
+func (c *PNCounter) applyUpdate(u *common.Update, ch *common.Change, a *common.Ack, remote bool) error {
+	// Compute the new totals before applying anything, so that the update can be
+	// persisted before it takes effect.
+	var totals []*total
+	get := func(neg bool, agentId uint32) *total {
+		for _, x := range totals {
+			if x.Neg == neg && x.AgentId == agentId {
+				return x
+			}
+		}
+		x := &total{neg, agentId, c.total(neg, agentId)}
+		totals = append(totals, x)
+		return x
+	}
+	for _, s := range u.OpStrs {
+		op, err := decodeCounterOp(s)
+		if err != nil {
+			return err
+		}
+		switch v := op.(type) {
+		case *clientIncrement:
+			x := get(v.Neg, u.ClientId)
+			if x.N+v.N < x.N {
+				return fmt.Errorf("counter overflow: %s", s)
+			}
+			x.N += v.N
+		case *total:
+			if !remote {
+				return fmt.Errorf("not a client op: %s", s)
+			}
+			if x := get(v.Neg, v.AgentId); v.N > x.N {
+				x.N = v.N
+			}
+		}
+	}
+	opStrs := make([]string, len(totals))
+	for i, x := range totals {
+		opStrs[i] = x.Encode()
+	}
+	if err := c.save(func() (string, error) {
+		next := NewPNCounter()
+		next.Merge(c)
+		next.applyTotals(totals)
+		return next.Encode()
+	}); err != nil {
+		return err
+	}
+	c.applyTotals(totals)
+	ch.OpStrs = opStrs
+	ch.PatchId = c.append(u.ClientId, opStrs)
+	a.PatchId = ch.PatchId
+	return nil
+}
+
+// total returns the given agent's total increments or decrements.
+func (c *PNCounter) total(neg bool, agentId uint32) uint64 {
+	if neg {
+		return c.n[agentId]
+	}
+	return c.p[agentId]
+}
+
+// applyTotals applies the given totals, each of which must be at least the
+// current total.
+func (c *PNCounter) applyTotals(totals []*total) {
+	for _, x := range totals {
+		m := c.p
+		if x.Neg {
+			m = c.n
+		}
+		assert(x.N >= m[x.AgentId])
+		if x.N > 0 {
+			m[x.AgentId] = x.N
+		}
+	}
+}
+
+// Merge advances c to the pointwise max of c and other, which is the result of
+// applying every update applied to either.
+func (c *PNCounter) Merge(other *PNCounter) {
+	for agentId, n := range other.p {
+		if n > c.p[agentId] {
+			c.p[agentId] = n
+		}
+	}
+	for agentId, n := range other.n {
+		if n > c.n[agentId] {
+			c.n[agentId] = n
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package crdt_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/crdt"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+func TestPNCounter(t *testing.T) {
+	c := crdt.NewPNCounter()
+	eq(t, c.Value(), int64(0))
+	ch := update(t, c, 1, "cp,5", "cn,2", "cp,1")
+	eq(t, ch.OpStrs, []string{"p,1,6", "n,1,2"})
+	eq(t, c.Value(), int64(4))
+	ch = update(t, c, 2, "cn,10")
+	eq(t, ch.OpStrs, []string{"n,2,10"})
+	eq(t, c.Value(), int64(-6))
+
+	// Totals are merged by max, so stale and repeated totals have no effect.
+	remoteUpdate(t, c, "p,1,3", "n,2,10")
+	eq(t, c.Value(), int64(-6))
+	remoteUpdate(t, c, "p,1,7", "p,3,1")
+	eq(t, c.Value(), int64(-4))
+	eq(t, state(t, c), `{"P":{"1":7,"3":1},"N":{"1":2,"2":10}}`)
+
+	for _, s := range []string{"cp", "cp,-1", "cp,x", "p,1", "p,1,2,3", "x,1", "cp,18446744073709551615"} {
+		if err := c.ApplyRemoteUpdate(&common.Update{ClientId: 1, OpStrs: []string{s}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyRemoteUpdate(%q) should have failed", s)
+		}
+	}
+	// Clients may not set totals, e.g. to overwrite another agent's.
+	for _, s := range []string{"p,2,100", "n,1,100"} {
+		if err := c.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{s}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyUpdate(%q) should have failed", s)
+		}
+	}
+	eq(t, c.Value(), int64(-4))
+}
+
+func TestPNCounterMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		// Replicas a and b apply client updates independently, then exchange the
+		// resulting totals in random order.
+		a, b := crdt.NewPNCounter(), crdt.NewPNCounter()
+		var changes [][]string
+		want := int64(0)
+		for j := 0; j < 20; j++ {
+			r := a
+			if rng.Intn(2) == 0 {
+				r = b
+			}
+			op := []string{"cp,1", "cn,1", "cp,3"}[rng.Intn(3)]
+			want += map[string]int64{"cp,1": 1, "cn,1": -1, "cp,3": 3}[op]
+			// Agent ids must be unique across replicas.
+			clientId := uint32(rng.Intn(3))
+			if r == b {
+				clientId += 10
+			}
+			changes = append(changes, update(t, r, clientId, op).OpStrs)
+		}
+		merged := crdt.NewPNCounter()
+		merged.Merge(a)
+		merged.Merge(b)
+		eq(t, merged.Value(), want)
+		for _, j := range rng.Perm(len(changes)) {
+			remoteUpdate(t, a, changes[j]...)
+			remoteUpdate(t, b, changes[j]...)
+		}
+		eq(t, a.Value(), want)
+		eq(t, state(t, a), state(t, b))
+	}
+}
+
+func TestOpenPNCounter(t *testing.T) {
+	snap := store.NewMemBlob()
+	c, err := crdt.OpenPNCounter(snap)
+	ok(t, err)
+	update(t, c, 1, "cp,3")
+	update(t, c, 2, "cn,1")
+
+	// Simulate a restart.
+	c, err = crdt.OpenPNCounter(snap)
+	ok(t, err)
+	var s common.Snapshot
+	ok(t, c.PopulateSnapshot(&s))
+	eq(t, s.Text, "2")
+	eq(t, s.BasePatchId, uint32(2))
+	eq(t, update(t, c, 1, "cp,1").OpStrs, []string{"p,1,4"})
+}
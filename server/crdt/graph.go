@@ -0,0 +1,320 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+// Edge is a directed edge in a Graph.
+type Edge struct {
+	From, To string
+}
+
+// graphOp is a Graph op: the addition or removal of a vertex or an edge. Ops
+// from clients are checked against the server's state before they take effect;
+// see Graph.
+type graphOp struct {
+	Client bool
+	Remove bool
+	Edge   bool
+	V      string // vertex, or source vertex of edge
+	W      string // target vertex of edge
+}
+
+// Encode encodes this op.
+func (op *graphOp) Encode() string {
+	t := "a"
+	if op.Remove {
+		t = "r"
+	}
+	if op.Client {
+		t = "c" + t
+	}
+	if op.Edge {
+		return fmt.Sprintf("%se,%s,%s", t, op.V, op.W)
+	}
+	return fmt.Sprintf("%sv,%s", t, op.V)
+}
+
+// checkVertex returns an error if v is not a valid vertex id. Vertex ids must be
+// non-empty and may not contain commas, which separate them in ops.
+func checkVertex(v string) error {
+	if v == "" || strings.Contains(v, ",") || !utf8.ValidString(v) {
+		return fmt.Errorf("invalid vertex: %q", v)
+	}
+	return nil
+}
+
+// decodeGraphOp decodes the given string into a graphOp.
+func decodeGraphOp(s string) (*graphOp, error) {
+	parts := strings.Split(s, ",")
+	t := strings.TrimPrefix(parts[0], "c")
+	op := &graphOp{Client: t != parts[0]}
+	switch t {
+	case "av", "rv":
+		if len(parts) != 2 {
+			return nil, newParseError(s)
+		}
+		op.V = parts[1]
+	case "ae", "re":
+		if len(parts) != 3 {
+			return nil, newParseError(s)
+		}
+		op.Edge, op.V, op.W = true, parts[1], parts[2]
+		if err := checkVertex(op.W); err != nil {
+			return nil, newParseError(s)
+		}
+	default:
+		return nil, fmt.Errorf("unknown op type: %s", parts[0])
+	}
+	if err := checkVertex(op.V); err != nil {
+		return nil, newParseError(s)
+	}
+	op.Remove = t[0] == 'r'
+	return op, nil
+}
+
+// Graph is a directed graph built from two two-phase sets (2P2P-Graph): one of
+// vertices and one of edges. A two-phase set tracks added and removed elements,
+// so an element can be added and then removed, but never re-added. An edge is
+// present iff it and both of its vertices are present.
+//
+// Clients send "cav,<v>" and "crv,<v>" to add and remove vertices, and
+// "cae,<v>,<w>" and "cre,<v>,<w>" to add and remove the edge from v to w. Client
+// ops that are invalid in the server's current state, such as adding an edge to
+// a missing vertex or removing a missing vertex, are dropped, since they are
+// typically the result of a concurrent remove. Removing a vertex also removes
+// its edges. Each Change holds the resulting "av", "rv", "ae" and "re" ops,
+// which take effect unconditionally and commute, so replicas that apply them in
+// any order converge. Only other replicas may send these.
+type Graph struct {
+	// Added vertices and edges; the value is false once removed.
+	vertices map[string]bool
+	edges    map[Edge]bool
+	history
+}
+
+// NewGraph returns a new, empty Graph.
+func NewGraph() *Graph {
+	return &Graph{vertices: map[string]bool{}, edges: map[Edge]bool{}}
+}
+
+// graphState is the encoded form of a Graph.
+type graphState struct {
+	Vertices map[string]bool // false for removed vertices
+	Edges    map[string]bool // keyed by "<v>,<w>"; false for removed edges
+}
+
+// OpenGraph returns a Graph persisted in snap.
+func OpenGraph(snap store.Blob) (*Graph, error) {
+	g := NewGraph()
+	if err := g.open(snap, g.decodeState); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Graph) encodeState() (string, error) {
+	return g.Encode()
+}
+
+func (g *Graph) decodeState(s string) error {
+	var state graphState
+	if err := json.Unmarshal([]byte(s), &state); err != nil {
+		return err
+	}
+	for v, live := range state.Vertices {
+		g.vertices[v] = live
+	}
+	for s, live := range state.Edges {
+		parts := strings.Split(s, ",")
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid edge: %s", s)
+		}
+		g.edges[Edge{parts[0], parts[1]}] = live
+	}
+	return nil
+}
+
+// Encode encodes this Graph as JSON.
+func (g *Graph) Encode() (string, error) {
+	state := graphState{Vertices: g.vertices, Edges: make(map[string]bool, len(g.edges))}
+	for e, live := range g.edges {
+		state.Edges[e.From+","+e.To] = live
+	}
+	buf, err := json.Marshal(&state)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// HasVertex returns true iff the graph contains vertex v.
+func (g *Graph) HasVertex(v string) bool {
+	return g.vertices[v]
+}
+
+// HasEdge returns true iff the graph contains the edge from v to w.
+func (g *Graph) HasEdge(v, w string) bool {
+	return g.edges[Edge{v, w}] && g.vertices[v] && g.vertices[w]
+}
+
+// Vertices returns the vertices of the graph, in sorted order.
+func (g *Graph) Vertices() []string {
+	var res []string
+	for v, live := range g.vertices {
+		if live {
+			res = append(res, v)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Edges returns the edges of the graph, in sorted order.
+func (g *Graph) Edges() []Edge {
+	var res []Edge
+	for e := range g.edges {
+		if g.HasEdge(e.From, e.To) {
+			res = append(res, e)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].From != res[j].From {
+			return res[i].From < res[j].From
+		}
+		return res[i].To < res[j].To
+	})
+	return res
+}
+
+// PopulateSnapshot populates s.
+func (g *Graph) PopulateSnapshot(s *common.Snapshot) error {
+	state, err := g.Encode()
+	if err != nil {
+		return err
+	}
+	s.BasePatchId = g.lastPatchId
+	s.State = state
+	return nil
+}
+
+// ApplyUpdate applies u, which must hold only client ops, and populates c and
+// a.
+func (g *Graph) ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return g.applyUpdate(u, c, a, false)
+}
+
+// ApplyRemoteUpdate is like ApplyUpdate, except that u may also hold the ops of
+// another replica's Changes. Those ops take effect unconditionally, so u must
+// come from a trusted replica.
+func (g *Graph) ApplyRemoteUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return g.applyUpdate(u, c, a, true)
+}
+
+func (g *Graph) applyUpdate(u *common.Update, c *common.Change, a *common.Ack, remote bool) error {
+	ops := make([]*graphOp, len(u.OpStrs))
+	for i, s := range u.OpStrs {
+		op, err := decodeGraphOp(s)
+		if err != nil {
+			return err
+		}
+		if !op.Client && !remote {
+			return fmt.Errorf("not a client op: %s", s)
+		}
+		ops[i] = op
+	}
+	// Whether a client op takes effect depends on the ops before it. If the
+	// update must be persisted before it takes effect, apply the ops to a copy
+	// of the state.
+	next := g
+	if g.snap != nil {
+		next = g.copy()
+	}
+	opStrs := []string{}
+	for _, op := range ops {
+		if !op.Client {
+			next.applyOp(op)
+			opStrs = append(opStrs, op.Encode())
+			continue
+		}
+		for _, x := range next.expand(op) {
+			next.applyOp(x)
+			opStrs = append(opStrs, x.Encode())
+		}
+	}
+	if err := g.save(next.Encode); err != nil {
+		return err
+	}
+	g.vertices, g.edges = next.vertices, next.edges
+	c.OpStrs = opStrs
+	c.PatchId = g.append(u.ClientId, opStrs)
+	a.PatchId = c.PatchId
+	return nil
+}
+
+// expand returns the ops that take effect when client op is applied to the
+// current state: none if op is invalid or has no effect, and, for a vertex
+// removal, removals of the vertex's edges followed by op.
+func (g *Graph) expand(op *graphOp) []*graphOp {
+	op = &graphOp{Remove: op.Remove, Edge: op.Edge, V: op.V, W: op.W}
+	switch {
+	case !op.Edge && !op.Remove:
+		if _, ok := g.vertices[op.V]; ok {
+			return nil
+		}
+	case !op.Edge && op.Remove:
+		if !g.vertices[op.V] {
+			return nil
+		}
+		var res []*graphOp
+		for _, e := range g.Edges() {
+			if e.From == op.V || e.To == op.V {
+				res = append(res, &graphOp{Remove: true, Edge: true, V: e.From, W: e.To})
+			}
+		}
+		return append(res, op)
+	case op.Edge && !op.Remove:
+		if _, ok := g.edges[Edge{op.V, op.W}]; ok || !g.vertices[op.V] || !g.vertices[op.W] {
+			return nil
+		}
+	case op.Edge && op.Remove:
+		if !g.HasEdge(op.V, op.W) {
+			return nil
+		}
+	}
+	return []*graphOp{op}
+}
+
+// applyOp applies the given op. Removals are permanent, so applying ops in any
+// order yields the same sets.
+func (g *Graph) applyOp(op *graphOp) {
+	if op.Edge {
+		e := Edge{op.V, op.W}
+		if _, ok := g.edges[e]; op.Remove || !ok {
+			g.edges[e] = !op.Remove
+		}
+	} else {
+		if _, ok := g.vertices[op.V]; op.Remove || !ok {
+			g.vertices[op.V] = !op.Remove
+		}
+	}
+}
+
+// copy returns a copy of the vertices and edges of g.
+func (g *Graph) copy() *Graph {
+	res := NewGraph()
+	for v, live := range g.vertices {
+		res.vertices[v] = live
+	}
+	for e, live := range g.edges {
+		res.edges[e] = live
+	}
+	return res
+}
@@ -0,0 +1,115 @@
+package crdt_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/crdt"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+func TestGraph(t *testing.T) {
+	g := crdt.NewGraph()
+	c := update(t, g, 1, "cav,a", "cav,b", "cav,c", "cae,a,b", "cae,b,c", "cae,c,a")
+	eq(t, len(c.OpStrs), 6)
+	eq(t, g.Vertices(), []string{"a", "b", "c"})
+	eq(t, g.Edges(), []crdt.Edge{{"a", "b"}, {"b", "c"}, {"c", "a"}})
+
+	// Edges can only be added between present vertices.
+	eq(t, update(t, g, 1, "cae,a,x", "cav,a").OpStrs, []string{})
+	eq(t, g.HasEdge("a", "x"), false)
+
+	// Removing a vertex removes its edges.
+	eq(t, update(t, g, 2, "crv,b").OpStrs, []string{"re,a,b", "re,b,c", "rv,b"})
+	eq(t, g.Vertices(), []string{"a", "c"})
+	eq(t, g.Edges(), []crdt.Edge{{"c", "a"}})
+
+	// Removed vertices and edges cannot be re-added.
+	eq(t, update(t, g, 1, "cav,b", "cae,a,b", "crv,b", "cre,a,b").OpStrs, []string{})
+	eq(t, g.HasVertex("b"), false)
+	eq(t, update(t, g, 1, "cre,c,a", "cae,c,a").OpStrs, []string{"re,c,a"})
+	eq(t, g.Edges(), []crdt.Edge(nil))
+	eq(t, state(t, g), `{"Vertices":{"a":true,"b":false,"c":true},"Edges":{"a,b":false,"b,c":false,"c,a":false}}`)
+
+	// Ops from other replicas take effect even if they would be invalid as client
+	// ops. An edge whose vertex is missing is not present until the vertex is
+	// added.
+	remoteUpdate(t, g, "ae,d,e", "av,d")
+	eq(t, g.HasEdge("d", "e"), false)
+	remoteUpdate(t, g, "av,e")
+	eq(t, g.HasEdge("d", "e"), true)
+	remoteUpdate(t, g, "rv,e")
+	eq(t, g.Edges(), []crdt.Edge(nil))
+
+	for _, op := range []string{"av", "cav,", "av,a,b", "cae,a", "ae,a,", "re,a,b,c", "x,a", "ccav,a"} {
+		if err := g.ApplyRemoteUpdate(&common.Update{ClientId: 1, OpStrs: []string{op}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyRemoteUpdate(%q) should have failed", op)
+		}
+	}
+	// Clients may not send unchecked ops.
+	for _, op := range []string{"av,f", "rv,a", "ae,a,c", "re,d,e"} {
+		if err := g.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{op}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyUpdate(%q) should have failed", op)
+		}
+	}
+	eq(t, g.Vertices(), []string{"a", "c", "d"})
+}
+
+// TestGraphConverges runs clients against several replicas, then delivers the
+// resulting ops to every replica in a different random order.
+func TestGraphConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	vertex := func() string {
+		return string(rune('a' + rng.Intn(4)))
+	}
+	for i := 0; i < 200; i++ {
+		replicas := []*crdt.Graph{crdt.NewGraph(), crdt.NewGraph(), crdt.NewGraph()}
+		var ops []string
+		for j := 0; j < 30; j++ {
+			var op string
+			switch rng.Intn(4) {
+			case 0:
+				op = "cav," + vertex()
+			case 1:
+				op = "crv," + vertex()
+			case 2:
+				op = fmt.Sprintf("cae,%s,%s", vertex(), vertex())
+			case 3:
+				op = fmt.Sprintf("cre,%s,%s", vertex(), vertex())
+			}
+			ops = append(ops, update(t, replicas[rng.Intn(len(replicas))], 1, op).OpStrs...)
+		}
+		for _, r := range replicas {
+			for _, j := range rng.Perm(len(ops)) {
+				remoteUpdate(t, r, ops[j])
+			}
+		}
+		for _, r := range replicas[1:] {
+			eq(t, r.Vertices(), replicas[0].Vertices())
+			eq(t, r.Edges(), replicas[0].Edges())
+			for _, e := range r.Edges() {
+				eq(t, r.HasVertex(e.From) && r.HasVertex(e.To), true)
+			}
+		}
+	}
+}
+
+func TestOpenGraph(t *testing.T) {
+	snap := store.NewMemBlob()
+	g, err := crdt.OpenGraph(snap)
+	ok(t, err)
+	update(t, g, 1, "cav,a", "cav,b", "cav,c", "cae,a,b", "cae,b,c")
+	update(t, g, 1, "crv,c")
+
+	// Simulate a restart.
+	g, err = crdt.OpenGraph(snap)
+	ok(t, err)
+	eq(t, g.Vertices(), []string{"a", "b"})
+	eq(t, g.Edges(), []crdt.Edge{{"a", "b"}})
+	var s common.Snapshot
+	ok(t, g.PopulateSnapshot(&s))
+	eq(t, s.BasePatchId, uint32(2))
+	eq(t, update(t, g, 1, "cav,c").OpStrs, []string{})
+}
@@ -0,0 +1,132 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+// history records the Change produced by each applied update, for replaying to
+// resumed clients, and persists the state of the data type that embeds it. It
+// is used by the data types whose updates need no Ack data beyond the PatchId,
+// and whose state is small enough to store in full on every update.
+type history struct {
+	// Changes not yet discarded by Compact. changes[i] has PatchId
+	// firstPatchId+i+1.
+	changes      []common.Change
+	firstPatchId uint32
+	lastPatchId  uint32
+	// Persistence state. If snap is nil, the data type is not persisted.
+	snap store.Blob
+}
+
+// open loads the state stored in snap, if any, using decode, and then persists
+// all later states in snap.
+func (h *history) open(snap store.Blob, decode func(s string) error) error {
+	sn, err := loadState(snap)
+	if err != nil {
+		return err
+	}
+	if sn != nil {
+		if err := decode(sn.State); err != nil {
+			return err
+		}
+		h.reset(sn.PatchId)
+	}
+	h.snap = snap
+	return nil
+}
+
+// save persists the state that the next update will produce, as returned by
+// encodeNext, so that the update is durable before it takes effect. If the data
+// type is not persisted, encodeNext is not called, so that the update need not
+// copy or encode any state.
+func (h *history) save(encodeNext func() (string, error)) error {
+	if h.snap == nil {
+		return nil
+	}
+	state, err := encodeNext()
+	if err != nil {
+		return err
+	}
+	return saveState(h.snap, state, h.lastPatchId+1)
+}
+
+// reset discards all changes and sets the last PatchId, e.g. after loading a
+// snapshot.
+func (h *history) reset(patchId uint32) {
+	h.changes = nil
+	h.firstPatchId, h.lastPatchId = patchId, patchId
+}
+
+// resetHistory discards all changes. See mapValue.
+func (h *history) resetHistory() {
+	h.reset(h.lastPatchId)
+}
+
+// append records a change and returns its PatchId.
+func (h *history) append(clientId uint32, opStrs []string) uint32 {
+	h.lastPatchId++
+	h.changes = append(h.changes, common.Change{ClientId: clientId, PatchId: h.lastPatchId, OpStrs: opStrs})
+	return h.lastPatchId
+}
+
+// Replay calls f with the Change and Ack for each update after basePatchId, in
+// order. Returns common.ErrResyncRequired if the changes after basePatchId
+// have been discarded, e.g. after a restart.
+func (h *history) Replay(basePatchId uint32, f func(c *common.Change, a *common.Ack)) error {
+	if basePatchId > h.lastPatchId {
+		return fmt.Errorf("unknown BasePatchId: %d", basePatchId)
+	} else if basePatchId < h.firstPatchId {
+		return common.ErrResyncRequired
+	}
+	for _, c := range h.changes[basePatchId-h.firstPatchId:] {
+		c := c
+		f(&c, &common.Ack{PatchId: c.PatchId})
+	}
+	return nil
+}
+
+// Compact discards the changes up to and including basePatchId, which are
+// needed only by clients whose BasePatchId is older than basePatchId.
+func (h *history) Compact(basePatchId uint32) error {
+	if basePatchId > h.lastPatchId {
+		return fmt.Errorf("unknown BasePatchId: %d", basePatchId)
+	} else if basePatchId <= h.firstPatchId {
+		return nil
+	}
+	h.changes = append([]common.Change(nil), h.changes[basePatchId-h.firstPatchId:]...)
+	h.firstPatchId = basePatchId
+	return nil
+}
+
+// stateSnapshot is the persisted form of data types that are small enough to
+// store their entire state on every update.
+type stateSnapshot struct {
+	State   string // encoded state
+	PatchId uint32 // last PatchId at snapshot time
+}
+
+// loadState returns the state stored in snap, or nil if none has been stored.
+func loadState(snap store.Blob) (*stateSnapshot, error) {
+	buf, err := snap.Get()
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	var sn stateSnapshot
+	if err := json.Unmarshal(buf, &sn); err != nil {
+		return nil, err
+	}
+	return &sn, nil
+}
+
+// saveState stores the given state in snap.
+func saveState(snap store.Blob, state string, patchId uint32) error {
+	buf, err := json.Marshal(&stateSnapshot{State: state, PatchId: patchId})
+	if err != nil {
+		return err
+	}
+	return snap.Put(buf)
+}
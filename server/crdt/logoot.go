@@ -4,17 +4,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
-	"math/rand"
-	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
 )
 
 // Prototype implementation notes:
 // - Server: single Logoot document (analog of OT server)
-// - An atom is a string (for now)
+// - An atom is a single Unicode code point
 // - Start with a single node (local editing, unidirectional data flow)
 //
 // Possible approaches to deal with client-server asynchronicity:
@@ -57,6 +56,11 @@ type pid struct {
 	Seq uint32 // logical clock value for the last id's agent
 }
 
+// agentId returns the id of the agent that generated this pid.
+func (p *pid) agentId() uint32 {
+	return p.Ids[len(p.Ids)-1].AgentId
+}
+
 // Less returns true iff p is less than other.
 func (p *pid) Less(other *pid) bool {
 	for i, v := range p.Ids {
@@ -139,7 +143,7 @@ type op interface {
 type clientInsert struct {
 	PrevPid *pid   // nil means start of document
 	NextPid *pid   // nil means end of document
-	Value   string // may contain multiple characters
+	Value   string // may contain multiple code points
 }
 
 // Encode encodes this op.
@@ -157,25 +161,39 @@ func (op *clientInsert) Encode() string {
 // insert represents an atom insertion.
 type insert struct {
 	Pid   *pid
-	Value string
+	Value rune
 }
 
 // Encode encodes this op.
 func (op *insert) Encode() string {
-	return fmt.Sprintf("i,%s,%s", op.Pid.Encode(), op.Value)
+	return fmt.Sprintf("i,%s,%c", op.Pid.Encode(), op.Value)
+}
+
+// clientDelete represents a range deletion from a client. The server expands it
+// into a delete for each atom with StartPid <= pid <= EndPid in the server's
+// current state, including atoms inserted concurrently inside the range. This
+// matches ot.Transform, where a delete expands to include concurrent inserts
+// inside its range. StartPid and EndPid need not identify existing atoms.
+type clientDelete struct {
+	StartPid *pid
+	EndPid   *pid
+}
+
+// Encode encodes this op.
+func (op *clientDelete) Encode() string {
+	return fmt.Sprintf("cd,%s,%s", op.StartPid.Encode(), op.EndPid.Encode())
 }
 
-// delete represents an atom deletion. Pid is the position identifier of the
-// deleted atom. Note, delete cannot be defined as a [start, end] range because
-// it must commute with insert.
-// TODO: To reduce client->server message size, maybe add a clientDelete
-// operation defined as a [start, end] range.
-type delete struct {
+// deleteOp represents an atom deletion. Pid is the position identifier of the
+// deleted atom. Note, deleteOp cannot be defined as a [start, end] range because
+// it must commute with insert; see clientDelete. (It is not named delete so as
+// not to shadow the builtin.)
+type deleteOp struct {
 	Pid *pid
 }
 
 // Encode encodes this op.
-func (op *delete) Encode() string {
+func (op *deleteOp) Encode() string {
 	return fmt.Sprintf("d,%s", op.Pid.Encode())
 }
 
@@ -205,10 +223,24 @@ func decodeOp(s string) (op, error) {
 				return nil, newParseError(s)
 			}
 		}
-		if err != nil {
+		if err != nil || !utf8.ValidString(parts[3]) {
 			return nil, newParseError(s)
 		}
 		return &clientInsert{prevPid, nextPid, parts[3]}, nil
+	case "cd":
+		parts = strings.SplitN(s, ",", 3)
+		if len(parts) < 3 {
+			return nil, newParseError(s)
+		}
+		startPid, err := decodePid(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		endPid, err := decodePid(parts[2])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &clientDelete{startPid, endPid}, nil
 	case "i":
 		parts = strings.SplitN(s, ",", 3)
 		if len(parts) < 3 {
@@ -218,7 +250,11 @@ func decodeOp(s string) (op, error) {
 		if err != nil {
 			return nil, newParseError(s)
 		}
-		return &insert{pid, parts[2]}, nil
+		value, err := decodeRune(parts[2])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &insert{pid, value}, nil
 	case "d":
 		parts = strings.SplitN(s, ",", 2)
 		if len(parts) < 2 {
@@ -228,12 +264,21 @@ func decodeOp(s string) (op, error) {
 		if err != nil {
 			return nil, newParseError(s)
 		}
-		return &delete{pid}, nil
+		return &deleteOp{pid}, nil
 	default:
 		return nil, fmt.Errorf("unknown op type: %s", t)
 	}
 }
 
+// decodeRune decodes the given string, which must hold exactly one code point.
+func decodeRune(s string) (rune, error) {
+	r, n := utf8.DecodeRuneInString(s)
+	if n != len(s) || r == utf8.RuneError && n <= 1 {
+		return 0, fmt.Errorf("not a single code point: %q", s)
+	}
+	return r, nil
+}
+
 func encodeOps(ops []op) ([]string, error) {
 	strs := make([]string, len(ops))
 	for i, v := range ops {
@@ -256,119 +301,448 @@ func decodeOps(strs []string) ([]op, error) {
 
 // atom is an atom in a Logoot document.
 type atom struct {
-	Pid *pid
-	// TODO: Switch to rune?
-	Value string
+	Pid   *pid
+	Value rune
 }
 
-var _ json.Marshaler = (*atom)(nil)
+var (
+	_ json.Marshaler   = (*atom)(nil)
+	_ json.Unmarshaler = (*atom)(nil)
+)
 
-// MarshalJSON marshals to JSON.
+// MarshalJSON marshals to JSON. Value is encoded as a string.
 func (a *atom) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
 		Pid   string
 		Value string
 	}{
 		Pid:   a.Pid.Encode(),
-		Value: a.Value,
+		Value: string(a.Value),
 	})
 }
 
-// Logoot is a CRDT string.
+// UnmarshalJSON unmarshals from JSON.
+func (a *atom) UnmarshalJSON(buf []byte) error {
+	var v struct {
+		Pid   string
+		Value string
+	}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return err
+	}
+	pid, err := decodePid(v.Pid)
+	if err != nil {
+		return err
+	}
+	value, err := decodeRune(v.Value)
+	if err != nil {
+		return err
+	}
+	a.Pid, a.Value = pid, value
+	return nil
+}
+
+// snapshotInterval is the number of applied ops after which a persisted Logoot
+// writes a new snapshot and resets its op log.
+const snapshotInterval = 1000
+
+// logootState is the encoded form of a Logoot, as returned by Logoot.Encode.
+type logootState struct {
+	Atoms []atom
+	Clock VersionVector
+}
+
+// snapshot is the persisted form of a Logoot, minus its op log tail.
+type snapshot struct {
+	LogootStr string // as returned by Logoot.Encode
+	PatchId   uint32 // last PatchId at snapshot time
+}
+
+// update is an applied update. It is also the persisted form of an update.
+type update struct {
+	ClientId uint32
+	PatchId  uint32
+	OpStrs   []string // encoded insert and delete ops
+	Pids     []string // encoded pids assigned to clientInsert atoms
+}
+
+// Logoot is a CRDT string. Clients send "ci" and "cd" ops, which the server
+// expands into the pid-carrying "i" and "d" ops that each Change holds and that
+// only other replicas may send.
 type Logoot struct {
-	atoms []atom
-	text  string
+	atoms atomTree
+	alloc Allocator
+	// Highest pid Seq observed for each agent. Includes deleted atoms, so that
+	// pids are never reused.
+	clock VersionVector
+	// History of applied updates, for replaying to resumed clients.
+	// updates[i] has PatchId firstPatchId+i+1.
+	updates      []update
+	firstPatchId uint32
+	lastPatchId  uint32
+	// Persistence state. If snap is nil, the Logoot is not persisted.
+	snap      store.Blob
+	log       store.Log
+	numLogOps int // number of ops in log since last snapshot
 }
 
 // NewLogoot returns a new Logoot.
 func NewLogoot() *Logoot {
-	return &Logoot{}
+	return &Logoot{clock: VersionVector{}}
+}
+
+// SetAllocator sets the strategy used to allocate pids for inserted atoms. Pids
+// from different strategies can coexist, so the strategy can be changed at any
+// time.
+func (l *Logoot) SetAllocator(alloc Allocator) {
+	l.alloc = alloc
+}
+
+// Clock returns a copy of this replica's version vector, which maps each agent
+// id to the highest pid Seq observed from that agent.
+func (l *Logoot) Clock() VersionVector {
+	return l.clock.Copy()
+}
+
+// OpenLogoot returns a Logoot backed by the given snapshot and op log,
+// restoring any previously persisted state. Applied ops are appended to the
+// log, and every so often the log is folded into a new snapshot.
+func OpenLogoot(snap store.Blob, log store.Log) (*Logoot, error) {
+	l := NewLogoot()
+	buf, err := snap.Get()
+	if err != nil {
+		return nil, err
+	}
+	if buf != nil {
+		var sn snapshot
+		if err := json.Unmarshal(buf, &sn); err != nil {
+			return nil, err
+		}
+		if err := l.decodeState(sn.LogootStr); err != nil {
+			return nil, err
+		}
+		l.firstPatchId, l.lastPatchId = sn.PatchId, sn.PatchId
+	}
+	err = log.Replay(func(buf []byte) error {
+		var u update
+		if err := json.Unmarshal(buf, &u); err != nil {
+			return err
+		}
+		if u.PatchId <= l.firstPatchId {
+			// We crashed after writing the snapshot but before resetting the log.
+			return nil
+		}
+		if u.PatchId != l.lastPatchId+1 {
+			return fmt.Errorf("unexpected PatchId: got %d, want %d", u.PatchId, l.lastPatchId+1)
+		}
+		ops, err := decodeOps(u.OpStrs)
+		if err != nil {
+			return err
+		}
+		if err := l.commit(&u, ops); err != nil {
+			return err
+		}
+		l.numLogOps += len(ops)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.snap, l.log = snap, log
+	return l, nil
+}
+
+// Close closes the underlying op log, if any.
+func (l *Logoot) Close() error {
+	if l.log == nil {
+		return nil
+	}
+	return l.log.Close()
+}
+
+// Checkpoint writes a snapshot of the current state and resets the op log.
+// It is a no-op if this Logoot is not persisted.
+func (l *Logoot) Checkpoint() error {
+	if l.snap == nil {
+		return nil
+	}
+	logootStr, err := l.Encode()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(&snapshot{LogootStr: logootStr, PatchId: l.lastPatchId})
+	if err != nil {
+		return err
+	}
+	if err := l.snap.Put(buf); err != nil {
+		return err
+	}
+	// Note: If we crash before resetting the log, on restart we skip the records
+	// whose PatchId is already reflected in the snapshot.
+	if err := l.log.Reset(); err != nil {
+		return err
+	}
+	l.numLogOps = 0
+	return nil
 }
 
-// Encode encodes this Logoot as needed for use in the client library.
+// Encode encodes this Logoot as needed for use in the client library: its
+// atoms, in order, and its version vector.
 func (l *Logoot) Encode() (string, error) {
-	buf, err := json.Marshal(l.atoms)
+	buf, err := json.Marshal(&logootState{Atoms: l.atoms.atoms(), Clock: l.clock})
 	if err != nil {
 		return "", err
 	}
 	return string(buf), nil
 }
 
+func (l *Logoot) encodeState() (string, error) {
+	return l.Encode()
+}
+
+// decodeState loads the atoms and clock from s, as returned by Encode, into l,
+// which must be empty.
+func (l *Logoot) decodeState(s string) error {
+	var state logootState
+	if err := json.Unmarshal([]byte(s), &state); err != nil {
+		return err
+	}
+	for _, a := range state.Atoms {
+		l.atoms.insert(a)
+	}
+	l.clock.Merge(state.Clock)
+	return nil
+}
+
+func (l *Logoot) resetHistory() {
+	l.updates = nil
+	l.firstPatchId = l.lastPatchId
+}
+
 // PopulateSnapshot populates s.
 func (l *Logoot) PopulateSnapshot(s *common.Snapshot) error {
 	logootStr, err := l.Encode()
 	if err != nil {
 		return err
 	}
-	s.Text = l.text
+	s.BasePatchId = l.lastPatchId
+	atoms := l.atoms.atoms()
+	text := make([]rune, len(atoms))
+	for i, a := range atoms {
+		text[i] = a.Value
+	}
+	s.Text = string(text)
 	s.LogootStr = logootStr
 	return nil
 }
 
-// ApplyUpdate applies u and populates c.
-func (l *Logoot) ApplyUpdate(u *common.Update, c *common.Change) error {
+// Replay calls f with the Change and Ack for each update after basePatchId, in
+// order. Returns common.ErrResyncRequired if the history for basePatchId is
+// no longer available, e.g. after a restart.
+func (l *Logoot) Replay(basePatchId uint32, f func(c *common.Change, a *common.Ack)) error {
+	if basePatchId > l.lastPatchId {
+		return fmt.Errorf("unknown BasePatchId: %d", basePatchId)
+	} else if basePatchId < l.firstPatchId {
+		return common.ErrResyncRequired
+	}
+	for i := basePatchId; i < l.lastPatchId; i++ {
+		u := l.updates[i-l.firstPatchId]
+		f(&common.Change{ClientId: u.ClientId, PatchId: i + 1, OpStrs: u.OpStrs}, &common.Ack{PatchId: i + 1, Pids: u.Pids})
+	}
+	return nil
+}
+
+// ApplyUpdate applies u, which must hold only client ops, and populates c and
+// a.
+func (l *Logoot) ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return l.applyUpdate(u, c, a, false)
+}
+
+// ApplyRemoteUpdate is like ApplyUpdate, except that u may also hold the insert
+// and delete ops of another replica's Changes. Those ops carry pids, which a
+// client could forge, so u must come from a trusted replica.
+func (l *Logoot) ApplyRemoteUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return l.applyUpdate(u, c, a, true)
+}
+
+func (l *Logoot) applyUpdate(u *common.Update, c *common.Change, a *common.Ack, remote bool) error {
 	ops, err := decodeOps(u.OpStrs)
 	if err != nil {
 		return err
 	}
+	// Expand clientInsert and clientDelete ops before applying anything, so that
+	// the ops can be logged before they take effect.
 	appliedOps := make([]op, 0, len(ops))
+	var pids []string
 	gotClientInsert := false
-	for _, op := range ops {
+	for i, op := range ops {
 		switch v := op.(type) {
 		case *clientInsert:
 			if gotClientInsert {
 				return errors.New("cannot apply multiple clientInsert ops")
 			}
 			gotClientInsert = true
-			// TODO: Smarter pid allocation.
-			prevPid := v.PrevPid
-			for j := 0; j < len(v.Value); j++ {
-				x := &insert{genPid(u.ClientId, prevPid, v.NextPid), string(v.Value[j])}
-				l.applyInsertText(x)
+			// Atoms after the first are allocated under the first atom's ids, so
+			// that they sort immediately after it. This keeps the run contiguous
+			// even if another run is concurrently inserted into the same gap.
+			prevPid, nextPid, minDepth := v.PrevPid, v.NextPid, 0
+			for _, r := range v.Value {
+				p, err := l.genPid(u.ClientId, prevPid, nextPid, minDepth)
+				if err != nil {
+					return err
+				}
+				x := &insert{p, r}
 				appliedOps = append(appliedOps, x)
+				pids = append(pids, x.Pid.Encode())
+				if minDepth == 0 {
+					nextPid, minDepth = nil, len(x.Pid.Ids)
+				}
 				prevPid = x.Pid
 			}
-		case *insert:
-			l.applyInsertText(v)
-			appliedOps = append(appliedOps, op)
-		case *delete:
-			l.applyDeleteText(v)
+		case *clientDelete:
+			if v.EndPid.Less(v.StartPid) {
+				return errors.New("clientDelete range is empty")
+			}
+			appliedOps = append(appliedOps, l.expandClientDelete(v, appliedOps)...)
+		case *insert, *deleteOp:
+			if !remote {
+				return fmt.Errorf("not a client op: %s", u.OpStrs[i])
+			}
 			appliedOps = append(appliedOps, op)
 		default:
 			return fmt.Errorf("unknown op type: %T", v)
 		}
 	}
+	if err := l.checkOps(appliedOps); err != nil {
+		return err
+	}
 	opStrs, err := encodeOps(appliedOps)
 	if err != nil {
 		return err
 	}
+	applied := &update{ClientId: u.ClientId, PatchId: l.lastPatchId + 1, OpStrs: opStrs, Pids: pids}
+	if l.log != nil {
+		buf, err := json.Marshal(applied)
+		if err != nil {
+			return err
+		}
+		if err := l.log.Append(buf); err != nil {
+			return err
+		}
+	}
+	if err := l.commit(applied, appliedOps); err != nil {
+		return err
+	}
+	c.PatchId = l.lastPatchId
 	c.OpStrs = opStrs
+	a.PatchId = l.lastPatchId
+	a.Pids = pids
+	if l.log != nil {
+		l.numLogOps += len(appliedOps)
+		if l.numLogOps >= snapshotInterval {
+			// The update has already been logged and applied, so a failed
+			// checkpoint is not fatal; we'll retry after the next update.
+			_ = l.Checkpoint()
+		}
+	}
 	return nil
 }
 
-func randUint32Between(prev, next uint32) uint32 {
-	return prev + 1 + uint32(rand.Int63n(int64(next-prev-1)))
+// expandClientDelete returns a delete for each atom in the range of cd, where
+// the atoms are those in l plus any inserted by pending, the ops that precede
+// cd in its update.
+func (l *Logoot) expandClientDelete(cd *clientDelete, pending []op) []op {
+	inRange := func(p *pid) bool {
+		return !p.Less(cd.StartPid) && !cd.EndPid.Less(p)
+	}
+	var res []op
+	l.atoms.ascend(cd.StartPid, func(a *atom) bool {
+		if !inRange(a.Pid) {
+			return false
+		}
+		res = append(res, &deleteOp{a.Pid})
+		return true
+	})
+	for _, v := range pending {
+		if x, ok := v.(*insert); ok && inRange(x.Pid) {
+			res = append(res, &deleteOp{x.Pid})
+		}
+	}
+	return res
 }
 
-// TODO: Smarter pid allocation, e.g. LSEQ. Also, maybe do something to ensure
-// that concurrent multi-atom insertions from different agents do not get
-// interleaved.
-func genIds(agentId uint32, prev, next []id) []id {
-	if len(prev) == 0 {
-		prev = []id{{Pos: 0, AgentId: agentId}}
-	}
-	if len(next) == 0 {
-		next = []id{{Pos: math.MaxUint32, AgentId: agentId}}
+// commit applies the given update, whose decoded ops are given, and records it
+// in the history. If the ops cannot be applied, commit returns an error and
+// leaves l unchanged.
+func (l *Logoot) commit(u *update, ops []op) error {
+	if err := l.checkOps(ops); err != nil {
+		return err
 	}
-	if prev[0].Pos+1 < next[0].Pos {
-		return []id{{Pos: randUint32Between(prev[0].Pos, next[0].Pos), AgentId: agentId}}
+	l.applyOps(ops)
+	l.updates = append(l.updates, *u)
+	l.lastPatchId++
+	return nil
+}
+
+// checkOps returns an error if ops, applied in order, would insert an atom at a
+// pid that already holds a different value, either in l or earlier in ops, or if
+// any op's pid has a Seq that the clock cannot observe.
+func (l *Logoot) checkOps(ops []op) error {
+	// Values inserted or deleted by the ops checked so far, keyed by encoded pid.
+	inserted := map[string]rune{}
+	deleted := map[string]bool{}
+	for _, op := range ops {
+		switch v := op.(type) {
+		case *insert:
+			k := v.Pid.Encode()
+			if v.Pid.Seq > maxClockValue {
+				return fmt.Errorf("pid seq too large: %s", k)
+			}
+			value, ok := inserted[k]
+			if !ok && !deleted[k] {
+				if _, a := l.atoms.find(v.Pid); a != nil {
+					value, ok = a.Value, true
+				}
+			}
+			if ok && value != v.Value {
+				return fmt.Errorf("conflicting insert at pid: %s", k)
+			}
+			inserted[k] = v.Value
+			delete(deleted, k)
+		case *deleteOp:
+			k := v.Pid.Encode()
+			if v.Pid.Seq > maxClockValue {
+				return fmt.Errorf("pid seq too large: %s", k)
+			}
+			delete(inserted, k)
+			deleted[k] = true
+		default:
+			return fmt.Errorf("unexpected op type: %T", v)
+		}
 	}
-	return append([]id{prev[0]}, genIds(agentId, prev[1:], next[1:])...)
+	return nil
 }
 
-var seq uint32 = 0
+// applyOps applies the given insert and delete ops, which must have passed
+// checkOps.
+func (l *Logoot) applyOps(ops []op) {
+	for _, op := range ops {
+		switch v := op.(type) {
+		case *insert:
+			err := l.clock.Observe(v.Pid.agentId(), v.Pid.Seq)
+			assert(err == nil, err)
+			l.applyInsertText(v)
+		case *deleteOp:
+			err := l.clock.Observe(v.Pid.agentId(), v.Pid.Seq)
+			assert(err == nil, err)
+			l.applyDeleteText(v)
+		}
+	}
+}
 
-func genPid(agentId uint32, prev, next *pid) *pid {
+// genPid returns a new pid between prev and next, allocated at depth minDepth or
+// deeper. See genIds. The pid's Seq comes from agentId's clock.
+func (l *Logoot) genPid(agentId uint32, prev, next *pid, minDepth int) (*pid, error) {
 	prevIds, nextIds := []id{}, []id{}
 	if prev != nil {
 		prevIds = prev.Ids
@@ -376,38 +750,20 @@ func genPid(agentId uint32, prev, next *pid) *pid {
 	if next != nil {
 		nextIds = next.Ids
 	}
-	seq++
-	return &pid{Ids: genIds(agentId, prevIds, nextIds), Seq: seq}
-}
-
-func (l *Logoot) applyInsertText(op *insert) {
-	a := l.atoms
-	p := l.search(op.Pid)
-	if p != len(a) && a[p].Pid.Equal(op.Pid) {
-		assert(a[p].Value == op.Value)
-		return
+	seq, err := l.clock.Tick(agentId)
+	if err != nil {
+		return nil, err
 	}
-	// https://github.com/golang/go/wiki/SliceTricks
-	a = append(a, atom{})
-	copy(a[p+1:], a[p:])
-	a[p] = atom{Pid: op.Pid, Value: op.Value}
-	l.atoms = a
-	l.text = l.text[:p] + op.Value + l.text[p:]
+	return &pid{Ids: genIds(l.alloc, agentId, prevIds, nextIds, minDepth), Seq: seq}, nil
 }
 
-func (l *Logoot) applyDeleteText(op *delete) {
-	a := l.atoms
-	p := l.search(op.Pid)
-	if p == len(a) || !a[p].Pid.Equal(op.Pid) {
+func (l *Logoot) applyInsertText(op *insert) {
+	if _, a := l.atoms.find(op.Pid); a != nil {
 		return
 	}
-	// https://github.com/golang/go/wiki/SliceTricks
-	a, a[len(a)-1] = append(a[:p], a[p+1:]...), atom{}
-	l.atoms = a
-	l.text = l.text[:p] + l.text[p+1:]
+	l.atoms.insert(atom{Pid: op.Pid, Value: op.Value})
 }
 
-// search returns the position of the first atom with pid >= the given pid.
-func (l *Logoot) search(pid *pid) int {
-	return sort.Search(len(l.atoms), func(i int) bool { return !l.atoms[i].Pid.Less(pid) })
+func (l *Logoot) applyDeleteText(op *deleteOp) {
+	l.atoms.delete(op.Pid)
 }
@@ -0,0 +1,334 @@
+package crdt_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/crdt"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+func fatal(t testing.TB, v ...interface{}) {
+	debug.PrintStack()
+	t.Fatal(v...)
+}
+
+func fatalf(t testing.TB, format string, v ...interface{}) {
+	debug.PrintStack()
+	t.Fatalf(format, v...)
+}
+
+func ok(t testing.TB, err error) {
+	if err != nil {
+		fatal(t, err)
+	}
+}
+
+func eq(t testing.TB, got, want interface{}) {
+	if !reflect.DeepEqual(got, want) {
+		fatalf(t, "got %v, want %v", got, want)
+	}
+}
+
+func applyUpdateAck(t testing.TB, l *crdt.Logoot, clientId uint32, opStrs ...string) (*common.Change, *common.Ack) {
+	var c common.Change
+	var a common.Ack
+	ok(t, l.ApplyUpdate(&common.Update{ClientId: clientId, OpStrs: opStrs}, &c, &a))
+	return &c, &a
+}
+
+func applyUpdate(t testing.TB, l *crdt.Logoot, clientId uint32, opStrs ...string) *common.Change {
+	c, _ := applyUpdateAck(t, l, clientId, opStrs...)
+	return c
+}
+
+// insertPid returns the encoded pid from the given encoded insert op.
+func insertPid(opStr string) string {
+	return strings.SplitN(opStr, ",", 3)[1]
+}
+
+func snapshot(t testing.TB, l *crdt.Logoot) *common.Snapshot {
+	var s common.Snapshot
+	ok(t, l.PopulateSnapshot(&s))
+	return &s
+}
+
+func TestLogootApplyUpdate(t *testing.T) {
+	l := crdt.NewLogoot()
+	c, a := applyUpdateAck(t, l, 0, "ci,,,abc")
+	eq(t, len(c.OpStrs), 3)
+	eq(t, snapshot(t, l).Text, "abc")
+	// The ack carries the pids assigned to each inserted atom.
+	eq(t, a.Pids, []string{insertPid(c.OpStrs[0]), insertPid(c.OpStrs[1]), insertPid(c.OpStrs[2])})
+	c, a = applyUpdateAck(t, l, 0, "cd,"+insertPid(c.OpStrs[1])+","+insertPid(c.OpStrs[1]))
+	eq(t, snapshot(t, l).Text, "ac")
+	eq(t, len(c.OpStrs), 1)
+	eq(t, a.Pids, []string(nil))
+}
+
+func TestLogootClientDelete(t *testing.T) {
+	l := crdt.NewLogoot()
+	c := applyUpdate(t, l, 0, "ci,,,abcdef")
+	pid := func(i int) string { return insertPid(c.OpStrs[i]) }
+
+	// The range is inclusive, and expands to one delete per atom.
+	c2 := applyUpdate(t, l, 0, "cd,"+pid(1)+","+pid(2))
+	eq(t, c2.OpStrs, []string{"d," + pid(1), "d," + pid(2)})
+	eq(t, snapshot(t, l).Text, "adef")
+
+	// Atoms inserted inside the range concurrently with the delete are also
+	// deleted. Here, client 1 deletes "de" without having seen client 2's
+	// insert between them. The endpoints need not exist, e.g. "b" is already
+	// deleted.
+	applyUpdate(t, l, 2, "ci,"+pid(3)+","+pid(4)+",XY")
+	eq(t, snapshot(t, l).Text, "adXYef")
+	c2 = applyUpdate(t, l, 1, "cd,"+pid(1)+","+pid(4))
+	eq(t, len(c2.OpStrs), 4)
+	eq(t, snapshot(t, l).Text, "af")
+
+	// An empty range is a no-op, whereas a reversed range is an error.
+	c2 = applyUpdate(t, l, 1, "cd,"+pid(2)+","+pid(3))
+	eq(t, len(c2.OpStrs), 0)
+	if err := l.ApplyUpdate(&common.Update{OpStrs: []string{"cd," + pid(5) + "," + pid(0)}}, &common.Change{}, &common.Ack{}); err == nil {
+		fatal(t, "expected error")
+	}
+
+	// Atoms inserted earlier in the same update are included.
+	c2 = applyUpdate(t, l, 1, "ci,"+pid(0)+","+pid(5)+",gh", "cd,"+pid(0)+","+pid(5))
+	eq(t, len(c2.OpStrs), 6)
+	eq(t, snapshot(t, l).Text, "")
+}
+
+func TestLogootUnicode(t *testing.T) {
+	snap, log := store.NewMemBlob(), store.NewMemLog()
+	l, err := crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	// Each code point gets its own atom: "e", a combining acute accent, a CJK
+	// character, and an emoji outside the Basic Multilingual Plane.
+	c, a := applyUpdateAck(t, l, 0, "ci,,,e\u0301中😀")
+	eq(t, len(c.OpStrs), 4)
+	eq(t, len(a.Pids), 4)
+	eq(t, strings.SplitN(c.OpStrs[3], ",", 3)[2], "😀")
+	applyUpdate(t, l, 0, "cd,"+insertPid(c.OpStrs[2])+","+insertPid(c.OpStrs[2]))
+	eq(t, snapshot(t, l).Text, "e\u0301😀")
+	applyUpdate(t, l, 0, "ci,"+insertPid(c.OpStrs[3])+",,文")
+	want := snapshot(t, l)
+	eq(t, want.Text, "e\u0301😀文")
+
+	// Atoms round-trip through the encoded snapshot and the op log.
+	ok(t, l.Checkpoint())
+	applyUpdate(t, l, 0, "cd,"+insertPid(c.OpStrs[1])+","+insertPid(c.OpStrs[1]))
+	want = snapshot(t, l)
+	eq(t, want.Text, "e😀文")
+	l, err = crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	eq(t, snapshot(t, l), want)
+
+	// Inserts must hold exactly one code point, and values must be valid UTF-8.
+	for _, opStr := range []string{
+		"i," + insertPid(c.OpStrs[0]) + ",ab",
+		"i," + insertPid(c.OpStrs[0]) + ",",
+		"i," + insertPid(c.OpStrs[0]) + ",\xff",
+		"ci,,,a\xffb",
+	} {
+		if err := l.ApplyRemoteUpdate(&common.Update{OpStrs: []string{opStr}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "expected error for %q", opStr)
+		}
+	}
+}
+
+func TestLogootClock(t *testing.T) {
+	snap, log := store.NewMemBlob(), store.NewMemLog()
+	l, err := crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	c := applyUpdate(t, l, 1, "ci,,,ab")
+	applyUpdate(t, l, 2, "ci,"+insertPid(c.OpStrs[1])+",,c")
+	// Each agent's pids are stamped from that agent's own clock.
+	eq(t, l.Clock(), crdt.VersionVector{1: 2, 2: 1})
+	eq(t, strings.HasSuffix(insertPid(c.OpStrs[1]), "~2"), true)
+
+	// Replicas have independent clocks.
+	other := crdt.NewLogoot()
+	c2 := applyUpdate(t, other, 1, "ci,,,x")
+	eq(t, strings.HasSuffix(insertPid(c2.OpStrs[0]), "~1"), true)
+	eq(t, other.Clock(), crdt.VersionVector{1: 1})
+
+	// The clock survives restarts, both via the snapshot and via the log.
+	ok(t, l.Checkpoint())
+	applyUpdate(t, l, 3, "cd,"+insertPid(c.OpStrs[0])+","+insertPid(c.OpStrs[0]))
+	l, err = crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	eq(t, l.Clock(), crdt.VersionVector{1: 2, 2: 1})
+	// Clock returns a copy.
+	l.Clock()[1] = 100
+	eq(t, l.Clock()[1], uint32(2))
+	// The clock is also part of the encoded snapshot, for clients.
+	var state struct{ Clock crdt.VersionVector }
+	ok(t, json.Unmarshal([]byte(snapshot(t, l).LogootStr), &state))
+	eq(t, state.Clock, crdt.VersionVector{1: 2, 2: 1})
+}
+
+func TestOpenLogoot(t *testing.T) {
+	snap, log := store.NewMemBlob(), store.NewMemLog()
+	l, err := crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	c := applyUpdate(t, l, 0, "ci,,,foo")
+	ok(t, l.Checkpoint())
+	c = applyUpdate(t, l, 1, "ci,"+insertPid(c.OpStrs[2])+",,bar")
+	want := snapshot(t, l)
+	eq(t, want.Text, "foobar")
+
+	// Simulate a restart. State is restored from the snapshot plus the log.
+	l, err = crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	eq(t, snapshot(t, l), want)
+
+	// Newly generated pids must not collide with existing ones, even if the
+	// atom with the highest seq was deleted.
+	lastPid, deletedPid := insertPid(c.OpStrs[1]), insertPid(c.OpStrs[2])
+	applyUpdate(t, l, 1, "cd,"+deletedPid+","+deletedPid)
+	ok(t, l.Checkpoint())
+	l, err = crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	eq(t, snapshot(t, l).Text, "fooba")
+	c = applyUpdate(t, l, 1, "ci,"+lastPid+",,r")
+	eq(t, snapshot(t, l).Text, "foobar")
+	if insertPid(c.OpStrs[0]) == deletedPid {
+		fatal(t, "pid reused: ", deletedPid)
+	}
+}
+
+func TestLogootConflictingInserts(t *testing.T) {
+	snap, log := store.NewMemBlob(), store.NewMemLog()
+	l, err := crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	c := applyUpdate(t, l, 0, "ci,,,a")
+	want := snapshot(t, l)
+
+	// Updates that would insert two values at one pid are rejected, and have no
+	// effect.
+	p := insertPid(c.OpStrs[0])
+	for _, opStrs := range [][]string{{"i,5.1~1,a", "i,5.1~1,b"}, {"i," + p + ",b"}, {"d," + p, "i," + p + ",b", "i," + p + ",c"}} {
+		if err := l.ApplyRemoteUpdate(&common.Update{ClientId: 1, OpStrs: opStrs}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyRemoteUpdate(%q) should have failed", opStrs)
+		}
+		eq(t, snapshot(t, l), want)
+	}
+	eq(t, remoteUpdate(t, l, "i,"+p+",a").PatchId, uint32(2))
+
+	// The rejected updates were not logged.
+	l, err = crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	want.BasePatchId = 2
+	eq(t, snapshot(t, l), want)
+}
+
+func TestLogootClockOverflow(t *testing.T) {
+	l := crdt.NewLogoot()
+	// Clients may not send ops with pids, which they could forge, e.g. to exhaust
+	// an agent's clock.
+	for _, opStr := range []string{"i,5.1~4294967294,a", "d,5.1~1"} {
+		if err := l.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{opStr}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyUpdate(%q) should have failed", opStr)
+		}
+	}
+	// Other replicas may, but not with a Seq beyond the highest clock value.
+	if err := l.ApplyRemoteUpdate(&common.Update{OpStrs: []string{"i,5.1~4294967295,a"}}, &common.Change{}, &common.Ack{}); err == nil {
+		fatal(t, "expected error")
+	}
+	remoteUpdate(t, l, "i,5.1~4294967294,a")
+	eq(t, l.Clock(), crdt.VersionVector{1: 4294967294})
+	// Agent 1's clock cannot be ticked again, so it cannot insert, rather than
+	// reusing Seq 0.
+	if err := l.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{"ci,,,b"}}, &common.Change{}, &common.Ack{}); err == nil {
+		fatal(t, "expected error")
+	}
+	applyUpdate(t, l, 2, "ci,,,b")
+	eq(t, snapshot(t, l).Text, "ab")
+}
+
+// resetFailingLog is a Log whose Reset fails, as if we crashed between writing a
+// snapshot and resetting the log.
+type resetFailingLog struct {
+	*store.MemLog
+}
+
+func (l resetFailingLog) Reset() error {
+	return errors.New("reset failed")
+}
+
+func TestOpenLogootSkipsSnapshottedRecords(t *testing.T) {
+	snap, log := store.NewMemBlob(), resetFailingLog{store.NewMemLog()}
+	l, err := crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	applyUpdate(t, l, 0, "ci,,,foo")
+	if err := l.Checkpoint(); err == nil {
+		fatal(t, "Checkpoint should have failed")
+	}
+	applyUpdate(t, l, 0, "ci,,,bar")
+	want := snapshot(t, l)
+
+	l, err = crdt.OpenLogoot(snap, log)
+	ok(t, err)
+	eq(t, snapshot(t, l), want)
+	eq(t, want.BasePatchId, uint32(2))
+}
+
+// atomPids returns the encoded pids of all atoms in l, in order.
+func atomPids(t testing.TB, l *crdt.Logoot) []string {
+	var state struct{ Atoms []struct{ Pid string } }
+	ok(t, json.Unmarshal([]byte(snapshot(t, l).LogootStr), &state))
+	pids := make([]string, len(state.Atoms))
+	for i, a := range state.Atoms {
+		pids[i] = a.Pid
+	}
+	return pids
+}
+
+// In each round, several agents concurrently insert runs of text at randomly
+// chosen gaps, often the same gap. Each run must end up contiguous.
+func TestConcurrentInsertsDoNotInterleave(t *testing.T) {
+	const numRounds, numAgents = 50, 4
+	for _, a := range allocators {
+		l := crdt.NewLogoot()
+		l.SetAllocator(a.alloc)
+		rng := rand.New(rand.NewSource(1))
+		for round := 0; round < numRounds; round++ {
+			// All agents generate their ops against the same state.
+			pids := append([]string{""}, atomPids(t, l)...)
+			pids = append(pids, "")
+			gap := rng.Intn(len(pids) - 1)
+			var opStrs []string
+			for agent := 0; agent < numAgents; agent++ {
+				if rng.Intn(2) == 0 {
+					gap = rng.Intn(len(pids) - 1)
+				}
+				value := strings.Repeat(string(rune('a'+agent)), 1+rng.Intn(8))
+				opStrs = append(opStrs, "ci,"+pids[gap]+","+pids[gap+1]+","+value)
+			}
+			// The server receives the ops in random order.
+			var runs [][]string
+			for _, i := range rng.Perm(numAgents) {
+				_, ack := applyUpdateAck(t, l, uint32(i), opStrs[i])
+				runs = append(runs, ack.Pids)
+			}
+			index := map[string]int{}
+			for i, pid := range atomPids(t, l) {
+				index[pid] = i
+			}
+			for _, run := range runs {
+				for i := range run {
+					if index[run[i]] != index[run[0]]+i {
+						fatalf(t, "%s: run interleaved: %v", a.name, run)
+					}
+				}
+			}
+		}
+	}
+}
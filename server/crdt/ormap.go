@@ -0,0 +1,539 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+// mapValue is implemented by the crdt types that can be ORMap values.
+type mapValue interface {
+	// PopulateSnapshot populates s.
+	PopulateSnapshot(s *common.Snapshot) error
+	// ApplyUpdate applies u, which must hold only client ops, and populates c
+	// and a.
+	ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error
+	// ApplyRemoteUpdate is like ApplyUpdate, except that u may also hold the ops
+	// of another replica's Changes.
+	ApplyRemoteUpdate(u *common.Update, c *common.Change, a *common.Ack) error
+	// encodeState returns the complete state, including any clocks.
+	encodeState() (string, error)
+	// decodeState loads the given state, as returned by encodeState, into a new
+	// value.
+	decodeState(s string) error
+	// resetHistory discards the history kept for resumed clients. ORMap values
+	// are never served directly, so they do not need it.
+	resetHistory()
+}
+
+var (
+	_ mapValue = (*Logoot)(nil)
+	_ mapValue = (*LWWRegister)(nil)
+	_ mapValue = (*MVRegister)(nil)
+	_ mapValue = (*PNCounter)(nil)
+	_ mapValue = (*ORSet)(nil)
+	_ mapValue = (*Graph)(nil)
+	_ mapValue = (*ORMap)(nil)
+)
+
+// mapValueTypes maps the name of each type that can be an ORMap value, as in
+// Init.DataType, to a constructor.
+var mapValueTypes = map[string]func() mapValue{
+	"crdt.Logoot": func() mapValue { return NewLogoot() },
+	"crdt.LogootLSEQ": func() mapValue {
+		l := NewLogoot()
+		l.SetAllocator(LSEQAllocator)
+		return l
+	},
+	"crdt.LWWRegister": func() mapValue { return NewLWWRegister() },
+	"crdt.MVRegister":  func() mapValue { return NewMVRegister() },
+	"crdt.PNCounter":   func() mapValue { return NewPNCounter() },
+	"crdt.ORSet":       func() mapValue { return NewORSet() },
+	"crdt.Graph":       func() mapValue { return NewGraph() },
+	"crdt.ORMap":       func() mapValue { return NewORMap() },
+}
+
+// mapOp is an ORMap op: an update to the value at a key path, or the removal of
+// the key at a key path.
+type mapOp struct {
+	Client bool
+	Remove bool
+	Path   []string
+	// For updates from other replicas, the new dot of each key in Path followed
+	// by the dots it replaces. For removals from other replicas, a single list of
+	// the removed dots of the last key in Path.
+	Dots  [][]dot
+	Type  string // type of the value, for updates
+	Inner string // encoded op to apply to the value, for updates
+}
+
+// Encode encodes this op.
+func (op *mapOp) Encode() string {
+	path := strings.Join(op.Path, "/")
+	switch {
+	case op.Client && op.Remove:
+		return "cr," + path
+	case op.Client:
+		return fmt.Sprintf("cu,%s,%s,%s", path, op.Type, op.Inner)
+	case op.Remove:
+		return fmt.Sprintf("r,%s,%s", path, encodeDotLists(op.Dots))
+	default:
+		return fmt.Sprintf("u,%s,%s,%s,%s", path, encodeDotLists(op.Dots), op.Type, op.Inner)
+	}
+}
+
+// encodeDotLists encodes the given dot lists, separated by slashes like the
+// keys of a key path.
+func encodeDotLists(lists [][]dot) string {
+	parts := make([]string, len(lists))
+	for i, dots := range lists {
+		parts[i] = encodeDotList(dots)
+	}
+	return strings.Join(parts, "/")
+}
+
+// decodeDotLists decodes the given string, as returned by encodeDotLists. Each
+// list must be non-empty.
+func decodeDotLists(s string) ([][]dot, error) {
+	var lists [][]dot
+	for _, part := range strings.Split(s, "/") {
+		dots, err := decodeDotList(part)
+		if err != nil {
+			return nil, err
+		}
+		if len(dots) == 0 {
+			return nil, fmt.Errorf("empty dot list: %q", s)
+		}
+		lists = append(lists, dots)
+	}
+	return lists, nil
+}
+
+// decodePath decodes the given key path. Keys must be non-empty and may not
+// contain slashes, which separate them, or commas.
+func decodePath(s string) ([]string, error) {
+	path := strings.Split(s, "/")
+	for _, k := range path {
+		if k == "" || strings.Contains(k, ",") || !utf8.ValidString(k) {
+			return nil, fmt.Errorf("invalid key path: %q", s)
+		}
+	}
+	return path, nil
+}
+
+// decodeMapOp decodes the given string into a mapOp.
+func decodeMapOp(s string) (*mapOp, error) {
+	var parts []string
+	op := &mapOp{}
+	switch t := strings.SplitN(s, ",", 2)[0]; t {
+	case "cu":
+		if parts = strings.SplitN(s, ",", 4); len(parts) < 4 {
+			return nil, newParseError(s)
+		}
+		op.Client, op.Type, op.Inner = true, parts[2], parts[3]
+	case "cr":
+		if parts = strings.Split(s, ","); len(parts) != 2 {
+			return nil, newParseError(s)
+		}
+		op.Client, op.Remove = true, true
+	case "u":
+		if parts = strings.SplitN(s, ",", 5); len(parts) < 5 {
+			return nil, newParseError(s)
+		}
+		op.Type, op.Inner = parts[3], parts[4]
+	case "r":
+		if parts = strings.Split(s, ","); len(parts) != 3 {
+			return nil, newParseError(s)
+		}
+		op.Remove = true
+	default:
+		return nil, fmt.Errorf("unknown op type: %s", t)
+	}
+	var err error
+	if op.Path, err = decodePath(parts[1]); err != nil {
+		return nil, newParseError(s)
+	}
+	if !op.Client {
+		if op.Dots, err = decodeDotLists(parts[2]); err != nil {
+			return nil, newParseError(s)
+		}
+		if op.Remove && len(op.Dots) != 1 || !op.Remove && len(op.Dots) != len(op.Path) {
+			return nil, newParseError(s)
+		}
+	}
+	if !op.Remove {
+		// Nested maps are addressed by key path, so a value may not itself be an
+		// ORMap.
+		if _, ok := mapValueTypes[op.Type]; !ok || op.Type == "crdt.ORMap" {
+			return nil, fmt.Errorf("invalid value type: %s", op.Type)
+		}
+	}
+	return op, nil
+}
+
+// mapEntry is an entry in an ORMap.
+type mapEntry struct {
+	typ   string
+	value mapValue
+	// Live dots of the key. The key is present iff there are any.
+	dots map[dot]bool
+}
+
+// ORMap is an observed-remove map from string keys to values of the other crdt
+// types, including nested ORMaps, so that it can hold a whole JSON-like
+// document. Key presence works like ORSet membership: each update to a key
+// replaces the key's observed dots with a new one, and a remove deletes only the
+// dots it observed, so an update wins over a concurrent remove. Values are never
+// reset, so a key that is removed and later updated keeps its old value's state.
+//
+// Clients send "cu,<path>,<type>,<op>" to apply a client op of the given type,
+// such as "cs,foo", to the value at a key path such as "tasks/42/title",
+// creating keys as needed, and "cr,<path>" to remove the key at a key path. The
+// server expands these into "u,<path>,<dots>,<type>,<op>", with a dot list per
+// key in the path, and "r,<path>,<dots>", which each Change holds and which
+// only other replicas may send. A key's type is fixed by the first update to
+// it.
+//
+// Each update copies the values it touches, and a persisted ORMap rewrites its
+// whole state, so ORMap suits records rather than large documents.
+type ORMap struct {
+	entries map[string]*mapEntry
+	ctx     dotContext
+	history
+}
+
+// NewORMap returns a new, empty ORMap.
+func NewORMap() *ORMap {
+	return &ORMap{entries: map[string]*mapEntry{}, ctx: newDotContext()}
+}
+
+// OpenORMap returns an ORMap persisted in snap.
+func OpenORMap(snap store.Blob) (*ORMap, error) {
+	m := NewORMap()
+	if err := m.open(snap, m.decodeState); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Keys returns the keys present in the map, in sorted order.
+func (m *ORMap) Keys() []string {
+	res := []string{}
+	for k, e := range m.entries {
+		if len(e.dots) > 0 {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Get returns the value for the given key, e.g. an *LWWRegister, and whether
+// the key is present.
+func (m *ORMap) Get(key string) (interface{}, bool) {
+	e := m.entries[key]
+	if e == nil || len(e.dots) == 0 {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// orMapState is the encoded form of an ORMap.
+type orMapState struct {
+	Entries map[string]orMapEntryState
+	Clock   VersionVector
+	Cloud   []string // encoded dots seen out of order
+}
+
+type orMapEntryState struct {
+	Type  string
+	Dots  []string // encoded live dots
+	State string   // as returned by the value's encodeState
+}
+
+// Encode encodes this ORMap as JSON.
+func (m *ORMap) Encode() (string, error) {
+	state := orMapState{Entries: map[string]orMapEntryState{}, Clock: m.ctx.clock, Cloud: encodeDots(m.ctx.cloud)}
+	for k, e := range m.entries {
+		s, err := e.value.encodeState()
+		if err != nil {
+			return "", err
+		}
+		state.Entries[k] = orMapEntryState{Type: e.typ, Dots: encodeDots(e.dots), State: s}
+	}
+	buf, err := json.Marshal(&state)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (m *ORMap) encodeState() (string, error) {
+	return m.Encode()
+}
+
+func (m *ORMap) decodeState(s string) error {
+	var state orMapState
+	if err := json.Unmarshal([]byte(s), &state); err != nil {
+		return err
+	}
+	m.ctx.clock.Merge(state.Clock)
+	for _, v := range state.Cloud {
+		d, err := decodeDot(v)
+		if err != nil {
+			return err
+		}
+		m.ctx.add(d)
+	}
+	for k, es := range state.Entries {
+		newValue, ok := mapValueTypes[es.Type]
+		if !ok {
+			return fmt.Errorf("invalid value type: %s", es.Type)
+		}
+		e := &mapEntry{typ: es.Type, value: newValue(), dots: map[dot]bool{}}
+		if err := e.value.decodeState(es.State); err != nil {
+			return err
+		}
+		for _, v := range es.Dots {
+			d, err := decodeDot(v)
+			if err != nil {
+				return err
+			}
+			e.dots[d] = true
+		}
+		m.entries[k] = e
+	}
+	return nil
+}
+
+// PopulateSnapshot populates s.
+func (m *ORMap) PopulateSnapshot(s *common.Snapshot) error {
+	state, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	s.BasePatchId = m.lastPatchId
+	s.State = state
+	return nil
+}
+
+// ApplyUpdate applies u, which must hold only client ops, and populates c and
+// a. The Ack holds the pids assigned to atoms inserted into Logoot values, in
+// order.
+func (m *ORMap) ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return m.applyUpdate(u, c, a, false)
+}
+
+// ApplyRemoteUpdate is like ApplyUpdate, except that u may also hold the ops of
+// another replica's Changes. Those ops carry dots, which a client could forge,
+// so u must come from a trusted replica.
+func (m *ORMap) ApplyRemoteUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return m.applyUpdate(u, c, a, true)
+}
+
+func (m *ORMap) applyUpdate(u *common.Update, c *common.Change, a *common.Ack, remote bool) error {
+	ops := make([]*mapOp, len(u.OpStrs))
+	for i, s := range u.OpStrs {
+		op, err := decodeMapOp(s)
+		if err != nil {
+			return err
+		}
+		if !op.Client && !remote {
+			return fmt.Errorf("not a client op: %s", s)
+		}
+		ops[i] = op
+	}
+	// Values cannot apply ops speculatively, so apply the ops to copies of the
+	// entries they touch. If any op fails, or panics, the map is unchanged.
+	next, err := m.copyEntries(ops)
+	if err != nil {
+		return err
+	}
+	opStrs, pids := []string{}, []string(nil)
+	for _, op := range ops {
+		applied, opPids, err := next.apply(u.ClientId, op)
+		if err != nil {
+			return err
+		}
+		for _, x := range applied {
+			opStrs = append(opStrs, x.Encode())
+		}
+		pids = append(pids, opPids...)
+	}
+	old := m.swapEntries(next)
+	if err := m.save(m.Encode); err != nil {
+		m.swapEntries(old)
+		return err
+	}
+	c.OpStrs = opStrs
+	c.PatchId = m.append(u.ClientId, opStrs)
+	a.PatchId = c.PatchId
+	a.Pids = pids
+	return nil
+}
+
+// copyEntries returns an ORMap holding copies of the entries of m that the given
+// ops touch, or nil for those that are absent, and a copy of the dot context of
+// m.
+func (m *ORMap) copyEntries(ops []*mapOp) (*ORMap, error) {
+	res := &ORMap{entries: map[string]*mapEntry{}, ctx: m.ctx.copy()}
+	for _, op := range ops {
+		key := op.Path[0]
+		if _, ok := res.entries[key]; ok {
+			continue
+		}
+		e := m.entries[key]
+		if e == nil {
+			res.entries[key] = nil
+			continue
+		}
+		s, err := e.value.encodeState()
+		if err != nil {
+			return nil, err
+		}
+		cp := &mapEntry{typ: e.typ, value: mapValueTypes[e.typ](), dots: copyDots(e.dots)}
+		if err := cp.value.decodeState(s); err != nil {
+			return nil, err
+		}
+		res.entries[key] = cp
+	}
+	return res, nil
+}
+
+func copyDots(dots map[dot]bool) map[dot]bool {
+	res := make(map[dot]bool, len(dots))
+	for d := range dots {
+		res[d] = true
+	}
+	return res
+}
+
+// swapEntries replaces the entries and dot context of m with those of other, as
+// returned by copyEntries, and returns the replaced ones in the same form.
+func (m *ORMap) swapEntries(other *ORMap) *ORMap {
+	res := &ORMap{entries: map[string]*mapEntry{}, ctx: m.ctx}
+	for key, e := range other.entries {
+		res.entries[key] = m.entries[key]
+		if e == nil {
+			delete(m.entries, key)
+		} else {
+			m.entries[key] = e
+		}
+	}
+	m.ctx = other.ctx
+	return res
+}
+
+// apply applies op, whose path is relative to m, and returns the ops that took
+// effect, with paths relative to m, along with the pids assigned to any atoms
+// inserted into Logoot values.
+func (m *ORMap) apply(clientId uint32, op *mapOp) ([]*mapOp, []string, error) {
+	key := op.Path[0]
+	if op.Remove && len(op.Path) == 1 {
+		return m.applyRemove(op), nil, nil
+	}
+	typ := "crdt.ORMap"
+	if len(op.Path) == 1 {
+		typ = op.Type
+	}
+	e := m.entries[key]
+	if e == nil {
+		if op.Client && op.Remove {
+			return nil, nil, nil
+		}
+		e = &mapEntry{typ: typ, value: mapValueTypes[typ](), dots: map[dot]bool{}}
+		m.entries[key] = e
+	} else if e.typ != typ {
+		return nil, nil, fmt.Errorf("key %s has type %s, not %s", key, e.typ, typ)
+	}
+
+	// Determine the new dot for key and the dots it replaces, if the op is an
+	// update.
+	var dots []dot
+	switch {
+	case op.Remove:
+	case !op.Client:
+		dots = op.Dots[0]
+	default:
+		dots = append([]dot{m.ctx.next(clientId)}, sortDots(e.dots)...)
+	}
+
+	var res []*mapOp
+	var pids []string
+	if len(op.Path) == 1 {
+		var ic common.Change
+		var ia common.Ack
+		// The inner op of a client op must itself be a client op.
+		apply := e.value.ApplyUpdate
+		if !op.Client {
+			apply = e.value.ApplyRemoteUpdate
+		}
+		if err := apply(&common.Update{ClientId: clientId, OpStrs: []string{op.Inner}}, &ic, &ia); err != nil {
+			return nil, nil, err
+		}
+		e.value.resetHistory()
+		for _, s := range ic.OpStrs {
+			res = append(res, &mapOp{Path: []string{key}, Dots: [][]dot{dots}, Type: op.Type, Inner: s})
+		}
+		pids = ia.Pids
+	} else {
+		sub := *op
+		sub.Path = op.Path[1:]
+		if !op.Client && !op.Remove {
+			sub.Dots = op.Dots[1:]
+		}
+		childOps, childPids, err := e.value.(*ORMap).apply(clientId, &sub)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, x := range childOps {
+			x.Path = append([]string{key}, x.Path...)
+			if !x.Remove {
+				x.Dots = append([][]dot{dots}, x.Dots...)
+			}
+			res = append(res, x)
+		}
+		pids = childPids
+	}
+	// A client update that had no effect produces no op to carry its dots to
+	// other replicas, so it must not change the key's dots.
+	if !op.Remove && (!op.Client || len(res) > 0) {
+		for _, d := range dots[1:] {
+			m.ctx.add(d)
+			delete(e.dots, d)
+		}
+		if !m.ctx.seen(dots[0]) {
+			m.ctx.add(dots[0])
+			e.dots[dots[0]] = true
+		}
+	}
+	return res, pids, nil
+}
+
+// applyRemove applies op, which removes a key of m, and returns the ops that
+// took effect.
+func (m *ORMap) applyRemove(op *mapOp) []*mapOp {
+	key := op.Path[0]
+	e := m.entries[key]
+	var dots []dot
+	if op.Client {
+		if e == nil || len(e.dots) == 0 {
+			return nil
+		}
+		dots = sortDots(e.dots)
+	} else {
+		dots = op.Dots[0]
+	}
+	for _, d := range dots {
+		m.ctx.add(d)
+		if e != nil {
+			delete(e.dots, d)
+		}
+	}
+	return []*mapOp{{Remove: true, Path: []string{key}, Dots: [][]dot{dots}}}
+}
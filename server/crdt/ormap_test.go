@@ -0,0 +1,159 @@
+package crdt_test
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/crdt"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+func get(t testing.TB, m *crdt.ORMap, path ...string) interface{} {
+	for i, k := range path {
+		v, ok := m.Get(k)
+		if !ok {
+			fatalf(t, "missing key: %s", k)
+		}
+		if i == len(path)-1 {
+			return v
+		}
+		m = v.(*crdt.ORMap)
+	}
+	return m
+}
+
+func text(t testing.TB, d dataType) string {
+	var s common.Snapshot
+	ok(t, d.PopulateSnapshot(&s))
+	return s.Text
+}
+
+func TestORMap(t *testing.T) {
+	m := crdt.NewORMap()
+	eq(t, m.Keys(), []string{})
+	c := update(t, m, 1, "cu,title,crdt.LWWRegister,cs,foo")
+	eq(t, strings.HasPrefix(c.OpStrs[0], "u,title,1.1,crdt.LWWRegister,s,"), true)
+	eq(t, get(t, m, "title").(*crdt.LWWRegister).Value(), "foo")
+
+	// Nested maps are created as needed.
+	c = update(t, m, 1, "cu,tasks/a/done,crdt.PNCounter,cp,1")
+	eq(t, c.OpStrs, []string{"u,tasks/a/done,1.2/1.1/1.1,crdt.PNCounter,p,1,1"})
+	eq(t, get(t, m, "tasks", "a", "done").(*crdt.PNCounter).Value(), int64(1))
+	eq(t, m.Keys(), []string{"tasks", "title"})
+
+	// Logoot values forward the pids assigned to inserted atoms.
+	var a common.Ack
+	ok(t, m.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{"cu,body,crdt.Logoot,ci,,,ab"}}, &common.Change{}, &a))
+	eq(t, len(a.Pids), 2)
+	eq(t, text(t, get(t, m, "body").(*crdt.Logoot)), "ab")
+
+	// Each update replaces the key's dots. An update wins over a concurrent
+	// remove.
+	eq(t, update(t, m, 1, "cu,title,crdt.LWWRegister,cs,bar").OpStrs[0][:14], "u,title,1.4:1.")
+	eq(t, update(t, m, 2, "cr,title").OpStrs, []string{"r,title,1.4"})
+	eq(t, m.Keys(), []string{"body", "tasks"})
+	remoteUpdate(t, m, "u,title,2.1,crdt.LWWRegister,s,2000.0,2,baz")
+	eq(t, m.Keys(), []string{"body", "tasks", "title"})
+	remoteUpdate(t, m, "r,title,2.1")
+	eq(t, update(t, m, 2, "cr,title", "cr,x/y").OpStrs, []string{})
+	eq(t, m.Keys(), []string{"body", "tasks"})
+
+	// Client updates that have no effect do not add keys.
+	eq(t, update(t, m, 1, "cu,tags,crdt.ORSet,cr,x").OpStrs, []string{})
+	eq(t, m.Keys(), []string{"body", "tasks"})
+
+	// Failed updates have no effect, including on the keys touched by earlier ops
+	// in the update.
+	before := state(t, m)
+	for _, first := range []string{"cu,n,crdt.PNCounter,cp,1", "cu,tasks/a/done,crdt.PNCounter,cp,1"} {
+		for _, s := range []string{"cu,tasks,crdt.PNCounter,cp,1", "cu,body/x,crdt.PNCounter,cp,1", "cu,count,crdt.PNCounter,cx,1", "cu,tasks/a/done,crdt.PNCounter,cx,1"} {
+			if err := m.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{first, s}}, &common.Change{}, &common.Ack{}); err == nil {
+				fatalf(t, "ApplyUpdate(%q) should have failed", s)
+			}
+			eq(t, state(t, m), before)
+		}
+	}
+
+	// Clients may not send downstream ops, whose dots they could forge.
+	for _, s := range []string{"u,a,1.1,crdt.PNCounter,p,1,1", "r,body,1.3"} {
+		if err := m.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{s}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyUpdate(%q) should have failed", s)
+		}
+	}
+	eq(t, state(t, m), before)
+	// The same goes for the inner ops of client ops.
+	for _, s := range []string{"cu,k,crdt.ORSet,a,7.1000000,x", "cu,k,crdt.MVRegister,s,7.1,,x", "cu,k,crdt.LWWRegister,s,1000.0,7,x", "cu,k,crdt.PNCounter,p,7,100", "cu,k,crdt.Graph,av,x", "cu,k,crdt.Logoot,i,5.7~1,x"} {
+		if err := m.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{s}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyUpdate(%q) should have failed", s)
+		}
+	}
+	eq(t, state(t, m), before)
+
+	for _, s := range []string{"cu,,crdt.LWWRegister,cs,x", "cu,a//b,crdt.LWWRegister,cs,x", "cu,a,crdt.ORMap,cr,b", "cu,a,crdt.Foo,x", "cu,a", "u,a,,crdt.PNCounter,p,1,1", "u,a/b,1.1,crdt.PNCounter,p,1,1", "r,a,", "r,a,1.1/1.1", "cr,a,b", "x,a"} {
+		if err := m.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{s}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyUpdate(%q) should have failed", s)
+		}
+	}
+}
+
+// TestORMapConverges runs clients against several replicas, then delivers the
+// resulting ops to every replica in a different random order.
+func TestORMapConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	key := func() string {
+		return string(rune('a' + rng.Intn(3)))
+	}
+	for i := 0; i < 200; i++ {
+		replicas := []*crdt.ORMap{crdt.NewORMap(), crdt.NewORMap(), crdt.NewORMap()}
+		var ops []string
+		for j := 0; j < 20; j++ {
+			var op string
+			switch rng.Intn(4) {
+			case 0:
+				op = fmt.Sprintf("cu,%s,crdt.PNCounter,cp,%d", key(), rng.Intn(3))
+			case 1:
+				op = fmt.Sprintf("cu,m/%s,crdt.ORSet,ca,%s", key(), key())
+			case 2:
+				op = "cr," + key()
+			case 3:
+				op = "cr,m/" + key()
+			}
+			k := rng.Intn(len(replicas))
+			ops = append(ops, update(t, replicas[k], uint32(k+1), op).OpStrs...)
+		}
+		for _, r := range replicas {
+			for _, j := range rng.Perm(len(ops)) {
+				remoteUpdate(t, r, ops[j])
+			}
+		}
+		for _, r := range replicas[1:] {
+			eq(t, state(t, r), state(t, replicas[0]))
+			eq(t, r.Keys(), replicas[0].Keys())
+		}
+	}
+}
+
+func TestOpenORMap(t *testing.T) {
+	snap := store.NewMemBlob()
+	m, err := crdt.OpenORMap(snap)
+	ok(t, err)
+	update(t, m, 1, "cu,title,crdt.LWWRegister,cs,foo", "cu,tasks/a,crdt.MVRegister,cs,,x")
+	update(t, m, 1, "cu,body,crdt.LogootLSEQ,ci,,,ab")
+
+	// Simulate a restart.
+	m, err = crdt.OpenORMap(snap)
+	ok(t, err)
+	eq(t, m.Keys(), []string{"body", "tasks", "title"})
+	eq(t, get(t, m, "title").(*crdt.LWWRegister).Value(), "foo")
+	eq(t, get(t, m, "tasks", "a").(*crdt.MVRegister).Values(), []string{"x"})
+	eq(t, text(t, get(t, m, "body").(*crdt.Logoot)), "ab")
+	var s common.Snapshot
+	ok(t, m.PopulateSnapshot(&s))
+	eq(t, s.BasePatchId, uint32(2))
+	eq(t, m.Replay(1, func(*common.Change, *common.Ack) {}), common.ErrResyncRequired)
+	update(t, m, 1, "cu,title,crdt.LWWRegister,cs,bar")
+	eq(t, get(t, m, "title").(*crdt.LWWRegister).Value(), "bar")
+}
@@ -0,0 +1,434 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+// dot is a unique tag for an ORSet add: the agent that performed it, and that
+// agent's logical clock value at the time.
+type dot struct {
+	AgentId uint32
+	Seq     uint32
+}
+
+// Encode encodes this dot.
+func (d dot) Encode() string {
+	return fmt.Sprintf("%d.%d", d.AgentId, d.Seq)
+}
+
+// decodeDot decodes the given string into a dot.
+func decodeDot(s string) (dot, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return dot{}, fmt.Errorf("invalid dot: %s", s)
+	}
+	agentId, err := common.Atoi(parts[0])
+	if err != nil {
+		return dot{}, fmt.Errorf("invalid agentId: %s", s)
+	}
+	seq, err := common.Atoi(parts[1])
+	if err != nil || seq == 0 {
+		return dot{}, fmt.Errorf("invalid seq: %s", s)
+	}
+	return dot{agentId, seq}, nil
+}
+
+// encodeDotList encodes the given dots, separated by colons.
+func encodeDotList(dots []dot) string {
+	dotStrs := make([]string, len(dots))
+	for i, d := range dots {
+		dotStrs[i] = d.Encode()
+	}
+	return strings.Join(dotStrs, ":")
+}
+
+// decodeDotList decodes the given colon-separated dots. The empty string
+// decodes to no dots.
+func decodeDotList(s string) ([]dot, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var dots []dot
+	for _, v := range strings.Split(s, ":") {
+		d, err := decodeDot(v)
+		if err != nil {
+			return nil, err
+		}
+		dots = append(dots, d)
+	}
+	return dots, nil
+}
+
+// dotContext records the dots that an ORSet has seen, whether or not they are
+// still live. It stores every dot up to clock[agentId] compactly, so removed
+// adds leave no per-element tombstones; only dots seen out of order are stored
+// individually, until the gaps before them are filled.
+type dotContext struct {
+	clock VersionVector
+	cloud map[dot]bool
+}
+
+func newDotContext() dotContext {
+	return dotContext{clock: VersionVector{}, cloud: map[dot]bool{}}
+}
+
+func (c *dotContext) copy() dotContext {
+	res := newDotContext()
+	res.clock.Merge(c.clock)
+	for d := range c.cloud {
+		res.cloud[d] = true
+	}
+	return res
+}
+
+func (c *dotContext) seen(d dot) bool {
+	return d.Seq <= c.clock[d.AgentId] || c.cloud[d]
+}
+
+func (c *dotContext) add(d dot) {
+	if c.seen(d) {
+		return
+	}
+	if d.Seq != c.clock[d.AgentId]+1 {
+		c.cloud[d] = true
+		return
+	}
+	c.clock[d.AgentId] = d.Seq
+	for next := (dot{d.AgentId, d.Seq + 1}); c.cloud[next]; next.Seq++ {
+		delete(c.cloud, next)
+		c.clock[d.AgentId] = next.Seq
+	}
+}
+
+// next returns a new dot for the given agent, greater than any seen.
+func (c *dotContext) next(agentId uint32) dot {
+	seq := c.clock[agentId]
+	for d := range c.cloud {
+		if d.AgentId == agentId && d.Seq > seq {
+			seq = d.Seq
+		}
+	}
+	return dot{agentId, seq + 1}
+}
+
+// clientAdd represents an element addition from a client.
+type clientAdd struct {
+	Value string
+}
+
+// Encode encodes this op.
+func (op *clientAdd) Encode() string {
+	return "ca," + op.Value
+}
+
+// clientRemove represents an element removal from a client. The server expands
+// it into a remove of the element's dots in the server's current state.
+type clientRemove struct {
+	Value string
+}
+
+// Encode encodes this op.
+func (op *clientRemove) Encode() string {
+	return "cr," + op.Value
+}
+
+// add represents an element addition, tagged with a unique dot.
+type add struct {
+	Dot   dot
+	Value string
+}
+
+// Encode encodes this op.
+func (op *add) Encode() string {
+	return fmt.Sprintf("a,%s,%s", op.Dot.Encode(), op.Value)
+}
+
+// remove represents the removal of the given dots of an element, i.e. the adds
+// observed by the remover. Adds that the remover had not observed survive, so
+// an add wins over a concurrent remove.
+type remove struct {
+	Dots  []dot
+	Value string
+}
+
+// Encode encodes this op.
+func (op *remove) Encode() string {
+	return fmt.Sprintf("r,%s,%s", encodeDotList(op.Dots), op.Value)
+}
+
+// decodeSetElemOp decodes the given string into an ORSet op.
+func decodeSetElemOp(s string) (op, error) {
+	parts := strings.SplitN(s, ",", 2)
+	if len(parts) < 2 {
+		return nil, newParseError(s)
+	}
+	switch parts[0] {
+	case "ca", "cr":
+		if !utf8.ValidString(parts[1]) {
+			return nil, newParseError(s)
+		}
+		if parts[0] == "ca" {
+			return &clientAdd{parts[1]}, nil
+		}
+		return &clientRemove{parts[1]}, nil
+	case "a", "r":
+		parts = strings.SplitN(s, ",", 3)
+		if len(parts) < 3 || !utf8.ValidString(parts[2]) {
+			return nil, newParseError(s)
+		}
+		dots, err := decodeDotList(parts[1])
+		if err != nil || len(dots) == 0 {
+			return nil, newParseError(s)
+		}
+		if parts[0] == "r" {
+			return &remove{dots, parts[2]}, nil
+		}
+		if len(dots) != 1 {
+			return nil, newParseError(s)
+		}
+		return &add{dots[0], parts[2]}, nil
+	default:
+		return nil, fmt.Errorf("unknown op type: %s", parts[0])
+	}
+}
+
+// ORSet is an observed-remove set of strings with add-wins semantics. Each add
+// tags the element with a unique dot, and a remove deletes only the dots it
+// observed, so an element is present iff some add of it has not been removed.
+// The add and remove ops commute, so replicas that apply the same ops in any
+// order converge.
+//
+// Clients send "ca,<value>" and "cr,<value>". The server expands them into
+// "a,<dot>,<value>" and "r,<dot>:<dot>...,<value>", which each Change holds and
+// which only other replicas may send.
+type ORSet struct {
+	elems map[string]map[dot]bool // live dots of each present element
+	ctx   dotContext
+	history
+}
+
+// NewORSet returns a new, empty ORSet.
+func NewORSet() *ORSet {
+	return &ORSet{elems: map[string]map[dot]bool{}, ctx: newDotContext()}
+}
+
+// orSetState is the encoded form of an ORSet.
+type orSetState struct {
+	Elems map[string][]string // encoded live dots of each present element
+	Clock VersionVector
+	Cloud []string // encoded dots seen out of order
+}
+
+// OpenORSet returns an ORSet persisted in snap.
+func OpenORSet(snap store.Blob) (*ORSet, error) {
+	s := NewORSet()
+	if err := s.open(snap, s.decodeState); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ORSet) encodeState() (string, error) {
+	return s.Encode()
+}
+
+func (s *ORSet) decodeState(str string) error {
+	var state orSetState
+	if err := json.Unmarshal([]byte(str), &state); err != nil {
+		return err
+	}
+	s.ctx.clock.Merge(state.Clock)
+	for _, v := range state.Cloud {
+		d, err := decodeDot(v)
+		if err != nil {
+			return err
+		}
+		s.ctx.add(d)
+	}
+	for value, dotStrs := range state.Elems {
+		dots := map[dot]bool{}
+		for _, v := range dotStrs {
+			d, err := decodeDot(v)
+			if err != nil {
+				return err
+			}
+			dots[d] = true
+		}
+		if len(dots) > 0 {
+			s.elems[value] = dots
+		}
+	}
+	return nil
+}
+
+// Encode encodes this ORSet as JSON.
+func (s *ORSet) Encode() (string, error) {
+	state := orSetState{Elems: map[string][]string{}, Clock: s.ctx.clock, Cloud: encodeDots(s.ctx.cloud)}
+	for value, dots := range s.elems {
+		state.Elems[value] = encodeDots(dots)
+	}
+	buf, err := json.Marshal(&state)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// encodeDots returns the encoded dots in the given set, in sorted order.
+func encodeDots(dots map[dot]bool) []string {
+	res := make([]string, 0, len(dots))
+	for _, d := range sortDots(dots) {
+		res = append(res, d.Encode())
+	}
+	return res
+}
+
+func sortDots(dots map[dot]bool) []dot {
+	res := make([]dot, 0, len(dots))
+	for d := range dots {
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].AgentId != res[j].AgentId {
+			return res[i].AgentId < res[j].AgentId
+		}
+		return res[i].Seq < res[j].Seq
+	})
+	return res
+}
+
+// Contains returns true iff the set contains value.
+func (s *ORSet) Contains(value string) bool {
+	return len(s.elems[value]) > 0
+}
+
+// Values returns the elements of the set, in sorted order.
+func (s *ORSet) Values() []string {
+	res := make([]string, 0, len(s.elems))
+	for value := range s.elems {
+		res = append(res, value)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// PopulateSnapshot populates s.
+func (s *ORSet) PopulateSnapshot(sn *common.Snapshot) error {
+	state, err := s.Encode()
+	if err != nil {
+		return err
+	}
+	sn.BasePatchId = s.lastPatchId
+	sn.State = state
+	return nil
+}
+
+// ApplyUpdate applies u, which must hold only client ops, and populates c and
+// a.
+func (s *ORSet) ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return s.applyUpdate(u, c, a, false)
+}
+
+// ApplyRemoteUpdate is like ApplyUpdate, except that u may also hold the ops of
+// another replica's Changes. Those ops carry dots, which a client could forge,
+// so u must come from a trusted replica.
+func (s *ORSet) ApplyRemoteUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return s.applyUpdate(u, c, a, true)
+}
+
+func (s *ORSet) applyUpdate(u *common.Update, c *common.Change, a *common.Ack, remote bool) error {
+	ops := make([]op, len(u.OpStrs))
+	for i, v := range u.OpStrs {
+		op, err := decodeSetElemOp(v)
+		if err != nil {
+			return err
+		}
+		switch op.(type) {
+		case *clientAdd, *clientRemove:
+		default:
+			if !remote {
+				return fmt.Errorf("not a client op: %s", v)
+			}
+		}
+		ops[i] = op
+	}
+	// Each client op is expanded against the state left by the ops before it. If
+	// the update must be persisted before it takes effect, apply the ops to a
+	// copy of the state.
+	next := s
+	if s.snap != nil {
+		next = s.copy()
+	}
+	opStrs := []string{}
+	for _, op := range ops {
+		switch v := op.(type) {
+		case *clientAdd:
+			op = &add{next.ctx.next(u.ClientId), v.Value}
+		case *clientRemove:
+			if !next.Contains(v.Value) {
+				continue
+			}
+			op = &remove{sortDots(next.elems[v.Value]), v.Value}
+		}
+		next.applyOp(op)
+		opStrs = append(opStrs, op.Encode())
+	}
+	if err := s.save(next.Encode); err != nil {
+		return err
+	}
+	s.elems, s.ctx = next.elems, next.ctx
+	c.OpStrs = opStrs
+	c.PatchId = s.append(u.ClientId, opStrs)
+	a.PatchId = c.PatchId
+	return nil
+}
+
+// copy returns a copy of the elements and dot context of s.
+func (s *ORSet) copy() *ORSet {
+	res := NewORSet()
+	res.ctx = s.ctx.copy()
+	for value, dots := range s.elems {
+		res.elems[value] = make(map[dot]bool, len(dots))
+		for d := range dots {
+			res.elems[value][d] = true
+		}
+	}
+	return res
+}
+
+// applyOp applies the given add or remove op.
+func (s *ORSet) applyOp(op op) {
+	switch v := op.(type) {
+	case *add:
+		s.applyAdd(v)
+	case *remove:
+		for _, d := range v.Dots {
+			s.ctx.add(d)
+			delete(s.elems[v.Value], d)
+		}
+		if len(s.elems[v.Value]) == 0 {
+			delete(s.elems, v.Value)
+		}
+	default:
+		panic(fmt.Sprintf("unexpected op type: %T", v))
+	}
+}
+
+func (s *ORSet) applyAdd(op *add) {
+	if s.ctx.seen(op.Dot) {
+		// Already added, and possibly removed.
+		return
+	}
+	s.ctx.add(op.Dot)
+	if s.elems[op.Value] == nil {
+		s.elems[op.Value] = map[dot]bool{}
+	}
+	s.elems[op.Value][op.Dot] = true
+}
@@ -0,0 +1,114 @@
+package crdt_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/crdt"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+func TestORSet(t *testing.T) {
+	s := crdt.NewORSet()
+	eq(t, update(t, s, 1, "ca,x", "ca,y,z").OpStrs, []string{"a,1.1,x", "a,1.2,y,z"})
+	eq(t, update(t, s, 2, "ca,x").OpStrs, []string{"a,2.1,x"})
+	eq(t, s.Values(), []string{"x", "y,z"})
+
+	// A client remove removes every observed add.
+	eq(t, update(t, s, 2, "cr,x").OpStrs, []string{"r,1.1:2.1,x"})
+	eq(t, s.Contains("x"), false)
+	// Removing a missing element does nothing.
+	eq(t, update(t, s, 2, "cr,x").OpStrs, []string{})
+
+	// A remove does not affect adds it did not observe.
+	remoteUpdate(t, s, "a,3.1,w")
+	remoteUpdate(t, s, "r,3.2,w")
+	eq(t, s.Contains("w"), true)
+	// The add of 3.2 arrives after its remove, so it has no effect.
+	remoteUpdate(t, s, "a,3.2,w")
+	remoteUpdate(t, s, "r,3.1,w")
+	eq(t, s.Contains("w"), false)
+	eq(t, s.Values(), []string{"y,z"})
+	eq(t, state(t, s), `{"Elems":{"y,z":["1.2"]},"Clock":{"1":2,"2":1,"3":2},"Cloud":[]}`)
+
+	for _, op := range []string{"ca", "a,1,x", "a,1.0,x", "a,1.1:1.2,x", "r,,x", "x,y"} {
+		if err := s.ApplyRemoteUpdate(&common.Update{ClientId: 1, OpStrs: []string{op}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyRemoteUpdate(%q) should have failed", op)
+		}
+	}
+	// Clients may not send ops with dots, which they could forge.
+	for _, op := range []string{"a,4.1,v", "r,2.100,zz"} {
+		if err := s.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{op}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyUpdate(%q) should have failed", op)
+		}
+	}
+	eq(t, state(t, s), `{"Elems":{"y,z":["1.2"]},"Clock":{"1":2,"2":1,"3":2},"Cloud":[]}`)
+}
+
+// TestORSetConverges runs clients against several replicas, then delivers the
+// resulting ops to every replica in a different random order.
+func TestORSetConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 200; i++ {
+		replicas := []*crdt.ORSet{crdt.NewORSet(), crdt.NewORSet(), crdt.NewORSet()}
+		var ops []string
+		for j := 0; j < 30; j++ {
+			// Replica k serves clients with ids k, k+3, ..., so that dots are unique.
+			k := rng.Intn(len(replicas))
+			clientId := uint32(k + len(replicas)*rng.Intn(2))
+			op := fmt.Sprintf("%s,%d", []string{"ca", "cr"}[rng.Intn(2)], rng.Intn(4))
+			ops = append(ops, update(t, replicas[k], clientId, op).OpStrs...)
+			// Occasionally deliver an op to another replica early.
+			if len(ops) > 0 && rng.Intn(3) == 0 {
+				remoteUpdate(t, replicas[rng.Intn(len(replicas))], ops[rng.Intn(len(ops))])
+			}
+		}
+		for _, r := range replicas {
+			for _, j := range rng.Perm(len(ops)) {
+				remoteUpdate(t, r, ops[j])
+			}
+		}
+		want := state(t, replicas[0])
+		for _, r := range replicas[1:] {
+			eq(t, state(t, r), want)
+		}
+	}
+}
+
+func TestORSetAddWins(t *testing.T) {
+	a, b := crdt.NewORSet(), crdt.NewORSet()
+	add := update(t, a, 1, "ca,x").OpStrs
+	remoteUpdate(t, b, add...)
+	// Concurrently, b removes x and a adds it again.
+	remove := update(t, b, 2, "cr,x").OpStrs
+	readd := update(t, a, 1, "ca,x").OpStrs
+	remoteUpdate(t, a, remove...)
+	remoteUpdate(t, b, readd...)
+	eq(t, a.Values(), []string{"x"})
+	eq(t, b.Values(), []string{"x"})
+}
+
+func TestOpenORSet(t *testing.T) {
+	snap := store.NewMemBlob()
+	s, err := crdt.OpenORSet(snap)
+	ok(t, err)
+	update(t, s, 1, "ca,x", "ca,y")
+	update(t, s, 1, "cr,x")
+	remoteUpdate(t, s, "a,2.5,z")
+
+	// Simulate a restart.
+	s, err = crdt.OpenORSet(snap)
+	ok(t, err)
+	eq(t, s.Values(), []string{"y", "z"})
+	var sn common.Snapshot
+	ok(t, s.PopulateSnapshot(&sn))
+	eq(t, sn.BasePatchId, uint32(3))
+	// Seen dots are remembered, so new adds get fresh dots and stale adds are
+	// ignored.
+	eq(t, update(t, s, 1, "ca,x").OpStrs, []string{"a,1.3,x"})
+	remoteUpdate(t, s, "a,1.1,x")
+	eq(t, update(t, s, 1, "cr,x").OpStrs, []string{"r,1.3,x"})
+	eq(t, update(t, s, 2, "ca,w").OpStrs, []string{"a,2.6,w"})
+}
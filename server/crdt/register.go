@@ -0,0 +1,436 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+// clientSet represents a register write from a client that has no clock of its
+// own. The server stamps it with the server's clock.
+type clientSet struct {
+	Value string
+}
+
+// Encode encodes this op.
+func (op *clientSet) Encode() string {
+	return "cs," + op.Value
+}
+
+// set represents a stamped register write. Of two writes, the one with the
+// greater Timestamp wins, with ties broken by AgentId.
+type set struct {
+	Timestamp Timestamp
+	AgentId   uint32
+	Value     string
+}
+
+// Encode encodes this op.
+func (op *set) Encode() string {
+	return fmt.Sprintf("s,%s,%d,%s", op.Timestamp.Encode(), op.AgentId, op.Value)
+}
+
+// Less returns true iff op loses to other.
+func (op *set) Less(other *set) bool {
+	if op.Timestamp != other.Timestamp {
+		return op.Timestamp.Less(other.Timestamp)
+	}
+	return op.AgentId < other.AgentId
+}
+
+// decodeSetOp decodes the given string into a clientSet or set op.
+func decodeSetOp(s string) (op, error) {
+	parts := strings.SplitN(s, ",", 2)
+	switch parts[0] {
+	case "cs":
+		if len(parts) < 2 || !utf8.ValidString(parts[1]) {
+			return nil, newParseError(s)
+		}
+		return &clientSet{parts[1]}, nil
+	case "s":
+		parts = strings.SplitN(s, ",", 4)
+		if len(parts) < 4 || !utf8.ValidString(parts[3]) {
+			return nil, newParseError(s)
+		}
+		ts, err := decodeTimestamp(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		agentId, err := common.Atoi(parts[2])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &set{ts, agentId, parts[3]}, nil
+	default:
+		return nil, fmt.Errorf("unknown op type: %s", parts[0])
+	}
+}
+
+// LWWRegister is a last-writer-wins register holding a string. Every write is
+// a set op, and the register holds the winning set, so replicas that apply the
+// same sets in any order converge.
+//
+// Clients send "cs,<value>" and the server stamps the write, so that it wins over
+// every write the server has seen. Each Change holds the register state after
+// the patch, encoded as the winning set op "s,<timestamp>,<agentId>,<value>",
+// which only other replicas may send.
+type LWWRegister struct {
+	cur   set
+	clock *HLC
+	history
+}
+
+// NewLWWRegister returns a new LWWRegister, whose value is the empty string.
+func NewLWWRegister() *LWWRegister {
+	return &LWWRegister{clock: NewHLC(nil)}
+}
+
+// OpenLWWRegister returns an LWWRegister persisted in snap.
+func OpenLWWRegister(snap store.Blob) (*LWWRegister, error) {
+	r := NewLWWRegister()
+	if err := r.open(snap, r.decodeState); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Value returns the current value.
+func (r *LWWRegister) Value() string {
+	return r.cur.Value
+}
+
+// Encode encodes this LWWRegister as the set op that produced its state.
+func (r *LWWRegister) Encode() string {
+	return r.cur.Encode()
+}
+
+func (r *LWWRegister) encodeState() (string, error) {
+	return r.Encode(), nil
+}
+
+func (r *LWWRegister) decodeState(s string) error {
+	op, err := decodeSetOp(s)
+	if err != nil {
+		return err
+	}
+	x, ok := op.(*set)
+	if !ok {
+		return fmt.Errorf("invalid state: %s", s)
+	}
+	r.cur = *x
+	// Our physical clock may have gone backwards since the write.
+	r.clock.advance(x.Timestamp)
+	return nil
+}
+
+// PopulateSnapshot populates s.
+func (r *LWWRegister) PopulateSnapshot(s *common.Snapshot) error {
+	s.BasePatchId = r.lastPatchId
+	s.Text = r.cur.Value
+	s.State = r.Encode()
+	return nil
+}
+
+// ApplyUpdate applies u, which must hold only client ops, and populates c and
+// a.
+func (r *LWWRegister) ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return r.applyUpdate(u, c, a, false)
+}
+
+// ApplyRemoteUpdate is like ApplyUpdate, except that u may also hold the set
+// ops of another replica's Changes. Those ops carry timestamps and agent ids,
+// which a client could forge, so u must come from a trusted replica.
+func (r *LWWRegister) ApplyRemoteUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return r.applyUpdate(u, c, a, true)
+}
+
+func (r *LWWRegister) applyUpdate(u *common.Update, c *common.Change, a *common.Ack, remote bool) error {
+	cur := r.cur
+	for _, s := range u.OpStrs {
+		op, err := decodeSetOp(s)
+		if err != nil {
+			return err
+		}
+		var x *set
+		switch v := op.(type) {
+		case *clientSet:
+			x = &set{r.clock.Now(), u.ClientId, v.Value}
+		case *set:
+			if !remote {
+				return fmt.Errorf("not a client op: %s", s)
+			}
+			if err := r.clock.Observe(v.Timestamp); err != nil {
+				return err
+			}
+			x = v
+		}
+		if cur.Less(x) {
+			cur = *x
+		}
+	}
+	c.OpStrs = []string{cur.Encode()}
+	if err := r.save(func() (string, error) { return c.OpStrs[0], nil }); err != nil {
+		return err
+	}
+	r.cur = cur
+	c.PatchId = r.append(u.ClientId, c.OpStrs)
+	a.PatchId = c.PatchId
+	return nil
+}
+
+// clientMVSet represents a multi-value register write from a client. Observed
+// holds the dots of the values the client saw, which the write overwrites.
+type clientMVSet struct {
+	Observed []dot
+	Value    string
+}
+
+// Encode encodes this op.
+func (op *clientMVSet) Encode() string {
+	return fmt.Sprintf("cs,%s,%s", encodeDotList(op.Observed), op.Value)
+}
+
+// mvSet represents a multi-value register write, tagged with a unique dot.
+// It overwrites the values with the given dots.
+type mvSet struct {
+	Dot         dot
+	Overwritten []dot
+	Value       string
+}
+
+// Encode encodes this op.
+func (op *mvSet) Encode() string {
+	return fmt.Sprintf("s,%s,%s,%s", op.Dot.Encode(), encodeDotList(op.Overwritten), op.Value)
+}
+
+// decodeMVSetOp decodes the given string into a clientMVSet or mvSet op.
+func decodeMVSetOp(s string) (op, error) {
+	parts := strings.SplitN(s, ",", 2)
+	switch parts[0] {
+	case "cs":
+		parts = strings.SplitN(s, ",", 3)
+		if len(parts) < 3 || !utf8.ValidString(parts[2]) {
+			return nil, newParseError(s)
+		}
+		observed, err := decodeDotList(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &clientMVSet{observed, parts[2]}, nil
+	case "s":
+		parts = strings.SplitN(s, ",", 4)
+		if len(parts) < 4 || !utf8.ValidString(parts[3]) {
+			return nil, newParseError(s)
+		}
+		d, err := decodeDot(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		overwritten, err := decodeDotList(parts[2])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &mvSet{d, overwritten, parts[3]}, nil
+	default:
+		return nil, fmt.Errorf("unknown op type: %s", parts[0])
+	}
+}
+
+// MVRegister is a multi-value register holding strings. A write overwrites the
+// values its writer had seen, so concurrent writes do not overwrite each other
+// and the register exposes all of their values, until a later write resolves
+// the conflict. Writes are tagged with dots as in ORSet, and replicas that
+// apply the same writes in any order converge.
+//
+// Clients send "cs,<dot>:<dot>...,<value>", listing the dots of the values they
+// saw, from the Snapshot or from Changes; the list may be empty. The server
+// expands this into "s,<dot>,<dot>:<dot>...,<value>", which each Change holds
+// and which only other replicas may send.
+type MVRegister struct {
+	values map[dot]string
+	ctx    dotContext
+	history
+}
+
+// NewMVRegister returns a new MVRegister, which holds no values.
+func NewMVRegister() *MVRegister {
+	return &MVRegister{values: map[dot]string{}, ctx: newDotContext()}
+}
+
+// mvRegisterState is the encoded form of an MVRegister.
+type mvRegisterState struct {
+	Values map[string]string // keyed by encoded dot
+	Clock  VersionVector
+	Cloud  []string // encoded dots seen out of order
+}
+
+// OpenMVRegister returns an MVRegister persisted in snap.
+func OpenMVRegister(snap store.Blob) (*MVRegister, error) {
+	r := NewMVRegister()
+	if err := r.open(snap, r.decodeState); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Values returns the current values, ordered by dot. There is more than one
+// iff there were concurrent writes.
+func (r *MVRegister) Values() []string {
+	res := []string{}
+	for _, d := range sortDots(r.dots()) {
+		res = append(res, r.values[d])
+	}
+	return res
+}
+
+func (r *MVRegister) dots() map[dot]bool {
+	res := make(map[dot]bool, len(r.values))
+	for d := range r.values {
+		res[d] = true
+	}
+	return res
+}
+
+// Encode encodes this MVRegister as JSON.
+func (r *MVRegister) Encode() (string, error) {
+	state := mvRegisterState{Values: map[string]string{}, Clock: r.ctx.clock, Cloud: encodeDots(r.ctx.cloud)}
+	for d, v := range r.values {
+		state.Values[d.Encode()] = v
+	}
+	buf, err := json.Marshal(&state)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (r *MVRegister) encodeState() (string, error) {
+	return r.Encode()
+}
+
+func (r *MVRegister) decodeState(s string) error {
+	var state mvRegisterState
+	if err := json.Unmarshal([]byte(s), &state); err != nil {
+		return err
+	}
+	r.ctx.clock.Merge(state.Clock)
+	for _, v := range state.Cloud {
+		d, err := decodeDot(v)
+		if err != nil {
+			return err
+		}
+		r.ctx.add(d)
+	}
+	for k, v := range state.Values {
+		d, err := decodeDot(k)
+		if err != nil {
+			return err
+		}
+		r.values[d] = v
+	}
+	return nil
+}
+
+// PopulateSnapshot populates s.
+func (r *MVRegister) PopulateSnapshot(s *common.Snapshot) error {
+	state, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	s.BasePatchId = r.lastPatchId
+	s.State = state
+	return nil
+}
+
+// ApplyUpdate applies u, which must hold only client ops, and populates c and
+// a.
+func (r *MVRegister) ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return r.applyUpdate(u, c, a, false)
+}
+
+// ApplyRemoteUpdate is like ApplyUpdate, except that u may also hold the set
+// ops of another replica's Changes. Those ops carry dots, which a client could
+// forge, so u must come from a trusted replica.
+func (r *MVRegister) ApplyRemoteUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	return r.applyUpdate(u, c, a, true)
+}
+
+func (r *MVRegister) applyUpdate(u *common.Update, c *common.Change, a *common.Ack, remote bool) error {
+	// Check the observed dots before applying anything, so that a bad update
+	// leaves the state unchanged. Clients can only have observed dots from the
+	// state or from earlier ops in the update.
+	ops := make([]op, len(u.OpStrs))
+	added := map[dot]bool{}
+	for i, s := range u.OpStrs {
+		op, err := decodeMVSetOp(s)
+		if err != nil {
+			return err
+		}
+		switch v := op.(type) {
+		case *clientMVSet:
+			for _, d := range v.Observed {
+				if !r.ctx.seen(d) && !added[d] {
+					return fmt.Errorf("unknown dot: %s", d.Encode())
+				}
+			}
+		case *mvSet:
+			if !remote {
+				return fmt.Errorf("not a client op: %s", s)
+			}
+			added[v.Dot] = true
+		}
+		ops[i] = op
+	}
+	// Client ops are stamped with dots that depend on the ops before them. If
+	// the update must be persisted before it takes effect, apply the ops to a
+	// copy of the state.
+	next := r
+	if r.snap != nil {
+		next = r.copy()
+	}
+	opStrs := make([]string, len(ops))
+	for i, op := range ops {
+		var x *mvSet
+		switch v := op.(type) {
+		case *clientMVSet:
+			x = &mvSet{next.ctx.next(u.ClientId), v.Observed, v.Value}
+		case *mvSet:
+			x = v
+		}
+		next.applySet(x)
+		opStrs[i] = x.Encode()
+	}
+	if err := r.save(next.Encode); err != nil {
+		return err
+	}
+	r.values, r.ctx = next.values, next.ctx
+	c.OpStrs = opStrs
+	c.PatchId = r.append(u.ClientId, opStrs)
+	a.PatchId = c.PatchId
+	return nil
+}
+
+// copy returns a copy of the values and dot context of r.
+func (r *MVRegister) copy() *MVRegister {
+	res := NewMVRegister()
+	res.ctx = r.ctx.copy()
+	for d, v := range r.values {
+		res.values[d] = v
+	}
+	return res
+}
+
+func (r *MVRegister) applySet(op *mvSet) {
+	for _, d := range op.Overwritten {
+		r.ctx.add(d)
+		delete(r.values, d)
+	}
+	if !r.ctx.seen(op.Dot) {
+		r.ctx.add(op.Dot)
+		r.values[op.Dot] = op.Value
+	}
+}
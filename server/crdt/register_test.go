@@ -0,0 +1,193 @@
+package crdt_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/crdt"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+// dataType is implemented by the crdt types served by the hub.
+type dataType interface {
+	PopulateSnapshot(s *common.Snapshot) error
+	ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error
+}
+
+func update(t testing.TB, d dataType, clientId uint32, opStrs ...string) *common.Change {
+	var c common.Change
+	ok(t, d.ApplyUpdate(&common.Update{ClientId: clientId, OpStrs: opStrs}, &c, &common.Ack{}))
+	return &c
+}
+
+// remoteDataType is implemented by the crdt types that can apply the ops of
+// another replica's Changes.
+type remoteDataType interface {
+	dataType
+	ApplyRemoteUpdate(u *common.Update, c *common.Change, a *common.Ack) error
+}
+
+func remoteUpdate(t testing.TB, d remoteDataType, opStrs ...string) *common.Change {
+	var c common.Change
+	ok(t, d.ApplyRemoteUpdate(&common.Update{OpStrs: opStrs}, &c, &common.Ack{}))
+	return &c
+}
+
+func state(t testing.TB, d dataType) string {
+	var s common.Snapshot
+	ok(t, d.PopulateSnapshot(&s))
+	return s.State
+}
+
+func TestLWWRegister(t *testing.T) {
+	r := crdt.NewLWWRegister()
+	eq(t, r.Value(), "")
+	c := remoteUpdate(t, r, "s,1000.0,1,foo")
+	eq(t, c.PatchId, uint32(1))
+	eq(t, c.OpStrs, []string{"s,1000.0,1,foo"})
+
+	// Older writes lose; ties are broken by agent id.
+	c = remoteUpdate(t, r, "s,999.5,2,bar")
+	eq(t, c.OpStrs, []string{"s,1000.0,1,foo"})
+	eq(t, remoteUpdate(t, r, "s,1000.0,2,bar").OpStrs, []string{"s,1000.0,2,bar"})
+	eq(t, remoteUpdate(t, r, "s,1000.0,1,baz").OpStrs, []string{"s,1000.0,2,bar"})
+	eq(t, r.Value(), "bar")
+
+	// Writes stamped by the server win over everything it has seen, even with a
+	// clock that lags behind the writers'.
+	update(t, r, 1, "cs,a,b")
+	eq(t, r.Value(), "a,b")
+	eq(t, state(t, r), r.Encode())
+
+	for _, s := range []string{"s,1,1,x", "s,1.0,x,y", "s,1.0,1", "x,1", fmt.Sprintf("s,%d.0,1,x", 1<<62)} {
+		if err := r.ApplyRemoteUpdate(&common.Update{ClientId: 1, OpStrs: []string{s}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyRemoteUpdate(%q) should have failed", s)
+		}
+	}
+	// Clients may not send stamped writes, whose agent id they could forge.
+	if err := r.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{"s,1000.0,2,x"}}, &common.Change{}, &common.Ack{}); err == nil {
+		fatal(t, "expected error")
+	}
+	eq(t, r.Value(), "a,b")
+}
+
+func TestLWWRegisterConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		// Each agent stamps one write, so that no two writes have the same stamp.
+		var ops []string
+		for j := 0; j < 10; j++ {
+			ops = append(ops, fmt.Sprintf("s,%d.%d,%d,v%d", rng.Intn(3), rng.Intn(3), j, j))
+		}
+		a, b := crdt.NewLWWRegister(), crdt.NewLWWRegister()
+		for _, op := range ops {
+			remoteUpdate(t, a, op)
+		}
+		for _, j := range rng.Perm(len(ops)) {
+			remoteUpdate(t, b, ops[j])
+		}
+		eq(t, b.Encode(), a.Encode())
+	}
+}
+
+func TestOpenLWWRegister(t *testing.T) {
+	snap := store.NewMemBlob()
+	r, err := crdt.OpenLWWRegister(snap)
+	ok(t, err)
+	update(t, r, 1, "cs,foo")
+	c := remoteUpdate(t, r, "s,1000.0,2,bar")
+
+	// Simulate a restart.
+	r, err = crdt.OpenLWWRegister(snap)
+	ok(t, err)
+	eq(t, r.Value(), "foo")
+	var s common.Snapshot
+	ok(t, r.PopulateSnapshot(&s))
+	eq(t, s.BasePatchId, uint32(2))
+	eq(t, s.State, c.OpStrs[0])
+	eq(t, r.Replay(1, func(*common.Change, *common.Ack) {}), common.ErrResyncRequired)
+
+	// New server writes still win, even though they may have a smaller wall time
+	// than the persisted one.
+	update(t, r, 1, "cs,baz")
+	eq(t, r.Value(), "baz")
+	var got []string
+	ok(t, r.Replay(2, func(c *common.Change, a *common.Ack) {
+		eq(t, c.PatchId, a.PatchId)
+		got = append(got, c.OpStrs...)
+	}))
+	eq(t, got, []string{r.Encode()})
+}
+
+func TestMVRegister(t *testing.T) {
+	r := crdt.NewMVRegister()
+	eq(t, r.Values(), []string{})
+	c := update(t, r, 1, "cs,,foo")
+	eq(t, c.OpStrs, []string{"s,1.1,,foo"})
+	eq(t, r.Values(), []string{"foo"})
+
+	// Concurrent writes are all exposed, until a write that saw them.
+	update(t, r, 2, "cs,,bar")
+	remoteUpdate(t, r, "s,3.1,,baz")
+	eq(t, r.Values(), []string{"foo", "bar", "baz"})
+	eq(t, update(t, r, 1, "cs,1.1:2.1,a,b").OpStrs, []string{"s,1.2,1.1:2.1,a,b"})
+	eq(t, r.Values(), []string{"a,b", "baz"})
+
+	// Writes that were already overwritten have no effect.
+	remoteUpdate(t, r, "s,2.1,,bar")
+	eq(t, r.Values(), []string{"a,b", "baz"})
+	eq(t, state(t, r), `{"Values":{"1.2":"a,b","3.1":"baz"},"Clock":{"1":2,"2":1,"3":1},"Cloud":[]}`)
+
+	for _, s := range []string{"cs,foo", "cs,4.1,foo", "s,1.0,,foo", "s,1.3", "x,1"} {
+		if err := r.ApplyRemoteUpdate(&common.Update{ClientId: 1, OpStrs: []string{s}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyRemoteUpdate(%q) should have failed", s)
+		}
+	}
+	// Clients may not send ops with dots, which they could forge.
+	for _, s := range []string{"s,4.1,,x", "s,2.100,1.2:3.1,x"} {
+		if err := r.ApplyUpdate(&common.Update{ClientId: 1, OpStrs: []string{s}}, &common.Change{}, &common.Ack{}); err == nil {
+			fatalf(t, "ApplyUpdate(%q) should have failed", s)
+		}
+	}
+	eq(t, r.Values(), []string{"a,b", "baz"})
+}
+
+func TestMVRegisterConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		replicas := []*crdt.MVRegister{crdt.NewMVRegister(), crdt.NewMVRegister(), crdt.NewMVRegister()}
+		var ops []string
+		for j := 0; j < 10; j++ {
+			k := rng.Intn(len(replicas))
+			ops = append(ops, update(t, replicas[k], uint32(k+1), fmt.Sprintf("cs,,v%d", j)).OpStrs...)
+		}
+		for _, r := range replicas {
+			for _, j := range rng.Perm(len(ops)) {
+				remoteUpdate(t, r, ops[j])
+			}
+		}
+		for _, r := range replicas[1:] {
+			eq(t, state(t, r), state(t, replicas[0]))
+		}
+	}
+}
+
+func TestOpenMVRegister(t *testing.T) {
+	snap := store.NewMemBlob()
+	r, err := crdt.OpenMVRegister(snap)
+	ok(t, err)
+	update(t, r, 1, "cs,,foo")
+	remoteUpdate(t, r, "s,2.1,,bar")
+
+	// Simulate a restart.
+	r, err = crdt.OpenMVRegister(snap)
+	ok(t, err)
+	eq(t, r.Values(), []string{"foo", "bar"})
+	var s common.Snapshot
+	ok(t, r.PopulateSnapshot(&s))
+	eq(t, s.BasePatchId, uint32(2))
+	eq(t, update(t, r, 1, "cs,1.1:2.1,baz").OpStrs, []string{"s,1.2,1.1:2.1,baz"})
+	eq(t, r.Values(), []string{"baz"})
+}
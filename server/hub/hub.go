@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,6 +19,7 @@ import (
 	"github.com/asadovsky/goatee/server/common"
 	"github.com/asadovsky/goatee/server/crdt"
 	"github.com/asadovsky/goatee/server/ot"
+	"github.com/asadovsky/goatee/server/store"
 )
 
 func ok(err error, v ...interface{}) {
@@ -23,12 +28,6 @@ func ok(err error, v ...interface{}) {
 	}
 }
 
-func assert(b bool, v ...interface{}) {
-	if !b {
-		panic(fmt.Sprint(v...))
-	}
-}
-
 func jsonMarshal(v interface{}) []byte {
 	buf, err := json.Marshal(v)
 	ok(err)
@@ -39,156 +38,709 @@ func isReadFromClosedConnError(err error) bool {
 	return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
 }
 
+// codedError is an error with a machine-readable code. It is reported to the
+// client as an Error message.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return fmt.Sprintf("%s: %v", e.code, e.err)
+}
+
+func newCodedError(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// newErrorMsg returns the Error message that reports err to the client.
+// Errors without a code are reported as internal errors.
+func newErrorMsg(err error) *common.Error {
+	ce, ok := err.(*codedError)
+	if !ok {
+		ce = &codedError{code: common.CodeInternal, err: err}
+	}
+	return &common.Error{Type: "Error", Code: ce.code, Message: ce.err.Error()}
+}
+
+// dataType is implemented by all document types served by the hub.
+type dataType interface {
+	// PopulateSnapshot populates s.
+	PopulateSnapshot(s *common.Snapshot) error
+	// ApplyUpdate applies u and populates c and a.
+	ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error
+}
+
+// newDataType returns a new instance of the data type for the given document.
+// If dataDir is non-empty, document state is persisted under dataDir.
+func newDataType(dataDir string, k docKey) (dataType, error) {
+	switch k.dataType {
+	case "ot.Text":
+		if dataDir == "" {
+			return ot.NewText(""), nil
+		}
+		opLog, err := store.OpenFileLog(k.path(dataDir, "log"))
+		if err != nil {
+			return nil, err
+		}
+		return ot.OpenText(store.NewFileBlob(k.path(dataDir, "snap")), opLog)
+	case "ot.DeltaText":
+		if dataDir == "" {
+			return ot.NewDeltaText(""), nil
+		}
+		opLog, err := store.OpenFileLog(k.path(dataDir, "log"))
+		if err != nil {
+			return nil, err
+		}
+		return ot.OpenDeltaText(store.NewFileBlob(k.path(dataDir, "snap")), opLog)
+	case "crdt.Logoot", "crdt.LogootLSEQ":
+		l := crdt.NewLogoot()
+		if dataDir != "" {
+			opLog, err := store.OpenFileLog(k.path(dataDir, "log"))
+			if err != nil {
+				return nil, err
+			}
+			if l, err = crdt.OpenLogoot(store.NewFileBlob(k.path(dataDir, "snap")), opLog); err != nil {
+				return nil, err
+			}
+		}
+		if k.dataType == "crdt.LogootLSEQ" {
+			l.SetAllocator(crdt.LSEQAllocator)
+		}
+		return l, nil
+	case "crdt.LWWRegister":
+		if dataDir == "" {
+			return crdt.NewLWWRegister(), nil
+		}
+		return crdt.OpenLWWRegister(store.NewFileBlob(k.path(dataDir, "snap")))
+	case "crdt.PNCounter":
+		if dataDir == "" {
+			return crdt.NewPNCounter(), nil
+		}
+		return crdt.OpenPNCounter(store.NewFileBlob(k.path(dataDir, "snap")))
+	case "crdt.ORSet":
+		if dataDir == "" {
+			return crdt.NewORSet(), nil
+		}
+		return crdt.OpenORSet(store.NewFileBlob(k.path(dataDir, "snap")))
+	case "crdt.Graph":
+		if dataDir == "" {
+			return crdt.NewGraph(), nil
+		}
+		return crdt.OpenGraph(store.NewFileBlob(k.path(dataDir, "snap")))
+	case "crdt.MVRegister":
+		if dataDir == "" {
+			return crdt.NewMVRegister(), nil
+		}
+		return crdt.OpenMVRegister(store.NewFileBlob(k.path(dataDir, "snap")))
+	case "crdt.ORMap":
+		if dataDir == "" {
+			return crdt.NewORMap(), nil
+		}
+		return crdt.OpenORMap(store.NewFileBlob(k.path(dataDir, "snap")))
+	default:
+		return nil, newCodedError(common.CodeBadInit, fmt.Errorf("unknown data type: %s", k.dataType))
+	}
+}
+
+// replayer is implemented by data types that support resuming clients.
+type replayer interface {
+	// Replay calls f with the Change and Ack for each patch after basePatchId,
+	// in order. If the Ack is nil, the Change is sent even to the client that
+	// created the patch.
+	Replay(basePatchId uint32, f func(c *common.Change, a *common.Ack)) error
+}
+
+// selector is implemented by data types that track client selections.
+type selector interface {
+	// SetSelection sets a client's selection and populates s.
+	SetSelection(m *common.Select, s *common.Selection) error
+	// ClearSelection clears a client's selection, if any.
+	ClearSelection(clientId uint32)
+}
+
+// undoer is implemented by data types that support undo and redo.
+type undoer interface {
+	// Undo undoes one of the given client's patches and populates c.
+	Undo(clientId uint32, m *common.Undo, c *common.Change) error
+	// Redo redoes one of the given client's undone patches and populates c.
+	Redo(clientId uint32, m *common.Redo, c *common.Change) error
+}
+
+// compacter is implemented by data types that can discard old history.
+type compacter interface {
+	// Compact discards the history needed only by clients whose BasePatchId is
+	// older than basePatchId.
+	Compact(basePatchId uint32) error
+}
+
+// docKey identifies a document. Documents with the same DocId but different
+// DataType are distinct.
+type docKey struct {
+	docId    uint32
+	dataType string
+}
+
+// path returns the path of the file with the given extension that stores
+// state for this document.
+func (k docKey) path(dataDir, ext string) string {
+	return filepath.Join(dataDir, fmt.Sprintf("%s-%d.%s", k.dataType, k.docId, ext))
+}
+
+// doc is a document, along with the set of clients subscribed to it.
+type doc struct {
+	key     docKey
+	streams map[*stream]bool // set of initialized streams; guarded by hub.mu
+	data    dataType
+	// PatchId passed to the most recent Compact call. Guarded by hub.mu.
+	compactedPatchId uint32
+	// PatchId of the most recent patch. Guarded by hub.mu.
+	lastPatchId uint32
+}
+
+// observePatchId records that a patch with the given PatchId was created.
+// Requires hub.mu to be held.
+func (d *doc) observePatchId(patchId uint32) {
+	if patchId > d.lastPatchId {
+		d.lastPatchId = patchId
+	}
+}
+
+// collaborators returns the clients connected to this document, other than
+// the given stream, ordered by ClientId. Requires hub.mu to be held.
+func (d *doc) collaborators(except *stream) []common.Collaborator {
+	res := []common.Collaborator{}
+	for s := range d.streams {
+		if s != except {
+			res = append(res, common.Collaborator{ClientId: s.clientId, Meta: s.meta})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ClientId < res[j].ClientId })
+	return res
+}
+
+// removeStream removes s from this document, clears its selection, and tells
+// the other clients that it left. Requires hub.mu to be held.
+func (d *doc) removeStream(s *stream) {
+	delete(d.streams, s)
+	if sr, ok := d.data.(selector); ok {
+		sr.ClearSelection(s.clientId)
+	}
+	left := &common.Left{Type: "Left", ClientId: s.clientId}
+	d.broadcast(jsonMarshal(left), nil, nil)
+}
+
+// broadcast sends msg to all clients of this document. If origin is non-nil,
+// originMsg is sent to origin in place of msg, or nothing is sent to origin if
+// originMsg is nil. Requires hub.mu to be held, so that all clients observe
+// messages in the order they were broadcast.
+func (d *doc) broadcast(msg []byte, origin *stream, originMsg []byte) {
+	for s := range d.streams {
+		if s != origin {
+			s.enqueue(msg)
+		} else if originMsg != nil {
+			s.enqueue(originMsg)
+		}
+	}
+}
+
+// defaultCompactInterval is the default minimum number of patches discarded by
+// each compaction. Compacting in batches amortizes the cost of checkpoints.
+const defaultCompactInterval = 1000
+
+// defaultSendQueueSize is the default maximum number of messages queued for
+// each client. A client that falls further behind is disconnected, so that it
+// cannot stall the hub; it can then reconnect and resume.
+const defaultSendQueueSize = 1024
+
 type hub struct {
-	clients      map[chan<- []byte]bool // set of active clients
-	subscribe    chan chan<- []byte
-	unsubscribe  chan chan<- []byte
-	broadcast    chan []byte
-	mu           sync.Mutex // protects the fields below
-	nextClientId uint32
-	text         *ot.Text
-	logoot       *crdt.Logoot
+	dataDir         string
+	compactInterval uint32
+	sendQueueSize   int
+	mu              sync.Mutex // protects the fields below
+	nextClientId    uint32
+	clientIds       store.Blob // persisted nextClientId; nil if not persisted
+	docs            map[docKey]*doc
 }
 
-func newHub() *hub {
-	return &hub{
-		clients:     make(map[chan<- []byte]bool),
-		subscribe:   make(chan chan<- []byte),
-		unsubscribe: make(chan chan<- []byte),
-		broadcast:   make(chan []byte),
-		text:        ot.NewText(""),
-		logoot:      crdt.NewLogoot(),
+func newHub(dataDir string) (*hub, error) {
+	h := &hub{
+		dataDir:         dataDir,
+		compactInterval: defaultCompactInterval,
+		sendQueueSize:   defaultSendQueueSize,
+		docs:            make(map[docKey]*doc),
 	}
+	if dataDir != "" {
+		// Persist nextClientId so that client ids in persisted document history
+		// are never reassigned, e.g. to resumed clients.
+		h.clientIds = store.NewFileBlob(filepath.Join(dataDir, "clientids"))
+		buf, err := h.clientIds.Get()
+		if err != nil {
+			return nil, err
+		}
+		if buf != nil {
+			if h.nextClientId, err = common.Atoi(string(buf)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return h, nil
 }
 
-func (h *hub) run() {
-	for {
-		select {
-		case c := <-h.subscribe:
-			h.clients[c] = true
-		case c := <-h.unsubscribe:
-			delete(h.clients, c)
-		case msg := <-h.broadcast:
-			for send := range h.clients {
-				send <- msg
+// newClientId returns a new client id. Requires h.mu to be held.
+func (h *hub) newClientId() (uint32, error) {
+	clientId := h.nextClientId
+	if h.clientIds != nil {
+		if err := h.clientIds.Put([]byte(common.Itoa(clientId + 1))); err != nil {
+			return 0, err
+		}
+	}
+	h.nextClientId++
+	return clientId, nil
+}
+
+// getOrCreateDoc returns the document for the given key, creating it if
+// needed. Requires h.mu to be held.
+func (h *hub) getOrCreateDoc(k docKey) (*doc, error) {
+	if d, ok := h.docs[k]; ok {
+		return d, nil
+	}
+	data, err := newDataType(h.dataDir, k)
+	if err != nil {
+		return nil, err
+	}
+	var sn common.Snapshot
+	if err := data.PopulateSnapshot(&sn); err != nil {
+		return nil, err
+	}
+	d := &doc{
+		key:         k,
+		streams:     make(map[*stream]bool),
+		data:        data,
+		lastPatchId: sn.BasePatchId,
+	}
+	h.docs[k] = d
+	return d, nil
+}
+
+// maybeCompact discards history of d that no connected client needs, if there
+// are at least h.compactInterval such patches. Requires h.mu to be held.
+func (h *hub) maybeCompact(d *doc) {
+	c, ok := d.data.(compacter)
+	if !ok || len(d.streams) == 0 {
+		return
+	}
+	minBasePatchId := ^uint32(0)
+	for s := range d.streams {
+		if s.basePatchId < minBasePatchId {
+			minBasePatchId = s.basePatchId
+		}
+	}
+	if minBasePatchId < d.compactedPatchId+h.compactInterval {
+		return
+	}
+	// Compaction only frees memory, so a failure is not fatal; we'll retry
+	// after the next update.
+	if err := c.Compact(minBasePatchId); err != nil {
+		log.Printf("compaction failed: %v", err)
+		return
+	}
+	d.compactedPatchId = minBasePatchId
+}
+
+// maybeUnloadDoc forgets d if it has no streams and its state is persisted, and
+// closes it if it holds resources, e.g. open files. The next Init for d reloads
+// it. Requires h.mu to be held.
+func (h *hub) maybeUnloadDoc(d *doc) {
+	if h.dataDir == "" || len(d.streams) > 0 || h.docs[d.key] != d {
+		return
+	}
+	delete(h.docs, d.key)
+	if c, ok := d.data.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("closing document failed: %v", err)
+		}
+	}
+}
+
+// close closes all documents that hold resources, e.g. open files.
+func (h *hub) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var firstErr error
+	for _, d := range h.docs {
+		if c, ok := d.data.(io.Closer); ok {
+			if err := c.Close(); err != nil && firstErr == nil {
+				firstErr = err
 			}
 		}
 	}
+	return firstErr
 }
 
 type stream struct {
-	h           *hub
-	conn        *websocket.Conn
-	send        chan []byte
-	initialized bool
-	isLogoot    bool
+	h    *hub
+	conn *websocket.Conn
+	done chan struct{} // closed when streamChanges exits
+	// Messages to write to conn, queued by enqueue; closed by handleConn.
+	send chan []byte
+	// Whether send overflowed, in which case conn has been closed. Guarded by
+	// hub.mu.
+	overflowed bool
+	d          *doc              // nil until initialized
+	clientId   uint32            // valid once initialized
+	meta       map[string]string // valid once initialized
+	// Latest PatchId the client is known to have received, i.e. the latest
+	// BasePatchId it has sent us. Valid once initialized; guarded by hub.mu.
+	basePatchId uint32
+}
+
+// enqueue queues msg to be written to the client, without blocking. If the
+// queue is full, it closes the connection instead, which ends the stream.
+// Requires s.h.mu to be held.
+func (s *stream) enqueue(msg []byte) {
+	if s.overflowed {
+		return
+	}
+	select {
+	case s.send <- msg:
+	default:
+		log.Printf("send queue full, closing conn")
+		s.overflowed = true
+		s.conn.Close()
+	}
 }
 
 func (s *stream) processInitMsg(msg *common.Init) error {
 	s.h.mu.Lock()
 	defer s.h.mu.Unlock()
-	if s.initialized {
-		return errors.New("already initialized")
+	if s.d != nil {
+		return newCodedError(common.CodeBadState, errors.New("already initialized"))
 	}
-	s.initialized = true
-	s.isLogoot = msg.DataType == "crdt.Logoot"
-	if !s.isLogoot {
-		assert(msg.DataType == "ot.Text")
-	}
-	sn := &common.Snapshot{
-		Type:     "Snapshot",
-		ClientId: s.h.nextClientId,
+	d, err := s.h.getOrCreateDoc(docKey{msg.DocId, msg.DataType})
+	if err != nil {
+		return err
 	}
-	if s.isLogoot {
-		s.h.logoot.PopulateSnapshot(sn)
+	// If the Init fails, don't keep d loaded on our account.
+	defer s.h.maybeUnloadDoc(d)
+	if msg.Resume {
+		if err := s.resume(d, msg); err != nil {
+			return err
+		}
+		s.clientId = msg.ClientId
+		s.basePatchId = msg.BasePatchId
 	} else {
-		s.h.text.PopulateSnapshot(sn)
+		clientId, err := s.h.newClientId()
+		if err != nil {
+			return err
+		}
+		sn := &common.Snapshot{
+			Type:          "Snapshot",
+			ClientId:      clientId,
+			Collaborators: d.collaborators(nil),
+		}
+		if err := d.data.PopulateSnapshot(sn); err != nil {
+			return err
+		}
+		s.enqueue(jsonMarshal(sn))
+		s.clientId = clientId
+		s.basePatchId = sn.BasePatchId
 	}
-	if err := s.conn.WriteJSON(sn); err != nil {
-		return err
+	s.d = d
+	s.meta = msg.Meta
+	d.streams[s] = true
+	joined := &common.Joined{
+		Type:         "Joined",
+		Collaborator: common.Collaborator{ClientId: s.clientId, Meta: s.meta},
+	}
+	d.broadcast(jsonMarshal(joined), s, nil)
+	return nil
+}
+
+// resume sends a reconnecting client the patches it missed, followed by a
+// Resumed message. Patches from the client itself are sent as Acks, since the
+// client may not have received the original Acks. A client that missed more
+// patches than fit in its send queue must resync instead. Any stream that the
+// client still has open for d, e.g. one whose connection dropped without us
+// noticing, is closed. Requires s.h.mu to be held.
+func (s *stream) resume(d *doc, msg *common.Init) error {
+	r, ok := d.data.(replayer)
+	if !ok {
+		return newCodedError(common.CodeBadInit, fmt.Errorf("cannot resume %s", msg.DataType))
+	}
+	if msg.ClientId >= s.h.nextClientId {
+		return newCodedError(common.CodeBadInit, fmt.Errorf("unknown ClientId: %d", msg.ClientId))
+	}
+	var msgs [][]byte
+	err := r.Replay(msg.BasePatchId, func(c *common.Change, a *common.Ack) {
+		if c.ClientId == msg.ClientId && a != nil {
+			a.Type = "Ack"
+			msgs = append(msgs, jsonMarshal(a))
+		} else {
+			c.Type = "Change"
+			msgs = append(msgs, jsonMarshal(c))
+		}
+	})
+	if err == common.ErrResyncRequired {
+		return newCodedError(common.CodeResyncRequired, err)
+	} else if err != nil {
+		return newCodedError(common.CodeBadInit, err)
+	}
+	if len(msgs)+1 > cap(s.send)-len(s.send) {
+		return newCodedError(common.CodeResyncRequired, fmt.Errorf("too many patches to replay: %d", len(msgs)))
+	}
+	for old := range d.streams {
+		if old.clientId == msg.ClientId {
+			d.removeStream(old)
+			old.conn.Close()
+		}
+	}
+	msgs = append(msgs, jsonMarshal(&common.Resumed{
+		Type:          "Resumed",
+		ClientId:      msg.ClientId,
+		Collaborators: d.collaborators(nil),
+	}))
+	for _, m := range msgs {
+		s.enqueue(m)
 	}
-	s.h.nextClientId++
-	go s.streamChanges()
-	s.h.subscribe <- s.send
 	return nil
 }
 
 func (s *stream) processUpdateMsg(msg *common.Update) error {
 	s.h.mu.Lock()
-	if !s.initialized {
-		s.h.mu.Unlock()
-		return errors.New("not initialized")
+	defer s.h.mu.Unlock()
+	if s.d == nil {
+		return newCodedError(common.CodeBadState, errors.New("not initialized"))
 	}
+	// Clients may only send their own updates.
+	msg.ClientId = s.clientId
 	ch := &common.Change{
 		Type:     "Change",
 		ClientId: msg.ClientId,
 	}
-	var err error
-	if s.isLogoot {
-		err = s.h.logoot.ApplyUpdate(msg, ch)
-	} else {
-		err = s.h.text.ApplyUpdate(msg, ch)
+	ack := &common.Ack{Type: "Ack"}
+	if err := s.d.data.ApplyUpdate(msg, ch, ack); err == common.ErrResyncRequired {
+		return newCodedError(common.CodeResyncRequired, err)
+	} else if err != nil {
+		return newCodedError(common.CodeBadUpdate, err)
 	}
-	s.h.mu.Unlock()
-	if err != nil {
-		return err
+	s.d.observePatchId(ch.PatchId)
+	// Broadcast while holding the lock, so that all clients observe updates in
+	// the order they were applied.
+	s.d.broadcast(jsonMarshal(ch), s, jsonMarshal(ack))
+	s.observeBasePatchId(msg.BasePatchId)
+	s.h.maybeCompact(s.d)
+	return nil
+}
+
+func (s *stream) processSelectMsg(msg *common.Select) error {
+	s.h.mu.Lock()
+	defer s.h.mu.Unlock()
+	if s.d == nil {
+		return newCodedError(common.CodeBadState, errors.New("not initialized"))
 	}
-	s.h.broadcast <- jsonMarshal(ch)
+	sr, ok := s.d.data.(selector)
+	if !ok {
+		return newCodedError(common.CodeBadMessage, errors.New("data type does not support selections"))
+	}
+	// Clients may only set their own selections.
+	msg.ClientId = s.clientId
+	sel := &common.Selection{Type: "Selection"}
+	if err := sr.SetSelection(msg, sel); err == common.ErrResyncRequired {
+		return newCodedError(common.CodeResyncRequired, err)
+	} else if err != nil {
+		return newCodedError(common.CodeBadUpdate, err)
+	}
+	s.d.broadcast(jsonMarshal(sel), s, nil)
+	s.observeBasePatchId(msg.BasePatchId)
 	return nil
 }
 
-// streamChanges streams changes to the client until the connection is closed.
+func (s *stream) processReceivedMsg(msg *common.Received) error {
+	s.h.mu.Lock()
+	defer s.h.mu.Unlock()
+	if s.d == nil {
+		return newCodedError(common.CodeBadState, errors.New("not initialized"))
+	}
+	if msg.BasePatchId > s.d.lastPatchId {
+		return newCodedError(common.CodeBadUpdate, fmt.Errorf("unknown BasePatchId: %d", msg.BasePatchId))
+	}
+	s.observeBasePatchId(msg.BasePatchId)
+	s.h.maybeCompact(s.d)
+	return nil
+}
+
+// observeBasePatchId records that the client has received all patches up to
+// basePatchId. Requires s.h.mu to be held.
+func (s *stream) observeBasePatchId(basePatchId uint32) {
+	if basePatchId > s.basePatchId {
+		s.basePatchId = basePatchId
+	}
+}
+
+// processUndoMsg processes an Undo or Redo message, using apply to create the
+// patch. Clients can only undo and redo their own patches, so apply is passed
+// the stream's ClientId.
+func (s *stream) processUndoMsg(apply func(u undoer, clientId uint32, c *common.Change) error) error {
+	s.h.mu.Lock()
+	defer s.h.mu.Unlock()
+	if s.d == nil {
+		return newCodedError(common.CodeBadState, errors.New("not initialized"))
+	}
+	u, ok := s.d.data.(undoer)
+	if !ok {
+		return newCodedError(common.CodeBadMessage, errors.New("data type does not support undo"))
+	}
+	ch := &common.Change{
+		Type:     "Change",
+		ClientId: s.clientId,
+	}
+	if err := apply(u, s.clientId, ch); err == common.ErrNothingToUndo {
+		return nil
+	} else if err != nil {
+		return newCodedError(common.CodeBadUpdate, err)
+	}
+	s.d.observePatchId(ch.PatchId)
+	// The client did not create the ops in this patch, so it gets a Change
+	// rather than an Ack.
+	s.d.broadcast(jsonMarshal(ch), nil, nil)
+	return nil
+}
+
+// processMsg processes a single message from the client. Bad client input is
+// reported as a protocol error. As a last resort, a panic, which indicates a
+// server bug, is converted to an internal error so that one bad stream cannot
+// take down the server.
+func (s *stream) processMsg(buf []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic: %v\n%s", r, debug.Stack())
+			err = newCodedError(common.CodeInternal, fmt.Errorf("panic: %v", r))
+		}
+	}()
+	badMessage := func(err error) error {
+		return newCodedError(common.CodeBadMessage, err)
+	}
+	// TODO: Avoid decoding multiple times.
+	var mt common.MsgType
+	if err := json.Unmarshal(buf, &mt); err != nil {
+		return badMessage(err)
+	}
+	switch mt.Type {
+	case "Init":
+		var msg common.Init
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return badMessage(err)
+		}
+		return s.processInitMsg(&msg)
+	case "Update":
+		var msg common.Update
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return badMessage(err)
+		}
+		return s.processUpdateMsg(&msg)
+	case "Select":
+		var msg common.Select
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return badMessage(err)
+		}
+		return s.processSelectMsg(&msg)
+	case "Received":
+		var msg common.Received
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return badMessage(err)
+		}
+		return s.processReceivedMsg(&msg)
+	case "Undo":
+		var msg common.Undo
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return badMessage(err)
+		}
+		return s.processUndoMsg(func(u undoer, clientId uint32, c *common.Change) error {
+			return u.Undo(clientId, &msg, c)
+		})
+	case "Redo":
+		var msg common.Redo
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return badMessage(err)
+		}
+		return s.processUndoMsg(func(u undoer, clientId uint32, c *common.Change) error {
+			return u.Redo(clientId, &msg, c)
+		})
+	default:
+		return badMessage(fmt.Errorf("unknown message type: %s", mt.Type))
+	}
+}
+
+// streamChanges writes messages from s.send to the client until s.send is
+// closed. After a write error, it keeps draining s.send until it is closed.
 func (s *stream) streamChanges() {
-	for {
-		err := s.conn.WriteMessage(websocket.TextMessage, <-s.send)
-		if err == websocket.ErrCloseSent {
-			break
+	defer close(s.done)
+	var err error
+	for msg := range s.send {
+		if err != nil {
+			continue
 		}
-		ok(err)
+		if err = s.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			log.Printf("write failed: %v", err)
+		}
+	}
+	if err == nil {
+		// Fails with ErrCloseSent if the client initiated the close.
+		s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	}
 }
 
 func (h *hub) handleConn(w http.ResponseWriter, r *http.Request) {
 	conn, err := websocket.Upgrade(w, r, nil, 0, 0)
-	ok(err)
-	s := &stream{h: h, conn: conn, send: make(chan []byte)}
+	if err != nil {
+		// Upgrade has already replied with an HTTP error.
+		log.Printf("upgrade failed: %v", err)
+		return
+	}
+	s := &stream{h: h, conn: conn, send: make(chan []byte, h.sendQueueSize), done: make(chan struct{})}
+	go s.streamChanges()
 
+	var procErr error
 	for {
 		_, buf, err := conn.ReadMessage()
 		if isReadFromClosedConnError(err) {
 			log.Printf("conn closed: %v", err)
 			break
+		} else if err != nil {
+			log.Printf("read failed: %v", err)
+			break
 		}
-		ok(err)
-		// TODO: Avoid decoding multiple times.
-		var mt common.MsgType
-		ok(json.Unmarshal(buf, &mt))
-		switch mt.Type {
-		case "Init":
-			var msg common.Init
-			ok(json.Unmarshal(buf, &msg))
-			ok(s.processInitMsg(&msg))
-		case "Update":
-			var msg common.Update
-			ok(json.Unmarshal(buf, &msg))
-			ok(s.processUpdateMsg(&msg))
-		default:
-			panic(fmt.Errorf("unknown message type: %s", mt.Type))
+		if procErr = s.processMsg(buf); procErr != nil {
+			log.Printf("closing stream: %v", procErr)
+			break
 		}
 	}
 
 	h.mu.Lock()
-	if s.initialized {
-		h.unsubscribe <- s.send
+	if procErr != nil {
+		// Report the error and close only this stream.
+		s.enqueue(jsonMarshal(newErrorMsg(procErr)))
+	}
+	// The stream may already have been removed, if its client resumed on another
+	// connection.
+	if s.d != nil && s.d.streams[s] {
+		s.d.removeStream(s)
+		h.maybeUnloadDoc(s.d)
 	}
 	h.mu.Unlock()
 	close(s.send)
+	<-s.done
 	conn.Close()
 }
 
-func Serve(addr string) error {
-	h := newHub()
-	go h.run()
+// Serve serves documents on the given address. If dataDir is non-empty,
+// document state is persisted under dataDir and restored on restart.
+func Serve(addr, dataDir string) error {
+	h, err := newHub(dataDir)
+	if err != nil {
+		return err
+	}
 	http.HandleFunc("/", h.handleConn)
 	go func() {
 		time.Sleep(100 * time.Millisecond)
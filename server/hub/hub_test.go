@@ -0,0 +1,1090 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/crdt"
+)
+
+func fatal(t *testing.T, v ...interface{}) {
+	debug.PrintStack()
+	t.Fatal(v...)
+}
+
+func fatalf(t *testing.T, format string, v ...interface{}) {
+	debug.PrintStack()
+	t.Fatalf(format, v...)
+}
+
+func noErr(t *testing.T, err error) {
+	if err != nil {
+		fatal(t, err)
+	}
+}
+
+func eq(t *testing.T, got, want interface{}) {
+	if !reflect.DeepEqual(got, want) {
+		fatalf(t, "got %v, want %v", got, want)
+	}
+}
+
+// startServer starts a hub and returns its websocket address. The returned
+// cleanup function stops the server without closing the hub, which simulates
+// a crash.
+func startServer(t *testing.T, dataDir string) (h *hub, addr string, cleanup func()) {
+	h, err := newHub(dataDir)
+	noErr(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(h.handleConn))
+	return h, "ws" + strings.TrimPrefix(srv.URL, "http"), srv.Close
+}
+
+func dial(t *testing.T, addr string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	noErr(t, err)
+	return conn
+}
+
+func send(t *testing.T, conn *websocket.Conn, v interface{}) {
+	noErr(t, conn.WriteJSON(v))
+}
+
+func isPresenceMsg(t *testing.T, buf []byte) bool {
+	var mt common.MsgType
+	noErr(t, json.Unmarshal(buf, &mt))
+	return mt.Type == "Joined" || mt.Type == "Left"
+}
+
+// readMsg reads the next message, skipping presence messages (Joined and
+// Left), which most tests do not care about.
+func readMsg(t *testing.T, conn *websocket.Conn, timeout time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		_, buf, err := conn.ReadMessage()
+		if err != nil || !isPresenceMsg(t, buf) {
+			return buf, err
+		}
+	}
+}
+
+func recv(t *testing.T, conn *websocket.Conn, v interface{}) {
+	buf, err := readMsg(t, conn, 5*time.Second)
+	noErr(t, err)
+	noErr(t, json.Unmarshal(buf, v))
+}
+
+// recvPresence receives the next message, which must be a presence message.
+func recvPresence(t *testing.T, conn *websocket.Conn, v interface{}) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, buf, err := conn.ReadMessage()
+	noErr(t, err)
+	if !isPresenceMsg(t, buf) {
+		fatalf(t, "unexpected message: %s", buf)
+	}
+	noErr(t, json.Unmarshal(buf, v))
+}
+
+// expectNoMsg verifies that no message other than a presence message arrives
+// on conn within a short window.
+func expectNoMsg(t *testing.T, conn *websocket.Conn) {
+	if buf, err := readMsg(t, conn, 100*time.Millisecond); err == nil {
+		fatalf(t, "unexpected message: %s", buf)
+	}
+}
+
+func initDoc(t *testing.T, addr string, docId uint32, dataType string) (*websocket.Conn, *common.Snapshot) {
+	conn := dial(t, addr)
+	send(t, conn, &common.Init{Type: "Init", DocId: docId, DataType: dataType})
+	var sn common.Snapshot
+	recv(t, conn, &sn)
+	eq(t, sn.Type, "Snapshot")
+	return conn, &sn
+}
+
+func TestDocsAreIsolated(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, _ := initDoc(t, addr, 2, "ot.Text")
+	defer b.Close()
+	c, _ := initDoc(t, addr, 1, "crdt.Logoot")
+	defer c.Close()
+
+	send(t, a, &common.Update{
+		Type:        "Update",
+		ClientId:    snA.ClientId,
+		BasePatchId: snA.BasePatchId,
+		OpStrs:      []string{"i,0,foo"},
+	})
+	var ack common.Ack
+	recv(t, a, &ack)
+	eq(t, ack.Type, "Ack")
+	expectNoMsg(t, b)
+	expectNoMsg(t, c)
+
+	// A new client of doc 1 sees the update; a new client of doc 2 does not.
+	a2, sn := initDoc(t, addr, 1, "ot.Text")
+	defer a2.Close()
+	eq(t, sn.Text, "foo")
+	b2, sn := initDoc(t, addr, 2, "ot.Text")
+	defer b2.Close()
+	eq(t, sn.Text, "")
+}
+
+func TestAck(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "ot.Text")
+	defer b.Close()
+	send(t, a, &common.Update{
+		Type:        "Update",
+		ClientId:    snA.ClientId,
+		BasePatchId: snA.BasePatchId,
+		OpStrs:      []string{"i,0,foo"},
+	})
+	send(t, b, &common.Update{
+		Type:        "Update",
+		ClientId:    snB.ClientId,
+		BasePatchId: snB.BasePatchId,
+		OpStrs:      []string{"i,0,bar"},
+	})
+
+	// Each client gets an Ack for its own update and a Change for the other's,
+	// in PatchId order.
+	for _, c := range []struct {
+		conn     *websocket.Conn
+		clientId uint32
+	}{{a, snA.ClientId}, {b, snB.ClientId}} {
+		for patchId := uint32(1); patchId <= 2; patchId++ {
+			var msg struct {
+				common.Change
+				Pids []string
+			}
+			recv(t, c.conn, &msg)
+			eq(t, msg.PatchId, patchId)
+			if msg.Type == "Ack" {
+				eq(t, msg.OpStrs, []string(nil))
+			} else {
+				eq(t, msg.Type, "Change")
+				if msg.ClientId == c.clientId {
+					fatal(t, "got Change for own update")
+				}
+			}
+		}
+		expectNoMsg(t, c.conn)
+	}
+}
+
+func TestUpdateIsAttributedToSender(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "ot.Text")
+	defer b.Close()
+	// Client b claims to be a, but the patch is still attributed to b.
+	send(t, b, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"i,0,foo"}})
+	expectPatch(t, b, "Ack", 1)
+	var c common.Change
+	recv(t, a, &c)
+	eq(t, c.Type, "Change")
+	eq(t, c.ClientId, snB.ClientId)
+	// So a's concurrent update is transformed against it rather than rejected.
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"i,0,bar"}})
+	expectPatch(t, a, "Ack", 2)
+	expectPatch(t, b, "Change", 2)
+}
+
+func TestLogootAck(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	// The Logoot data types differ only in how the server allocates pids.
+	for _, dataType := range []string{"crdt.Logoot", "crdt.LogootLSEQ"} {
+		a, snA := initDoc(t, addr, 1, dataType)
+		defer a.Close()
+		b, _ := initDoc(t, addr, 1, dataType)
+		defer b.Close()
+		send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"ci,,,ab"}})
+		var ack common.Ack
+		recv(t, a, &ack)
+		eq(t, ack.Type, "Ack")
+		var ch common.Change
+		recv(t, b, &ch)
+		eq(t, ch.OpStrs, []string{"i," + ack.Pids[0] + ",a", "i," + ack.Pids[1] + ",b"})
+	}
+}
+
+func TestDeltaText(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "ot.DeltaText")
+	defer a.Close()
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"i,foo"}})
+	var ack common.Ack
+	recv(t, a, &ack)
+	eq(t, ack.PatchId, uint32(1))
+
+	// An update parented off an older patch is transformed.
+	b, snB := initDoc(t, addr, 1, "ot.DeltaText")
+	defer b.Close()
+	eq(t, snB.Text, "foo")
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, BasePatchId: 1, OpStrs: []string{"r,3", "i,bar"}})
+	recv(t, a, &ack)
+	send(t, b, &common.Update{Type: "Update", ClientId: snB.ClientId, BasePatchId: 1, OpStrs: []string{"d,1", "r,2"}})
+	var ch common.Change
+	recv(t, b, &ch)
+	eq(t, ch.OpStrs, []string{"r,3", "i,bar"})
+	recv(t, a, &ch)
+	eq(t, ch.PatchId, uint32(3))
+	eq(t, ch.OpStrs, []string{"d,1", "r,5"})
+
+	c, sn := initDoc(t, addr, 1, "ot.DeltaText")
+	defer c.Close()
+	eq(t, sn.Text, "oobar")
+}
+
+func TestLWWRegister(t *testing.T) {
+	dataDir := t.TempDir()
+	h, addr, cleanup := startServer(t, dataDir)
+	a, snA := initDoc(t, addr, 1, "crdt.LWWRegister")
+	b, _ := initDoc(t, addr, 1, "crdt.LWWRegister")
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"cs,My doc"}})
+	var ack common.Ack
+	recv(t, a, &ack)
+	eq(t, ack.PatchId, uint32(1))
+	var ch common.Change
+	recv(t, b, &ch)
+	eq(t, len(ch.OpStrs), 1)
+	a.Close()
+	b.Close()
+	cleanup()
+	noErr(t, h.close())
+
+	// The value survives a restart.
+	h, addr, cleanup = startServer(t, dataDir)
+	defer cleanup()
+	defer h.close()
+	c, sn := initDoc(t, addr, 1, "crdt.LWWRegister")
+	defer c.Close()
+	eq(t, sn.Text, "My doc")
+	eq(t, sn.State, ch.OpStrs[0])
+	eq(t, sn.BasePatchId, uint32(1))
+}
+
+func TestPNCounter(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "crdt.PNCounter")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "crdt.PNCounter")
+	defer b.Close()
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"cp,2"}})
+	send(t, b, &common.Update{Type: "Update", ClientId: snB.ClientId, OpStrs: []string{"cn,5"}})
+	for _, conn := range []*websocket.Conn{a, b} {
+		var ack, ch common.Change
+		recv(t, conn, &ack)
+		recv(t, conn, &ch)
+	}
+	c, sn := initDoc(t, addr, 1, "crdt.PNCounter")
+	defer c.Close()
+	eq(t, sn.Text, "-3")
+	eq(t, sn.BasePatchId, uint32(2))
+}
+
+func TestORSet(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "crdt.ORSet")
+	defer a.Close()
+	b, _ := initDoc(t, addr, 1, "crdt.ORSet")
+	defer b.Close()
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"ca,x", "ca,y", "cr,x"}})
+	var ack common.Ack
+	recv(t, a, &ack)
+	var ch common.Change
+	recv(t, b, &ch)
+	dot := common.Itoa(snA.ClientId) + ".1"
+	eq(t, ch.OpStrs, []string{"a," + dot + ",x", "a," + common.Itoa(snA.ClientId) + ".2,y", "r," + dot + ",x"})
+
+	c, sn := initDoc(t, addr, 1, "crdt.ORSet")
+	defer c.Close()
+	var state struct{ Elems map[string][]string }
+	noErr(t, json.Unmarshal([]byte(sn.State), &state))
+	eq(t, len(state.Elems), 1)
+	eq(t, len(state.Elems["y"]), 1)
+}
+
+func TestGraph(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	// A graph and a text document can share a DocId.
+	text, snText := initDoc(t, addr, 1, "crdt.Logoot")
+	defer text.Close()
+	a, snA := initDoc(t, addr, 1, "crdt.Graph")
+	defer a.Close()
+	b, _ := initDoc(t, addr, 1, "crdt.Graph")
+	defer b.Close()
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"cav,box1", "cav,box2", "cae,box1,box2"}})
+	var ack common.Ack
+	recv(t, a, &ack)
+	var ch common.Change
+	recv(t, b, &ch)
+	eq(t, ch.OpStrs, []string{"av,box1", "av,box2", "ae,box1,box2"})
+	send(t, text, &common.Update{Type: "Update", ClientId: snText.ClientId, OpStrs: []string{"ci,,,x"}})
+	recv(t, text, &ack)
+	eq(t, ack.PatchId, uint32(1))
+	expectNoMsg(t, a)
+
+	c, sn := initDoc(t, addr, 1, "crdt.Graph")
+	defer c.Close()
+	eq(t, sn.State, `{"Vertices":{"box1":true,"box2":true},"Edges":{"box1,box2":true}}`)
+}
+
+func TestMVRegister(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "crdt.MVRegister")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "crdt.MVRegister")
+	defer b.Close()
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"cs,,foo"}})
+	send(t, b, &common.Update{Type: "Update", ClientId: snB.ClientId, OpStrs: []string{"cs,,bar"}})
+	var ack common.Ack
+	recv(t, a, &ack)
+	recv(t, b, &ack)
+
+	c, sn := initDoc(t, addr, 1, "crdt.MVRegister")
+	defer c.Close()
+	var state struct{ Values map[string]string }
+	noErr(t, json.Unmarshal([]byte(sn.State), &state))
+	eq(t, len(state.Values), 2)
+}
+
+func TestORMap(t *testing.T) {
+	dataDir := t.TempDir()
+	h, addr, cleanup := startServer(t, dataDir)
+
+	// A whole document syncs over one Init.
+	a, snA := initDoc(t, addr, 1, "crdt.ORMap")
+	b, _ := initDoc(t, addr, 1, "crdt.ORMap")
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"cu,title,crdt.LWWRegister,cs,foo", "cu,body,crdt.Logoot,ci,,,xy"}})
+	var ack common.Ack
+	recv(t, a, &ack)
+	eq(t, len(ack.Pids), 2)
+	var ch common.Change
+	recv(t, b, &ch)
+	eq(t, len(ch.OpStrs), 3)
+	a.Close()
+	b.Close()
+	cleanup()
+	noErr(t, h.close())
+
+	// The document survives a restart.
+	h, addr, cleanup = startServer(t, dataDir)
+	defer cleanup()
+	defer h.close()
+	c, sn := initDoc(t, addr, 1, "crdt.ORMap")
+	defer c.Close()
+	eq(t, sn.BasePatchId, uint32(1))
+	var state struct {
+		Entries map[string]struct{ Type string }
+	}
+	noErr(t, json.Unmarshal([]byte(sn.State), &state))
+	eq(t, state.Entries["title"].Type, "crdt.LWWRegister")
+	eq(t, state.Entries["body"].Type, "crdt.Logoot")
+}
+
+func TestSelection(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "ot.Text")
+	defer b.Close()
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"i,0,foobar"}})
+	expectPatch(t, a, "Ack", 1)
+	expectPatch(t, b, "Change", 1)
+
+	// Client b's selection is relative to an old patch; the server transforms
+	// it and sends it to a only.
+	send(t, b, &common.Select{Type: "Select", ClientId: snB.ClientId, BasePatchId: 0, Start: 0, End: 0})
+	var sel common.Selection
+	recv(t, a, &sel)
+	eq(t, sel, common.Selection{Type: "Selection", ClientId: snB.ClientId, PatchId: 1, Start: 6, End: 6})
+	expectNoMsg(t, b)
+
+	// A selection always belongs to the client that sent it, whatever ClientId
+	// the message claims.
+	send(t, b, &common.Select{Type: "Select", ClientId: snA.ClientId, BasePatchId: 1, Start: 0, End: 3})
+	recv(t, a, &sel)
+	eq(t, sel, common.Selection{Type: "Selection", ClientId: snB.ClientId, PatchId: 1, Start: 0, End: 3})
+
+	// New clients see existing selections in their snapshot.
+	c, sn := initDoc(t, addr, 1, "ot.Text")
+	defer c.Close()
+	eq(t, sn.Selections, []common.Selection{{ClientId: snB.ClientId, PatchId: 1, Start: 0, End: 3}})
+
+	// Selections are not supported for Logoot.
+	d, _ := initDoc(t, addr, 1, "crdt.Logoot")
+	defer d.Close()
+	send(t, d, &common.Select{Type: "Select"})
+	expectError(t, d, common.CodeBadMessage)
+}
+
+func TestUndo(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, _ := initDoc(t, addr, 1, "ot.Text")
+	defer b.Close()
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"i,0,foo"}})
+	expectPatch(t, a, "Ack", 1)
+	expectPatch(t, b, "Change", 1)
+
+	// Undo and redo patches are sent to all clients, including the sender, as
+	// Changes.
+	send(t, a, &common.Undo{Type: "Undo"})
+	want := common.Change{Type: "Change", ClientId: snA.ClientId, PatchId: 2, OpStrs: []string{"d,0,3"}}
+	for _, conn := range []*websocket.Conn{a, b} {
+		var ch common.Change
+		recv(t, conn, &ch)
+		eq(t, ch, want)
+	}
+	send(t, a, &common.Redo{Type: "Redo"})
+	want = common.Change{Type: "Change", ClientId: snA.ClientId, PatchId: 3, OpStrs: []string{"i,0,foo"}}
+	for _, conn := range []*websocket.Conn{a, b} {
+		var ch common.Change
+		recv(t, conn, &ch)
+		eq(t, ch, want)
+	}
+
+	// Redo with nothing to redo is a no-op.
+	send(t, a, &common.Redo{Type: "Redo"})
+	expectNoMsg(t, a)
+	expectNoMsg(t, b)
+
+	// Clients cannot undo other clients' patches, whatever ClientId the message
+	// claims.
+	c, _ := initDoc(t, addr, 1, "ot.Text")
+	defer c.Close()
+	send(t, c, map[string]interface{}{"Type": "Undo", "ClientId": snA.ClientId})
+	send(t, c, &common.Undo{Type: "Undo", PatchId: 3})
+	expectError(t, c, common.CodeBadUpdate)
+	d, sn := initDoc(t, addr, 1, "ot.Text")
+	defer d.Close()
+	eq(t, sn.Text, "foo")
+	eq(t, sn.BasePatchId, uint32(3))
+
+	// Undo is not supported for Logoot.
+	e, _ := initDoc(t, addr, 1, "crdt.Logoot")
+	defer e.Close()
+	send(t, e, &common.Undo{Type: "Undo"})
+	expectError(t, e, common.CodeBadMessage)
+}
+
+func TestPresence(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	initWithMeta := func(name string) (*websocket.Conn, *common.Snapshot) {
+		conn := dial(t, addr)
+		send(t, conn, &common.Init{
+			Type:     "Init",
+			DocId:    1,
+			DataType: "ot.Text",
+			Meta:     map[string]string{"name": name},
+		})
+		var sn common.Snapshot
+		recv(t, conn, &sn)
+		return conn, &sn
+	}
+	a, snA := initWithMeta("alice")
+	defer a.Close()
+	eq(t, snA.Collaborators, []common.Collaborator{})
+	b, snB := initWithMeta("bob")
+	eq(t, snB.Collaborators, []common.Collaborator{
+		{ClientId: snA.ClientId, Meta: map[string]string{"name": "alice"}},
+	})
+	var joined common.Joined
+	recvPresence(t, a, &joined)
+	eq(t, joined, common.Joined{
+		Type:         "Joined",
+		Collaborator: common.Collaborator{ClientId: snB.ClientId, Meta: map[string]string{"name": "bob"}},
+	})
+
+	// Clients of other documents are not included.
+	c, sn := initDoc(t, addr, 2, "ot.Text")
+	defer c.Close()
+	eq(t, sn.Collaborators, []common.Collaborator{})
+
+	b.Close()
+	var left common.Left
+	recvPresence(t, a, &left)
+	eq(t, left, common.Left{Type: "Left", ClientId: snB.ClientId})
+	d, sn := initDoc(t, addr, 1, "ot.Text")
+	defer d.Close()
+	eq(t, sn.Collaborators, []common.Collaborator{
+		{ClientId: snA.ClientId, Meta: map[string]string{"name": "alice"}},
+	})
+}
+
+func TestRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	_, addr, cleanup := startServer(t, dataDir)
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	send(t, a, &common.Update{
+		Type:        "Update",
+		ClientId:    snA.ClientId,
+		BasePatchId: snA.BasePatchId,
+		OpStrs:      []string{"i,0,foo"},
+	})
+	var ack common.Ack
+	recv(t, a, &ack)
+	eq(t, ack.PatchId, uint32(1))
+	b, snB := initDoc(t, addr, 1, "ot.Text")
+	eq(t, snB.BasePatchId, uint32(1))
+
+	// Kill the server mid-session.
+	a.Close()
+	b.Close()
+	cleanup()
+
+	h, addr, cleanup := startServer(t, dataDir)
+	defer cleanup()
+	defer h.close()
+	c, sn := initDoc(t, addr, 1, "ot.Text")
+	defer c.Close()
+	eq(t, sn.BasePatchId, uint32(1))
+	eq(t, sn.Text, "foo")
+
+	// Client b continues from its last acked PatchId.
+	b = dial(t, addr)
+	defer b.Close()
+	send(t, b, &common.Init{Type: "Init", DocId: 1, DataType: "ot.Text"})
+	recv(t, b, snB)
+	send(t, b, &common.Update{
+		Type:        "Update",
+		ClientId:    snB.ClientId,
+		BasePatchId: 1,
+		OpStrs:      []string{"i,3,bar"},
+	})
+	var ch common.Change
+	recv(t, c, &ch)
+	eq(t, ch.PatchId, uint32(2))
+	eq(t, ch.OpStrs, []string{"i,3,bar"})
+}
+
+// expectError verifies that the server reports an error with the given code and
+// then closes the connection.
+func expectError(t *testing.T, conn *websocket.Conn, code string) {
+	var msg common.Error
+	recv(t, conn, &msg)
+	eq(t, msg.Type, "Error")
+	eq(t, msg.Code, code)
+	if _, err := readMsg(t, conn, 5*time.Second); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		fatalf(t, "expected close, got %v", err)
+	}
+}
+
+func TestBadMessages(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	// Client a stays connected throughout.
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+
+	newUpdate := func(basePatchId uint32, opStrs ...string) *common.Update {
+		return &common.Update{Type: "Update", BasePatchId: basePatchId, OpStrs: opStrs}
+	}
+	tests := []struct {
+		dataType string // if non-empty, send Init first
+		frame    interface{}
+		code     string
+	}{
+		{"", "not json", common.CodeBadMessage},
+		{"", []string{"wrong", "shape"}, common.CodeBadMessage},
+		{"", map[string]string{"Type": "Foo"}, common.CodeBadMessage},
+		{"", map[string]interface{}{"Type": "Init", "DocId": "foo"}, common.CodeBadMessage},
+		{"", &common.Init{Type: "Init", DataType: "foo"}, common.CodeBadInit},
+		{"", newUpdate(0, "i,0,foo"), common.CodeBadState},
+		{"ot.Text", &common.Init{Type: "Init", DataType: "ot.Text"}, common.CodeBadState},
+		{"ot.Text", newUpdate(0, "x,0,foo"), common.CodeBadUpdate},
+		{"ot.Text", newUpdate(0, "d,5,10"), common.CodeBadUpdate},
+		{"ot.Text", newUpdate(0, "d,0,-1"), common.CodeBadUpdate},
+		{"ot.Text", newUpdate(100, "i,0,foo"), common.CodeBadUpdate},
+		{"ot.Text", &common.Received{Type: "Received", BasePatchId: 1}, common.CodeBadUpdate},
+		{"crdt.Logoot", newUpdate(0, "d,garbage"), common.CodeBadUpdate},
+		{"crdt.Logoot", newUpdate(0, "ci,,,a", "ci,,,b"), common.CodeBadUpdate},
+	}
+	for _, test := range tests {
+		var conn *websocket.Conn
+		if test.dataType != "" {
+			conn, _ = initDoc(t, addr, 1, test.dataType)
+		} else {
+			conn = dial(t, addr)
+		}
+		if str, ok := test.frame.(string); ok {
+			noErr(t, conn.WriteMessage(websocket.TextMessage, []byte(str)))
+		} else {
+			send(t, conn, test.frame)
+		}
+		expectError(t, conn, test.code)
+		conn.Close()
+	}
+
+	// The server is still up, and client a still works.
+	send(t, a, &common.Update{
+		Type:        "Update",
+		ClientId:    snA.ClientId,
+		BasePatchId: snA.BasePatchId,
+		OpStrs:      []string{"i,0,foo"},
+	})
+	var ack common.Ack
+	recv(t, a, &ack)
+	eq(t, ack.PatchId, uint32(1))
+	b, sn := initDoc(t, addr, 1, "ot.Text")
+	defer b.Close()
+	eq(t, sn.Text, "foo")
+}
+
+func TestRawLogootOpsAreRejected(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+	a, _ := initDoc(t, addr, 1, "crdt.Logoot")
+	defer a.Close()
+	send(t, a, &common.Update{Type: "Update", OpStrs: []string{"ci,,,a"}})
+	var ack common.Ack
+	recv(t, a, &ack)
+	p := ack.Pids[0]
+	// Clients may only send "ci" and "cd" ops. An update with pids, e.g. one that
+	// inserts a different value at an existing pid, is a bad update, not an
+	// internal error.
+	send(t, a, &common.Update{Type: "Update", OpStrs: []string{"i," + p + ",b"}})
+	expectError(t, a, common.CodeBadUpdate)
+
+	// The document is unchanged and still usable.
+	b, sn := initDoc(t, addr, 1, "crdt.Logoot")
+	defer b.Close()
+	eq(t, sn.Text, "a")
+	eq(t, sn.BasePatchId, uint32(1))
+	send(t, b, &common.Update{Type: "Update", ClientId: sn.ClientId, OpStrs: []string{"ci," + p + ",,b"}})
+	recv(t, b, &ack)
+	eq(t, ack.PatchId, uint32(2))
+	c, sn := initDoc(t, addr, 1, "crdt.Logoot")
+	defer c.Close()
+	eq(t, sn.Text, "ab")
+}
+
+func resume(t *testing.T, addr string, docId uint32, dataType string, clientId, basePatchId uint32) *websocket.Conn {
+	conn := dial(t, addr)
+	send(t, conn, &common.Init{
+		Type:        "Init",
+		DocId:       docId,
+		DataType:    dataType,
+		Resume:      true,
+		ClientId:    clientId,
+		BasePatchId: basePatchId,
+	})
+	return conn
+}
+
+// expectPatch receives an Ack or Change and checks its Type and PatchId.
+func expectPatch(t *testing.T, conn *websocket.Conn, typ string, patchId uint32) {
+	var msg common.Change
+	recv(t, conn, &msg)
+	eq(t, msg.Type, typ)
+	eq(t, msg.PatchId, patchId)
+}
+
+func TestResume(t *testing.T) {
+	_, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "ot.Text")
+	update := func(conn *websocket.Conn, clientId, basePatchId uint32, opStrs ...string) {
+		send(t, conn, &common.Update{
+			Type:        "Update",
+			ClientId:    clientId,
+			BasePatchId: basePatchId,
+			OpStrs:      opStrs,
+		})
+	}
+
+	update(a, snA.ClientId, 0, "i,0,foo")
+	expectPatch(t, a, "Ack", 1)
+	// Client b's connection drops after the server applies its update, but
+	// before b sees the Ack.
+	update(b, snB.ClientId, 0, "i,0,bar")
+	expectPatch(t, a, "Change", 2)
+	b.Close()
+	update(a, snA.ClientId, 2, "i,0,baz")
+	expectPatch(t, a, "Ack", 3)
+
+	// Client b resumes, and the server replays the patches it missed.
+	b = resume(t, addr, 1, "ot.Text", snB.ClientId, 0)
+	defer b.Close()
+	expectPatch(t, b, "Change", 1)
+	expectPatch(t, b, "Ack", 2)
+	expectPatch(t, b, "Change", 3)
+	var rs common.Resumed
+	recv(t, b, &rs)
+	eq(t, rs, common.Resumed{
+		Type:          "Resumed",
+		ClientId:      snB.ClientId,
+		Collaborators: []common.Collaborator{{ClientId: snA.ClientId}},
+	})
+
+	// Client b continues with its buffered ops.
+	update(b, snB.ClientId, 3, "i,9,!")
+	expectPatch(t, b, "Ack", 4)
+	var ch common.Change
+	recv(t, a, &ch)
+	eq(t, ch.ClientId, snB.ClientId)
+	eq(t, ch.OpStrs, []string{"i,9,!"})
+
+	// Resuming with an unknown ClientId fails.
+	c := resume(t, addr, 1, "ot.Text", 100, 0)
+	defer c.Close()
+	expectError(t, c, common.CodeBadInit)
+}
+
+func TestResumeClosesOldStream(t *testing.T) {
+	h, addr, cleanup := startServer(t, "")
+	defer cleanup()
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "ot.Text")
+	defer b.Close()
+	var joined common.Joined
+	recvPresence(t, a, &joined)
+
+	// Client b resumes on a new connection while the server still considers its
+	// old connection live. The old stream is closed, so b is listed only once.
+	b2 := resume(t, addr, 1, "ot.Text", snB.ClientId, 0)
+	defer b2.Close()
+	var rs common.Resumed
+	recv(t, b2, &rs)
+	eq(t, rs.Collaborators, []common.Collaborator{{ClientId: snA.ClientId}})
+	var left common.Left
+	recvPresence(t, a, &left)
+	eq(t, left.ClientId, snB.ClientId)
+	recvPresence(t, a, &joined)
+	eq(t, joined.Collaborator.ClientId, snB.ClientId)
+	if _, err := readMsg(t, b, 5*time.Second); err == nil {
+		fatal(t, "old stream should have been closed")
+	}
+
+	// The old stream's disconnect does not make b leave.
+	expectNoMsg(t, a)
+	h.mu.Lock()
+	eq(t, len(h.docs[docKey{1, "ot.Text"}].streams), 2)
+	h.mu.Unlock()
+	c, sn := initDoc(t, addr, 1, "ot.Text")
+	defer c.Close()
+	eq(t, sn.Collaborators, []common.Collaborator{{ClientId: snA.ClientId}, {ClientId: snB.ClientId}})
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	h, addr, cleanup := startServer(t, dataDir)
+	a, snA := initDoc(t, addr, 1, "crdt.Logoot")
+	send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"ci,,,foo"}})
+	expectPatch(t, a, "Ack", 1)
+	a.Close()
+	cleanup()
+	h.close()
+
+	// The op log survives the restart, so a can resume.
+	h, addr, cleanup = startServer(t, dataDir)
+	a = resume(t, addr, 1, "crdt.Logoot", snA.ClientId, 0)
+	expectPatch(t, a, "Ack", 1)
+	var rs common.Resumed
+	recv(t, a, &rs)
+	a.Close()
+	// New clients get fresh ClientIds.
+	b, snB := initDoc(t, addr, 1, "crdt.Logoot")
+	if snB.ClientId <= snA.ClientId {
+		fatalf(t, "ClientId reused: %d", snB.ClientId)
+	}
+	// Fold the history into a snapshot, then restart again. Client b keeps the
+	// document loaded.
+	h.mu.Lock()
+	noErr(t, h.docs[docKey{1, "crdt.Logoot"}].data.(*crdt.Logoot).Checkpoint())
+	h.mu.Unlock()
+	b.Close()
+	cleanup()
+	h.close()
+
+	h, addr, cleanup = startServer(t, dataDir)
+	defer cleanup()
+	defer h.close()
+	a = resume(t, addr, 1, "crdt.Logoot", snA.ClientId, 0)
+	defer a.Close()
+	expectError(t, a, common.CodeResyncRequired)
+	a = resume(t, addr, 1, "crdt.Logoot", snA.ClientId, 1)
+	defer a.Close()
+	recv(t, a, &rs)
+	eq(t, rs.Type, "Resumed")
+}
+
+func TestIdleDocIsUnloaded(t *testing.T) {
+	h, addr, cleanup := startServer(t, t.TempDir())
+	defer cleanup()
+	defer h.close()
+	numDocs := func() int {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.docs)
+	}
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	send(t, a, &common.Update{
+		Type:        "Update",
+		ClientId:    snA.ClientId,
+		BasePatchId: snA.BasePatchId,
+		OpStrs:      []string{"i,0,foo"},
+	})
+	expectPatch(t, a, "Ack", 1)
+	b, _ := initDoc(t, addr, 2, "ot.Text")
+	defer b.Close()
+	eq(t, numDocs(), 2)
+
+	// Once its last client leaves, the document is closed and forgotten.
+	a.Close()
+	for i := 0; numDocs() != 1; i++ {
+		if i > 500 {
+			fatal(t, "document was not unloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The next client reloads it, and a failed Init does not keep it loaded.
+	c, sn := initDoc(t, addr, 1, "ot.Text")
+	eq(t, sn.BasePatchId, uint32(1))
+	eq(t, sn.Text, "foo")
+	c.Close()
+	a = resume(t, addr, 3, "ot.Text", snA.ClientId, 5)
+	defer a.Close()
+	expectError(t, a, common.CodeBadInit)
+	for i := 0; numDocs() != 1; i++ {
+		if i > 500 {
+			fatal(t, "document was not unloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	h, addr, cleanup := startServer(t, "")
+	defer cleanup()
+	h.compactInterval = 2
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "ot.Text")
+	update := func(basePatchId uint32) {
+		send(t, a, &common.Update{
+			Type:        "Update",
+			ClientId:    snA.ClientId,
+			BasePatchId: basePatchId,
+			OpStrs:      []string{"i,0,x"},
+		})
+	}
+	compactedPatchId := func() uint32 {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.docs[docKey{1, "ot.Text"}].compactedPatchId
+	}
+	for i := uint32(0); i < 3; i++ {
+		update(i)
+		expectPatch(t, a, "Ack", i+1)
+		expectPatch(t, b, "Change", i+1)
+	}
+	// Client b has not reported receiving any patches, so nothing has been
+	// discarded.
+	eq(t, compactedPatchId(), uint32(0))
+	b.Close()
+	var left common.Left
+	recvPresence(t, a, &left)
+	eq(t, left.ClientId, snB.ClientId)
+	b = resume(t, addr, 1, "ot.Text", snB.ClientId, 0)
+	for i := uint32(0); i < 3; i++ {
+		expectPatch(t, b, "Change", i+1)
+	}
+	var rs common.Resumed
+	recv(t, b, &rs)
+	var joined common.Joined
+	recvPresence(t, a, &joined)
+	eq(t, joined.Type, "Joined")
+	b.Close()
+	recvPresence(t, a, &left)
+	eq(t, left.Type, "Left")
+
+	// Once b, which never sends updates, reports receiving all patches, patches
+	// up to a's base are discarded.
+	b = resume(t, addr, 1, "ot.Text", snB.ClientId, 0)
+	for i := uint32(0); i < 3; i++ {
+		expectPatch(t, b, "Change", i+1)
+	}
+	recv(t, b, &rs)
+	recvPresence(t, a, &joined)
+	send(t, b, &common.Received{Type: "Received", BasePatchId: 3})
+	for i := 0; compactedPatchId() != 2; i++ {
+		if i > 1000 {
+			fatal(t, "history was not compacted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Close()
+	recvPresence(t, a, &left)
+
+	// Now a is the only client, so patches up to its base are discarded.
+	update(3)
+	expectPatch(t, a, "Ack", 4)
+	update(4)
+	expectPatch(t, a, "Ack", 5)
+	eq(t, compactedPatchId(), uint32(4))
+	b = resume(t, addr, 1, "ot.Text", snB.ClientId, 3)
+	defer b.Close()
+	expectError(t, b, common.CodeResyncRequired)
+	c := resume(t, addr, 1, "ot.Text", snB.ClientId, 4)
+	defer c.Close()
+	expectPatch(t, c, "Change", 5)
+	recv(t, c, &rs)
+	eq(t, rs.Type, "Resumed")
+
+	// Updates based on discarded patches are rejected.
+	update(2)
+	expectError(t, a, common.CodeResyncRequired)
+}
+
+func TestResumeAfterCompactionAndRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	h, addr, cleanup := startServer(t, dataDir)
+	h.compactInterval = 2
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	for i := uint32(0); i < 3; i++ {
+		send(t, a, &common.Update{
+			Type:        "Update",
+			ClientId:    snA.ClientId,
+			BasePatchId: i,
+			OpStrs:      []string{"i,0,x"},
+		})
+		expectPatch(t, a, "Ack", i+1)
+	}
+	h.mu.Lock()
+	eq(t, h.docs[docKey{1, "ot.Text"}].compactedPatchId, uint32(2))
+	h.mu.Unlock()
+	a.Close()
+	cleanup()
+	h.close()
+
+	// Patches after the compacted one survive the restart, so a can resume from
+	// its last base.
+	h, addr, cleanup = startServer(t, dataDir)
+	defer cleanup()
+	defer h.close()
+	a = resume(t, addr, 1, "ot.Text", snA.ClientId, 1)
+	defer a.Close()
+	expectError(t, a, common.CodeResyncRequired)
+	a = resume(t, addr, 1, "ot.Text", snA.ClientId, 2)
+	defer a.Close()
+	expectPatch(t, a, "Ack", 3)
+	var rs common.Resumed
+	recv(t, a, &rs)
+	eq(t, rs.Type, "Resumed")
+}
+
+func TestUnknownDataType(t *testing.T) {
+	h, err := newHub("")
+	noErr(t, err)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.getOrCreateDoc(docKey{0, "foo"}); err == nil {
+		fatal(t, "expected error")
+	}
+}
+
+func TestSlowClientIsDisconnected(t *testing.T) {
+	h, addr, cleanup := startServer(t, "")
+	defer cleanup()
+	h.sendQueueSize = 4
+
+	a, snA := initDoc(t, addr, 1, "crdt.LWWRegister")
+	defer a.Close()
+	// Client b never reads, so once the socket buffers fill up, its send queue
+	// overflows.
+	b, _ := initDoc(t, addr, 1, "crdt.LWWRegister")
+	defer b.Close()
+	numStreams := func() int {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.docs[docKey{1, "crdt.LWWRegister"}].streams)
+	}
+	value := strings.Repeat("x", 1<<16)
+	var ack common.Ack
+	for i := uint32(1); numStreams() == 2; i++ {
+		if i > 10000 {
+			fatal(t, "client b was not disconnected")
+		}
+		// Client a is not stalled by client b.
+		send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, OpStrs: []string{"cs," + value}})
+		recv(t, a, &ack)
+		eq(t, ack.PatchId, i)
+	}
+}
+
+func TestResumeTooFarBehind(t *testing.T) {
+	h, addr, cleanup := startServer(t, "")
+	defer cleanup()
+	h.sendQueueSize = 4
+
+	a, snA := initDoc(t, addr, 1, "ot.Text")
+	defer a.Close()
+	b, snB := initDoc(t, addr, 1, "ot.Text")
+	b.Close()
+	for i := uint32(0); i < 4; i++ {
+		send(t, a, &common.Update{Type: "Update", ClientId: snA.ClientId, BasePatchId: i, OpStrs: []string{"i,0,x"}})
+		expectPatch(t, a, "Ack", i+1)
+	}
+	// The 4 patches plus the Resumed message do not fit in the send queue.
+	b = resume(t, addr, 1, "ot.Text", snB.ClientId, 0)
+	defer b.Close()
+	expectError(t, b, common.CodeResyncRequired)
+	c := resume(t, addr, 1, "ot.Text", snB.ClientId, 1)
+	defer c.Close()
+	for i := uint32(2); i <= 4; i++ {
+		expectPatch(t, c, "Change", i)
+	}
+	var rs common.Resumed
+	recv(t, c, &rs)
+	eq(t, rs.Type, "Resumed")
+}
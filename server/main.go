@@ -8,12 +8,15 @@ import (
 	"github.com/asadovsky/goatee/server/hub"
 )
 
-var port = flag.Int("port", 0, "")
+var (
+	port    = flag.Int("port", 0, "")
+	dataDir = flag.String("data_dir", "", "if set, directory for persisted documents")
+)
 
 func main() {
 	flag.Parse()
 	addr := fmt.Sprintf("localhost:%d", *port)
-	if err := hub.Serve(addr); err != nil {
+	if err := hub.Serve(addr, *dataDir); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,119 @@
+package ot
+
+import (
+	"fmt"
+)
+
+// Compose returns a minimal patch equivalent to applying patch a and then patch
+// b, where the ops in each patch are applied sequentially. Adjacent and
+// overlapping inserts and deletes are merged, and text inserted by a and
+// deleted by b is dropped. Compose(ops, nil) normalizes ops.
+//
+// The result has at most one Delete followed by at most one Insert per edited
+// region, ordered by position. The ops must be valid, i.e. applying them must
+// not fail; in particular, Compose panics if an op splits a surrogate pair
+// within inserted text.
+func Compose(a, b []Op) []Op {
+	var d sparseDelta
+	for _, ops := range [][]Op{a, b} {
+		for _, op := range ops {
+			switch v := op.(type) {
+			case *Insert:
+				d.insert(v.Pos, v.Value)
+			case *Delete:
+				d.delete(v.Pos, v.Len)
+			default:
+				panic(fmt.Sprintf("unexpected op type: %T", v))
+			}
+		}
+	}
+	return d.ops()
+}
+
+// sparseDelta is like a Delta, except that text past the last component is
+// retained, so that it can describe positional ops without knowing the length
+// of the string they apply to.
+type sparseDelta []Component
+
+// boundary returns the index of the first component that produces text at or
+// after position pos of the result, splitting or appending components as
+// needed so that the components before it produce exactly pos code units.
+func (d *sparseDelta) boundary(pos int) int {
+	out := 0
+	for i := range *d {
+		if out == pos {
+			return i
+		}
+		c := &(*d)[i]
+		if w := c.width(); pos >= out+w {
+			out += w
+			continue
+		}
+		lo, hi, err := c.split(pos - out)
+		assert(err == nil, err)
+		*d = append(*d, Component{})
+		copy((*d)[i+2:], (*d)[i+1:])
+		(*d)[i], (*d)[i+1] = lo, hi
+		return i + 1
+	}
+	if pos > out {
+		*d = append(*d, Component{RetainComponent, pos - out, ""})
+	}
+	return len(*d)
+}
+
+func (d *sparseDelta) insert(pos int, value string) {
+	i := d.boundary(pos)
+	*d = append(*d, Component{})
+	copy((*d)[i+1:], (*d)[i:])
+	(*d)[i] = Component{InsertComponent, utf16Len(value), value}
+}
+
+func (d *sparseDelta) delete(pos, n int) {
+	i := d.boundary(pos)
+	j := d.boundary(pos + n)
+	// Deleting retained text deletes it from the original string, while deleting
+	// inserted text cancels the insert.
+	res := append(sparseDelta(nil), (*d)[:i]...)
+	for _, c := range (*d)[i:j] {
+		switch c.Type {
+		case RetainComponent:
+			res = append(res, Component{DeleteComponent, c.N, ""})
+		case DeleteComponent:
+			res = append(res, c)
+		}
+	}
+	*d = append(res, (*d)[j:]...)
+}
+
+// ops returns the ops that perform d. Between retained regions, deletes and
+// inserts commute, so each region becomes one Delete followed by one Insert.
+func (d sparseDelta) ops() []Op {
+	var res []Op
+	pos, del, ins := 0, 0, ""
+	flush := func() {
+		if del > 0 {
+			res = append(res, &Delete{pos, del})
+		}
+		if ins != "" {
+			res = append(res, &Insert{pos, ins})
+			pos += utf16Len(ins)
+		}
+		del, ins = 0, ""
+	}
+	for _, c := range d {
+		switch c.Type {
+		case RetainComponent:
+			if c.N > 0 {
+				flush()
+				pos += c.N
+			}
+		case InsertComponent:
+			ins += c.Value
+		case DeleteComponent:
+			del += c.N
+		}
+	}
+	flush()
+	return res
+}
@@ -0,0 +1,133 @@
+package ot_test
+
+import (
+	"math/rand"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/asadovsky/goatee/server/ot"
+)
+
+func decodeOps(t *testing.T, opStrs ...string) []ot.Op {
+	ops, err := ot.DecodeOps(opStrs)
+	ok(t, err)
+	return ops
+}
+
+func applyOps(t *testing.T, s string, ops []ot.Op) string {
+	for _, op := range ops {
+		var err error
+		s, err = op.Apply(s)
+		ok(t, err)
+	}
+	return s
+}
+
+func TestCompose(t *testing.T) {
+	for _, c := range []struct {
+		a, b, want []string
+	}{
+		{nil, nil, nil},
+		// Typing.
+		{[]string{"i,0,f", "i,1,o"}, []string{"i,2,o"}, []string{"i,0,foo"}},
+		// Typing in the middle, with backspace.
+		{[]string{"i,3,x", "i,4,y", "d,4,1"}, []string{"i,4,z"}, []string{"i,3,xz"}},
+		// Text inserted and then deleted is dropped.
+		{[]string{"i,1,abc"}, []string{"d,0,5"}, []string{"d,0,2"}},
+		{[]string{"i,1,abc"}, []string{"d,1,3"}, nil},
+		// Adjacent deletes are merged.
+		{[]string{"d,3,1", "d,2,1"}, []string{"d,2,2"}, []string{"d,2,4"}},
+		// Deletes and inserts in the same region become one Delete and one Insert.
+		{[]string{"i,2,x", "d,3,2"}, []string{"d,0,1", "i,1,y"}, []string{"d,0,1", "d,1,2", "i,1,yx"}},
+		// Separate regions stay separate, in order.
+		{[]string{"i,5,b"}, []string{"i,0,a"}, []string{"i,0,a", "i,6,b"}},
+		// Empty ops are dropped.
+		{[]string{"i,3,", "d,2,0"}, nil, nil},
+		// Positions are in UTF-16 code units.
+		{[]string{"i,0,😀"}, []string{"i,2,!", "d,0,2"}, []string{"i,0,!"}},
+	} {
+		got := ot.EncodeOps(ot.Compose(decodeOps(t, c.a...), decodeOps(t, c.b...)))
+		if len(got) == 0 {
+			got = nil
+		}
+		eq(t, got, c.want)
+	}
+}
+
+// runeBoundaries returns the positions in s, in UTF-16 code units, that do not
+// split a surrogate pair.
+func runeBoundaries(s string) []int {
+	res := []int{0}
+	for _, r := range s {
+		res = append(res, res[len(res)-1]+len(utf16.Encode([]rune{r})))
+	}
+	return res
+}
+
+// randOps returns a random sequence of valid ops for s.
+func randOps(rng *rand.Rand, s string) []ot.Op {
+	values := []string{"a", "bc", "中文", "😀", "x😀y"}
+	ops := make([]ot.Op, rng.Intn(6))
+	for i := range ops {
+		b := runeBoundaries(s)
+		if rng.Intn(2) == 0 {
+			ops[i] = &ot.Insert{Pos: b[rng.Intn(len(b))], Value: values[rng.Intn(len(values))]}
+		} else {
+			j := rng.Intn(len(b))
+			k := j + rng.Intn(minInt(len(b)-j, 4))
+			ops[i] = &ot.Delete{Pos: b[j], Len: b[k] - b[j]}
+		}
+		var err error
+		if s, err = ops[i].Apply(s); err != nil {
+			panic(err)
+		}
+	}
+	return ops
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// TestComposeRandom checks that applying Compose(a, b) is equivalent to
+// applying a and then b, and that composed patches are already normalized.
+func TestComposeRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		s := []string{"", "hello", "中文😀é"}[rng.Intn(3)]
+		a := randOps(rng, s)
+		b := randOps(rng, applyOps(t, s, a))
+		c := ot.Compose(a, b)
+		eq(t, applyOps(t, s, c), applyOps(t, applyOps(t, s, a), b))
+		if len(c) > len(a)+len(b) {
+			fatalf(t, "Compose(%v, %v) = %v is longer than its inputs", ot.EncodeOps(a), ot.EncodeOps(b), ot.EncodeOps(c))
+		}
+		eq(t, ot.EncodeOps(ot.Compose(c, nil)), ot.EncodeOps(c))
+	}
+}
+
+// checkConvergence checks that a client that applied own and then receives
+// concurrent, which the server applied first, ends up with the server's text.
+// Like the JS client, the client sends own composed, and transforms the Change
+// for concurrent against exactly the ops it sent.
+func checkConvergence(t *testing.T, base string, own, concurrent []ot.Op) {
+	sent := ot.Compose(own, nil)
+	server := ot.NewText(base)
+	c := applyUpdate(t, server, 2, 0, ot.EncodeOps(concurrent)...)
+	applyUpdate(t, server, 1, 0, ot.EncodeOps(sent)...)
+	_, ops := ot.TransformPatch(sent, decodeOps(t, c.OpStrs...))
+	eq(t, applyOps(t, applyOps(t, base, sent), ops), server.Value())
+}
+
+func TestComposedUpdateConverges(t *testing.T) {
+	// Transforming "i,2,Y" against the uncomposed ops would give "axYc".
+	checkConvergence(t, "abc", decodeOps(t, "i,1,x", "d,2,1"), decodeOps(t, "i,2,Y"))
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		s := []string{"", "hello", "中文😀é"}[rng.Intn(3)]
+		checkConvergence(t, s, randOps(rng, s), randOps(rng, s))
+	}
+}
@@ -0,0 +1,327 @@
+package ot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Delta is a change to a string, described as a traversal of the whole string:
+// a sequence of components that each retain, insert, or delete text. Unlike a
+// list of positional Ops, a Delta says what happens to every code unit of the
+// string, so TransformDeltas and Compose take time linear in the number of
+// components. This is the model used by ot.js and similar editors.
+//
+// Lengths are in UTF-16 code units, and components may not split a surrogate
+// pair. Build Deltas with Retain, Insert and Delete, which keep them in
+// canonical form: no empty components, adjacent components of the same type
+// merged, and inserts before deletes where the two are adjacent.
+type Delta []Component
+
+// ComponentType is the type of a Delta component.
+type ComponentType int
+
+const (
+	RetainComponent ComponentType = iota
+	InsertComponent
+	DeleteComponent
+)
+
+// Component is a Delta component.
+type Component struct {
+	Type  ComponentType
+	N     int    // length in UTF-16 code units
+	Value string // inserted text, for InsertComponent
+}
+
+// width returns the length of the text produced by c, in UTF-16 code units.
+func (c *Component) width() int {
+	if c.Type == DeleteComponent {
+		return 0
+	}
+	return c.N
+}
+
+// split splits c into its first n code units and the rest.
+func (c *Component) split(n int) (Component, Component, error) {
+	if c.Type != InsertComponent {
+		return Component{c.Type, n, ""}, Component{c.Type, c.N - n, ""}, nil
+	}
+	i, err := byteOffset(c.Value, n)
+	if err != nil {
+		return Component{}, Component{}, err
+	}
+	return Component{c.Type, n, c.Value[:i]}, Component{c.Type, c.N - n, c.Value[i:]}, nil
+}
+
+// Retain appends a component that retains n code units.
+func (d *Delta) Retain(n int) {
+	d.append(Component{RetainComponent, n, ""})
+}
+
+// Insert appends a component that inserts s.
+func (d *Delta) Insert(s string) {
+	d.append(Component{InsertComponent, utf16Len(s), s})
+}
+
+// Delete appends a component that deletes n code units.
+func (d *Delta) Delete(n int) {
+	d.append(Component{DeleteComponent, n, ""})
+}
+
+func (d *Delta) append(c Component) {
+	if c.N == 0 {
+		return
+	}
+	k := len(*d)
+	if c.Type == InsertComponent && k > 0 && (*d)[k-1].Type == DeleteComponent {
+		// Deletes and adjacent inserts commute, so put the insert first.
+		del := (*d)[k-1]
+		*d = (*d)[:k-1]
+		d.append(c)
+		*d = append(*d, del)
+		return
+	}
+	if k > 0 && (*d)[k-1].Type == c.Type {
+		last := &(*d)[k-1]
+		last.N += c.N
+		last.Value += c.Value
+		return
+	}
+	*d = append(*d, c)
+}
+
+// BaseLen returns the length of the strings to which d applies.
+func (d Delta) BaseLen() int {
+	n := 0
+	for _, c := range d {
+		if c.Type != InsertComponent {
+			n += c.N
+		}
+	}
+	return n
+}
+
+// TargetLen returns the length of the strings that d produces.
+func (d Delta) TargetLen() int {
+	n := 0
+	for _, c := range d {
+		n += c.width()
+	}
+	return n
+}
+
+// Encode returns the encoded components of d: "r,<n>", "i,<text>" or "d,<n>".
+func (d Delta) Encode() []string {
+	strs := make([]string, len(d))
+	for i, c := range d {
+		switch c.Type {
+		case RetainComponent:
+			strs[i] = fmt.Sprintf("r,%d", c.N)
+		case InsertComponent:
+			strs[i] = "i," + c.Value
+		case DeleteComponent:
+			strs[i] = fmt.Sprintf("d,%d", c.N)
+		}
+	}
+	return strs
+}
+
+// DecodeDelta returns the Delta with the given encoded components. The result
+// is in canonical form.
+func DecodeDelta(strs []string) (Delta, error) {
+	var d Delta
+	for _, s := range strs {
+		parts := strings.SplitN(s, ",", 2)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("failed to parse component: %s", s)
+		}
+		if parts[0] == "i" {
+			if parts[1] == "" || !utf8.ValidString(parts[1]) {
+				return nil, fmt.Errorf("invalid insert: %q", parts[1])
+			}
+			d.Insert(parts[1])
+			continue
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, err
+		} else if n <= 0 {
+			return nil, fmt.Errorf("invalid length: %s", s)
+		}
+		switch parts[0] {
+		case "r":
+			d.Retain(n)
+		case "d":
+			d.Delete(n)
+		default:
+			return nil, fmt.Errorf("unknown component type: %s", parts[0])
+		}
+	}
+	return d, nil
+}
+
+var errLengthMismatch = errors.New("delta length mismatch")
+
+// Apply returns the result of applying d to s.
+func (d Delta) Apply(s string) (string, error) {
+	if d.BaseLen() != utf16Len(s) {
+		return "", errLengthMismatch
+	}
+	var b strings.Builder
+	for _, c := range d {
+		if c.Type == InsertComponent {
+			b.WriteString(c.Value)
+			continue
+		}
+		i, err := byteOffset(s, c.N)
+		if err != nil {
+			return "", err
+		}
+		if c.Type == RetainComponent {
+			b.WriteString(s[:i])
+		}
+		s = s[i:]
+	}
+	return b.String(), nil
+}
+
+// Invert returns a Delta that undoes d, given the string s to which d applies.
+func (d Delta) Invert(s string) Delta {
+	var res Delta
+	for _, c := range d {
+		switch c.Type {
+		case RetainComponent, DeleteComponent:
+			i, err := byteOffset(s, c.N)
+			assert(err == nil, err)
+			if c.Type == RetainComponent {
+				res.Retain(c.N)
+			} else {
+				res.Insert(s[:i])
+			}
+			s = s[i:]
+		case InsertComponent:
+			res.Delete(c.N)
+		}
+	}
+	return res
+}
+
+// Compose returns a Delta equivalent to applying d and then e.
+func (d Delta) Compose(e Delta) (Delta, error) {
+	if d.TargetLen() != e.BaseLen() {
+		return nil, errLengthMismatch
+	}
+	var res Delta
+	a, b := &deltaIter{d: d}, &deltaIter{d: e}
+	for !a.done() || !b.done() {
+		if !a.done() && a.peek() == DeleteComponent {
+			res.Delete(a.next(-1).N)
+			continue
+		} else if !b.done() && b.peek() == InsertComponent {
+			res.Insert(b.next(-1).Value)
+			continue
+		}
+		n := minInt(a.remaining(), b.remaining())
+		ca, cb := a.next(n), b.next(n)
+		switch {
+		case ca.Type == RetainComponent && cb.Type == RetainComponent:
+			res.Retain(n)
+		case ca.Type == RetainComponent && cb.Type == DeleteComponent:
+			res.Delete(n)
+		case ca.Type == InsertComponent && cb.Type == RetainComponent:
+			res.Insert(ca.Value)
+		}
+		// An insert from d that is deleted by e cancels out.
+	}
+	if a.err != nil {
+		return nil, a.err
+	}
+	return res, nil
+}
+
+// TransformDeltas transforms a and b, which apply to the same string, and
+// returns a' and b' such that applying a then b' is equivalent to applying b
+// then a'. Where both insert at the same position, a's text comes first.
+func TransformDeltas(a, b Delta) (ap, bp Delta, err error) {
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, errLengthMismatch
+	}
+	ia, ib := &deltaIter{d: a}, &deltaIter{d: b}
+	for !ia.done() || !ib.done() {
+		if !ia.done() && ia.peek() == InsertComponent {
+			c := ia.next(-1)
+			ap.Insert(c.Value)
+			bp.Retain(c.N)
+			continue
+		} else if !ib.done() && ib.peek() == InsertComponent {
+			c := ib.next(-1)
+			ap.Retain(c.N)
+			bp.Insert(c.Value)
+			continue
+		}
+		n := minInt(ia.remaining(), ib.remaining())
+		ca, cb := ia.next(n), ib.next(n)
+		switch {
+		case ca.Type == RetainComponent && cb.Type == RetainComponent:
+			ap.Retain(n)
+			bp.Retain(n)
+		case ca.Type == DeleteComponent && cb.Type == RetainComponent:
+			ap.Delete(n)
+		case ca.Type == RetainComponent && cb.Type == DeleteComponent:
+			bp.Delete(n)
+		}
+		// Text deleted by both is simply gone.
+	}
+	return ap, bp, nil
+}
+
+// deltaIter iterates over the components of a Delta, which may be consumed in
+// parts.
+type deltaIter struct {
+	d   Delta
+	i   int
+	off int   // code units of d[i] already consumed
+	err error // set if an insert was split within a surrogate pair
+}
+
+func (it *deltaIter) done() bool {
+	return it.i == len(it.d)
+}
+
+func (it *deltaIter) peek() ComponentType {
+	return it.d[it.i].Type
+}
+
+func (it *deltaIter) remaining() int {
+	return it.d[it.i].N - it.off
+}
+
+// next consumes and returns up to n code units of the current component, or
+// all of them if n is negative.
+func (it *deltaIter) next(n int) Component {
+	c := it.d[it.i]
+	if rest := c.N - it.off; n < 0 || n > rest {
+		n = rest
+	}
+	res := Component{c.Type, n, ""}
+	if c.Type == InsertComponent {
+		i, err := byteOffset(c.Value, it.off)
+		j := 0
+		if err == nil {
+			j, err = byteOffset(c.Value[i:], n)
+		}
+		if err == nil {
+			res.Value = c.Value[i : i+j]
+		} else if it.err == nil {
+			it.err = err
+		}
+	}
+	it.off += n
+	if it.off == c.N {
+		it.i, it.off = it.i+1, 0
+	}
+	return res
+}
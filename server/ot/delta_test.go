@@ -0,0 +1,192 @@
+package ot_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/ot"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+func decodeDelta(t *testing.T, strs ...string) ot.Delta {
+	d, err := ot.DecodeDelta(strs)
+	ok(t, err)
+	return d
+}
+
+func TestDeltaEncoding(t *testing.T) {
+	d := decodeDelta(t, "r,2", "d,1", "d,2", "i,a", "r,1", "i,b", "i,c")
+	// Adjacent components are merged, and inserts go before deletes.
+	eq(t, d.Encode(), []string{"r,2", "i,a", "d,3", "r,1", "i,bc"})
+	eq(t, d.BaseLen(), 6)
+	eq(t, d.TargetLen(), 6)
+	eq(t, decodeDelta(t, "i,😀").BaseLen(), 0)
+	eq(t, decodeDelta(t, "i,😀").TargetLen(), 2)
+
+	for _, s := range []string{"r", "r,0", "d,-1", "i,", "x,1", "r,a"} {
+		if _, err := ot.DecodeDelta([]string{s}); err == nil {
+			fatalf(t, "DecodeDelta(%q) should have failed", s)
+		}
+	}
+}
+
+func TestDeltaApply(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		d    []string
+		want string
+	}{
+		{"", nil, ""},
+		{"", []string{"i,foo"}, "foo"},
+		{"foobar", []string{"r,3", "d,3"}, "foo"},
+		{"foobar", []string{"d,1", "r,2", "i,!", "r,3"}, "oo!bar"},
+		{"a😀b", []string{"r,1", "d,2", "i,é", "r,1"}, "aéb"},
+	} {
+		d := decodeDelta(t, c.d...)
+		got, err := d.Apply(c.s)
+		ok(t, err)
+		eq(t, got, c.want)
+		undone, err := d.Invert(c.s).Apply(got)
+		ok(t, err)
+		eq(t, undone, c.s)
+	}
+	// Wrong length.
+	if _, err := decodeDelta(t, "r,2").Apply("abc"); err == nil {
+		fatal(t, "Apply should have failed")
+	}
+	// Splits a surrogate pair.
+	if _, err := decodeDelta(t, "r,1", "d,1").Apply("😀"); err == nil {
+		fatal(t, "Apply should have failed")
+	}
+}
+
+// randDelta returns a random Delta that applies to s.
+func randDelta(rng *rand.Rand, s string) ot.Delta {
+	values := []string{"a", "bc", "中文", "😀", "x😀y"}
+	b := runeBoundaries(s)
+	var d ot.Delta
+	for i := 0; i < len(b)-1; {
+		j := i + 1 + rng.Intn(minInt(len(b)-1-i, 3))
+		switch rng.Intn(3) {
+		case 0:
+			d.Retain(b[j] - b[i])
+		case 1:
+			d.Delete(b[j] - b[i])
+		case 2:
+			d.Insert(values[rng.Intn(len(values))])
+			continue
+		}
+		i = j
+	}
+	if rng.Intn(2) == 0 {
+		d.Insert(values[rng.Intn(len(values))])
+	}
+	return d
+}
+
+func applyDelta(t *testing.T, s string, d ot.Delta) string {
+	s, err := d.Apply(s)
+	ok(t, err)
+	return s
+}
+
+func TestDeltaRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		s := []string{"", "hello", "中文😀é"}[rng.Intn(3)]
+		a := randDelta(rng, s)
+		sa := applyDelta(t, s, a)
+		eq(t, applyDelta(t, sa, a.Invert(s)), s)
+
+		// Composing is equivalent to applying in sequence.
+		b := randDelta(rng, sa)
+		ab, err := a.Compose(b)
+		ok(t, err)
+		eq(t, applyDelta(t, s, ab), applyDelta(t, sa, b))
+
+		// Transformed deltas converge (TP1).
+		c := randDelta(rng, s)
+		ap, cp, err := ot.TransformDeltas(a, c)
+		ok(t, err)
+		eq(t, applyDelta(t, sa, cp), applyDelta(t, applyDelta(t, s, c), ap))
+	}
+}
+
+func TestDeltaTransformTies(t *testing.T) {
+	a, b := decodeDelta(t, "r,1", "i,a"), decodeDelta(t, "r,1", "i,b")
+	ap, bp, err := ot.TransformDeltas(a, b)
+	ok(t, err)
+	eq(t, ap.Encode(), []string{"r,1", "i,a", "r,1"})
+	eq(t, bp.Encode(), []string{"r,2", "i,b"})
+	if _, _, err := ot.TransformDeltas(a, decodeDelta(t, "r,2")); err == nil {
+		fatal(t, "TransformDeltas should have failed")
+	}
+}
+
+func applyDeltaUpdate(t *testing.T, text *ot.DeltaText, clientId, basePatchId uint32, strs ...string) *common.Change {
+	var c common.Change
+	ok(t, text.ApplyUpdate(&common.Update{
+		ClientId:    clientId,
+		BasePatchId: basePatchId,
+		OpStrs:      strs,
+	}, &c, &common.Ack{}))
+	return &c
+}
+
+func TestDeltaTextApplyConcurrentUpdates(t *testing.T) {
+	text := ot.NewDeltaText("")
+	c := applyDeltaUpdate(t, text, 1, 0, "i,foo")
+	eq(t, c.PatchId, uint32(1))
+	// Client 2 has not yet seen patch 1.
+	c = applyDeltaUpdate(t, text, 2, 0, "i,bar")
+	eq(t, c.PatchId, uint32(2))
+	eq(t, c.OpStrs, []string{"r,3", "i,bar"})
+	eq(t, text.Value(), "foobar")
+
+	// Updates that do not apply are rejected without changing the value.
+	for _, strs := range [][]string{{"r,5"}, {"d,7"}, {"r,1", "i,x"}} {
+		err := text.ApplyUpdate(&common.Update{ClientId: 3, BasePatchId: 2, OpStrs: strs}, &common.Change{}, &common.Ack{})
+		neq(t, err, nil)
+	}
+	eq(t, text.Value(), "foobar")
+}
+
+func TestOpenDeltaText(t *testing.T) {
+	snap, log := store.NewMemBlob(), store.NewMemLog()
+	text, err := ot.OpenDeltaText(snap, log)
+	ok(t, err)
+	applyDeltaUpdate(t, text, 1, 0, "i,foo")
+	applyDeltaUpdate(t, text, 2, 0, "i,bar")
+	applyDeltaUpdate(t, text, 1, 2, "d,1", "r,5")
+
+	// Simulate a restart by reopening the log.
+	text, err = ot.OpenDeltaText(snap, log)
+	ok(t, err)
+	var s common.Snapshot
+	ok(t, text.PopulateSnapshot(&s))
+	eq(t, s, common.Snapshot{Text: "oobar", BasePatchId: 3})
+
+	// After compaction, clients that last saw a discarded patch must resync.
+	ok(t, text.Compact(2))
+	err = text.ApplyUpdate(&common.Update{ClientId: 3, BasePatchId: 1, OpStrs: []string{"r,6", "i,!"}}, &common.Change{}, &common.Ack{})
+	eq(t, err, common.ErrResyncRequired)
+	c := applyDeltaUpdate(t, text, 3, 2, "r,6", "i,!")
+	eq(t, c.PatchId, uint32(4))
+	eq(t, c.OpStrs, []string{"r,5", "i,!"})
+
+	text, err = ot.OpenDeltaText(snap, log)
+	ok(t, err)
+	eq(t, text.Value(), "oobar!")
+	var got []string
+	ok(t, text.Replay(3, func(c *common.Change, a *common.Ack) {
+		got = append(got, c.OpStrs...)
+	}))
+	eq(t, got, []string{"r,5", "i,!"})
+	// Patches retained by the compaction also survive the restart.
+	got = nil
+	ok(t, text.Replay(2, func(c *common.Change, a *common.Ack) {
+		got = append(got, c.OpStrs...)
+	}))
+	eq(t, got, []string{"d,1", "r,5", "r,5", "i,!"})
+}
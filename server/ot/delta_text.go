@@ -0,0 +1,233 @@
+package ot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
+)
+
+type deltaPatch struct {
+	clientId uint32
+	delta    Delta
+}
+
+// DeltaText is like Text, except that each patch is a single Delta, encoded as
+// described in Delta.Encode, rather than a list of positional Ops. It does not
+// support selections or undo.
+type DeltaText struct {
+	// Patches not yet discarded by Compact. patches[i] has PatchId
+	// firstPatchId+i+1.
+	patches      []deltaPatch
+	value        *rope
+	firstPatchId uint32
+	lastPatchId  uint32
+	// Persistence state. If log is nil, the DeltaText is not persisted.
+	snap store.Blob
+	log  store.Log
+}
+
+func NewDeltaText(s string) *DeltaText {
+	return &DeltaText{value: newRope(s)}
+}
+
+// OpenDeltaText returns a DeltaText backed by the given checkpoint and log. See
+// OpenText.
+func OpenDeltaText(snap store.Blob, log store.Log) (*DeltaText, error) {
+	t := NewDeltaText("")
+	cp, err := readCheckpoint(snap)
+	if err != nil {
+		return nil, err
+	}
+	t.value = newRope(cp.Value)
+	t.firstPatchId, t.lastPatchId = cp.PatchId, cp.PatchId
+	err = replayCheckpoint(cp, log, func(rec *logRecord) error {
+		d, err := DecodeDelta(rec.OpStrs)
+		if err != nil {
+			return err
+		}
+		if err := applyDelta(t.value, d); err != nil {
+			return err
+		}
+		t.commit(deltaPatch{rec.ClientId, d})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.snap, t.log = snap, log
+	return t, nil
+}
+
+func (t *DeltaText) Value() string {
+	return t.value.String()
+}
+
+// Close closes the underlying log, if any.
+func (t *DeltaText) Close() error {
+	if t.log == nil {
+		return nil
+	}
+	return t.log.Close()
+}
+
+// PopulateSnapshot populates s.
+func (t *DeltaText) PopulateSnapshot(s *common.Snapshot) error {
+	s.BasePatchId = t.lastPatchId
+	s.Text = t.value.String()
+	return nil
+}
+
+// Replay calls f with the Change and Ack for each patch after basePatchId, in
+// order. Returns common.ErrResyncRequired if the patches after basePatchId have
+// been discarded.
+func (t *DeltaText) Replay(basePatchId uint32, f func(c *common.Change, a *common.Ack)) error {
+	if err := t.checkBasePatchId(basePatchId); err != nil {
+		return err
+	}
+	for i, p := range t.patches[basePatchId-t.firstPatchId:] {
+		patchId := basePatchId + uint32(i) + 1
+		f(&common.Change{ClientId: p.clientId, PatchId: patchId, OpStrs: p.delta.Encode()}, &common.Ack{PatchId: patchId})
+	}
+	return nil
+}
+
+// ApplyUpdate applies u and populates c and a. Returns
+// common.ErrResyncRequired if the patches after u.BasePatchId have been
+// discarded.
+func (t *DeltaText) ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
+	d, err := DecodeDelta(u.OpStrs)
+	if err != nil {
+		return err
+	}
+	if err := t.checkBasePatchId(u.BasePatchId); err != nil {
+		return err
+	}
+	// Transform against past patches as needed. Text inserted by past patches
+	// goes first, as in Text.
+	for _, p := range t.patches[u.BasePatchId-t.firstPatchId:] {
+		if u.ClientId == p.clientId {
+			// Note: Clients are responsible for buffering.
+			return errors.New("patch is not parented off server state")
+		}
+		if _, d, err = TransformDeltas(p.delta, d); err != nil {
+			return err
+		}
+	}
+	if err := checkDelta(t.value, d); err != nil {
+		return err
+	}
+	if t.log != nil {
+		buf, err := json.Marshal(&logRecord{
+			ClientId: u.ClientId,
+			PatchId:  t.lastPatchId + 1,
+			OpStrs:   d.Encode(),
+		})
+		if err == nil {
+			err = t.log.Append(buf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = applyDelta(t.value, d)
+	assert(err == nil, err)
+	t.commit(deltaPatch{u.ClientId, d})
+	c.PatchId = t.lastPatchId
+	c.OpStrs = d.Encode()
+	a.PatchId = t.lastPatchId
+	return nil
+}
+
+// Compact discards the patches up to and including basePatchId. See
+// Text.Compact.
+func (t *DeltaText) Compact(basePatchId uint32) error {
+	if basePatchId > t.lastPatchId {
+		return fmt.Errorf("unknown BasePatchId: %d", basePatchId)
+	} else if basePatchId <= t.firstPatchId {
+		return nil
+	}
+	if t.log != nil {
+		cp, err := readCheckpoint(t.snap)
+		if err != nil {
+			return err
+		}
+		value := newRope(cp.Value)
+		for _, p := range t.patches[:basePatchId-t.firstPatchId] {
+			err := applyDelta(value, p.delta)
+			assert(err == nil, err)
+		}
+		cp = &checkpoint{Value: value.String(), PatchId: basePatchId}
+		for i, p := range t.patches[basePatchId-t.firstPatchId:] {
+			cp.Patches = append(cp.Patches, logRecord{
+				ClientId: p.clientId,
+				PatchId:  basePatchId + uint32(i) + 1,
+				OpStrs:   p.delta.Encode(),
+			})
+		}
+		if err := writeCheckpoint(t.snap, t.log, cp); err != nil {
+			return err
+		}
+	}
+	t.patches = append([]deltaPatch(nil), t.patches[basePatchId-t.firstPatchId:]...)
+	t.firstPatchId = basePatchId
+	return nil
+}
+
+// checkBasePatchId returns an error if basePatchId is not a PatchId whose
+// successors are retained.
+func (t *DeltaText) checkBasePatchId(basePatchId uint32) error {
+	if basePatchId > t.lastPatchId {
+		return fmt.Errorf("unknown BasePatchId: %d", basePatchId)
+	} else if basePatchId < t.firstPatchId {
+		return common.ErrResyncRequired
+	}
+	return nil
+}
+
+// commit records the given patch, which has already been applied to the value.
+func (t *DeltaText) commit(p deltaPatch) {
+	t.patches = append(t.patches, p)
+	t.lastPatchId++
+}
+
+// checkDelta returns an error if d does not apply to r.
+func checkDelta(r *rope, d Delta) error {
+	if d.BaseLen() != r.len() {
+		return errLengthMismatch
+	}
+	pos := 0
+	for _, c := range d {
+		if c.Type != InsertComponent {
+			pos += c.N
+			if err := r.check(pos); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyDelta applies d to r. If d does not apply, r is left unchanged.
+func applyDelta(r *rope, d Delta) error {
+	if err := checkDelta(r, d); err != nil {
+		return err
+	}
+	pos := 0
+	for _, c := range d {
+		var err error
+		switch c.Type {
+		case RetainComponent:
+			pos += c.N
+		case InsertComponent:
+			err = r.insert(pos, c.Value)
+			pos += c.N
+		case DeleteComponent:
+			_, err = r.delete(pos, c.N)
+		}
+		assert(err == nil, err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package ot
+
+import (
+	"math/rand"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxChunkBytes is the maximum size of a rope chunk. Edits within a chunk are
+// done in place, so this bounds the cost of a typical single-character edit.
+const maxChunkBytes = 512
+
+// rope is a string stored as a sequence of chunks, indexed by position in
+// UTF-16 code units. It supports O(log n) insert and delete. The chunks are
+// kept in a treap, i.e. a binary tree ordered by position that is also a heap
+// on randomly assigned node priorities, which keeps it balanced in expectation.
+type rope struct {
+	root *ropeNode
+}
+
+type ropeNode struct {
+	chunk       string
+	chunkLen    int // length of chunk in UTF-16 code units
+	len         int // length of this subtree in UTF-16 code units
+	bytes       int // length of this subtree in bytes
+	prio        uint32
+	left, right *ropeNode
+}
+
+func newRopeNode(chunk string) *ropeNode {
+	n := &ropeNode{chunk: chunk, chunkLen: utf16Len(chunk), prio: rand.Uint32()}
+	n.update()
+	return n
+}
+
+func (n *ropeNode) update() {
+	n.len, n.bytes = n.chunkLen, len(n.chunk)
+	if n.left != nil {
+		n.len += n.left.len
+		n.bytes += n.left.bytes
+	}
+	if n.right != nil {
+		n.len += n.right.len
+		n.bytes += n.right.bytes
+	}
+}
+
+func newRope(s string) *rope {
+	return &rope{buildRope(s)}
+}
+
+// len returns the length of r in UTF-16 code units.
+func (r *rope) len() int {
+	if r.root == nil {
+		return 0
+	}
+	return r.root.len
+}
+
+func (r *rope) String() string {
+	if r.root == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.Grow(r.root.bytes)
+	var walk func(n *ropeNode)
+	walk = func(n *ropeNode) {
+		if n == nil {
+			return
+		}
+		walk(n.left)
+		b.WriteString(n.chunk)
+		walk(n.right)
+	}
+	walk(r.root)
+	return b.String()
+}
+
+// insert inserts s at pos.
+func (r *rope) insert(pos int, s string) error {
+	if !utf8.ValidString(s) {
+		return errInvalidUTF8
+	}
+	if err := r.check(pos); err != nil {
+		return err
+	}
+	if s == "" {
+		return nil
+	}
+	if _, ok := spliceRope(&r.root, pos, 0, s); ok {
+		return nil
+	}
+	lo, hi := splitRope(r.root, pos)
+	r.root = mergeRopes(mergeRopes(lo, buildRope(s)), hi)
+	return nil
+}
+
+// delete deletes n code units starting at pos, and returns the deleted text.
+func (r *rope) delete(pos, n int) (string, error) {
+	if n < 0 {
+		return "", errOutOfBounds
+	}
+	if err := r.check(pos); err != nil {
+		return "", err
+	}
+	if err := r.check(pos + n); err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", nil
+	}
+	if s, ok := spliceRope(&r.root, pos, n, ""); ok {
+		return s, nil
+	}
+	lo, rest := splitRope(r.root, pos)
+	mid, hi := splitRope(rest, n)
+	r.root = mergeRopes(lo, hi)
+	return (&rope{mid}).String(), nil
+}
+
+// check returns an error if pos is out of bounds or splits a surrogate pair.
+func (r *rope) check(pos int) error {
+	if pos < 0 || pos > r.len() {
+		return errOutOfBounds
+	}
+	for n := r.root; n != nil; {
+		l := 0
+		if n.left != nil {
+			l = n.left.len
+		}
+		switch {
+		case pos < l:
+			n = n.left
+		case pos > l+n.chunkLen:
+			pos -= l + n.chunkLen
+			n = n.right
+		default:
+			_, err := byteOffset(n.chunk, pos-l)
+			return err
+		}
+	}
+	return nil
+}
+
+// buildRope returns a tree of chunks holding s.
+func buildRope(s string) *ropeNode {
+	var root *ropeNode
+	for s != "" {
+		i := len(s)
+		if i > maxChunkBytes {
+			i = maxChunkBytes
+			for !utf8.RuneStart(s[i]) {
+				i--
+			}
+		}
+		root = mergeRopes(root, newRopeNode(s[:i]))
+		s = s[i:]
+	}
+	return root
+}
+
+// spliceRope replaces the n code units at pos in the subtree *np with s, if
+// they lie within a single chunk with room for s. Returns the replaced text and
+// whether the splice was done. Positions must have been checked.
+func spliceRope(np **ropeNode, pos, n int, s string) (string, bool) {
+	x := *np
+	if x == nil {
+		return "", false
+	}
+	l := 0
+	if x.left != nil {
+		l = x.left.len
+	}
+	var res string
+	var ok bool
+	switch {
+	case pos < l:
+		if pos+n > l {
+			return "", false
+		}
+		res, ok = spliceRope(&x.left, pos, n, s)
+	case pos+n <= l+x.chunkLen:
+		i, _ := byteOffset(x.chunk, pos-l)
+		j, _ := byteOffset(x.chunk[i:], n)
+		if len(x.chunk)-j+len(s) > maxChunkBytes {
+			return "", false
+		}
+		res = x.chunk[i : i+j]
+		x.chunk = x.chunk[:i] + s + x.chunk[i+j:]
+		x.chunkLen += utf16Len(s) - n
+		if x.chunk == "" {
+			*np = mergeRopes(x.left, x.right)
+			return res, true
+		}
+		ok = true
+	case pos >= l+x.chunkLen:
+		res, ok = spliceRope(&x.right, pos-l-x.chunkLen, n, s)
+	}
+	if ok {
+		x.update()
+	}
+	return res, ok
+}
+
+// splitRope splits x into the first pos code units and the rest, splitting a
+// chunk if needed. pos must have been checked.
+func splitRope(x *ropeNode, pos int) (lo, hi *ropeNode) {
+	if x == nil {
+		return nil, nil
+	}
+	l := 0
+	if x.left != nil {
+		l = x.left.len
+	}
+	switch {
+	case pos <= l:
+		lo, x.left = splitRope(x.left, pos)
+		hi = x
+	case pos >= l+x.chunkLen:
+		x.right, hi = splitRope(x.right, pos-l-x.chunkLen)
+		lo = x
+	default:
+		i, _ := byteOffset(x.chunk, pos-l)
+		hi = mergeRopes(newRopeNode(x.chunk[i:]), x.right)
+		x.chunk, x.chunkLen, x.right = x.chunk[:i], pos-l, nil
+		lo = x
+	}
+	x.update()
+	return lo, hi
+}
+
+// mergeRopes joins lo and hi, with lo's chunks first.
+func mergeRopes(lo, hi *ropeNode) *ropeNode {
+	switch {
+	case lo == nil:
+		return hi
+	case hi == nil:
+		return lo
+	case lo.prio > hi.prio:
+		lo.right = mergeRopes(lo.right, hi)
+		lo.update()
+		return lo
+	default:
+		hi.left = mergeRopes(lo, hi.left)
+		hi.update()
+		return hi
+	}
+}
@@ -1,12 +1,16 @@
 package ot
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/asadovsky/goatee/server/common"
+	"github.com/asadovsky/goatee/server/store"
 )
 
 func assert(b bool, v ...interface{}) {
@@ -15,10 +19,14 @@ func assert(b bool, v ...interface{}) {
 	}
 }
 
-// Op is an operation.
+// Op is an operation. Positions and lengths are in UTF-16 code units, matching
+// JavaScript string indexing. Ops may not split a surrogate pair.
 type Op interface {
 	Encode() string
 	Apply(s string) (string, error)
+	// Invert returns an op that undoes this op, given the string s to which this
+	// op was applied.
+	Invert(s string) Op
 }
 
 // Insert represents a text insertion.
@@ -32,10 +40,18 @@ func (op *Insert) Encode() string {
 }
 
 func (op *Insert) Apply(s string) (string, error) {
-	if op.Pos < 0 || op.Pos > len(s) {
-		return "", errors.New("out of bounds")
+	if !utf8.ValidString(op.Value) {
+		return "", errInvalidUTF8
 	}
-	return s[:op.Pos] + op.Value + s[op.Pos:], nil
+	i, err := byteOffset(s, op.Pos)
+	if err != nil {
+		return "", err
+	}
+	return s[:i] + op.Value + s[i:], nil
+}
+
+func (op *Insert) Invert(s string) Op {
+	return &Delete{op.Pos, utf16Len(op.Value)}
 }
 
 // Delete represents a text deletion.
@@ -49,10 +65,33 @@ func (op *Delete) Encode() string {
 }
 
 func (op *Delete) Apply(s string) (string, error) {
-	if op.Pos < 0 || op.Pos+op.Len > len(s) {
-		return "", errors.New("out of bounds")
+	i, j, err := op.byteRange(s)
+	if err != nil {
+		return "", err
 	}
-	return s[:op.Pos] + s[op.Pos+op.Len:], nil
+	return s[:i] + s[j:], nil
+}
+
+// Invert returns an Insert of the deleted text. Delete does not retain the
+// deleted text, so s must be the string to which this op was applied.
+func (op *Delete) Invert(s string) Op {
+	i, j, err := op.byteRange(s)
+	assert(err == nil, err)
+	return &Insert{op.Pos, s[i:j]}
+}
+
+// byteRange returns the byte offsets in s of the deleted range.
+func (op *Delete) byteRange(s string) (i, j int, err error) {
+	if op.Len < 0 {
+		return 0, 0, errOutOfBounds
+	}
+	if i, err = byteOffset(s, op.Pos); err != nil {
+		return 0, 0, err
+	}
+	if j, err = byteOffset(s[i:], op.Len); err != nil {
+		return 0, 0, err
+	}
+	return i, i + j, nil
 }
 
 // DecodeOp returns an Op given an encoded op.
@@ -105,14 +144,14 @@ func DecodeOps(strs []string) ([]Op, error) {
 func transformInsertDelete(a *Insert, b *Delete) (ap, bp Op) {
 	if a.Pos <= b.Pos {
 		// Insert before delete. Delete shifts forward.
-		return a, &Delete{b.Pos + len(a.Value), b.Len}
+		return a, &Delete{b.Pos + utf16Len(a.Value), b.Len}
 	} else if a.Pos >= b.Pos+b.Len {
 		// Insert after delete. Insert shifts backward.
 		return &Insert{a.Pos - b.Len, a.Value}, b
 	} else {
 		// Insert inside the delete range. Delete expands to include the insert,
 		// and insert collapses to nothing.
-		return &Insert{b.Pos, ""}, &Delete{b.Pos, b.Len + len(a.Value)}
+		return &Insert{b.Pos, ""}, &Delete{b.Pos, b.Len + utf16Len(a.Value)}
 	}
 }
 
@@ -126,9 +165,9 @@ func Transform(a, b Op) (ap, bp Op) {
 		case *Insert:
 			// When insert positions are equal, a' shifts forward.
 			if bi.Pos <= ai.Pos {
-				return &Insert{ai.Pos + len(bi.Value), ai.Value}, b
+				return &Insert{ai.Pos + utf16Len(bi.Value), ai.Value}, b
 			} else {
-				return a, &Insert{bi.Pos + len(ai.Value), bi.Value}
+				return a, &Insert{bi.Pos + utf16Len(ai.Value), bi.Value}
 			}
 		case *Delete:
 			return transformInsertDelete(ai, bi)
@@ -167,67 +206,590 @@ func TransformPatch(a, b []Op) (ap, bp []Op) {
 	return aNew, bNew
 }
 
+// Selection is a selected range of text, [Start, End). A caret is represented
+// as a Selection with Start == End.
+type Selection struct {
+	Start int
+	End   int
+}
+
+// transformPos transforms the given position against op. Positions behave like
+// empty inserts, so text inserted at a position ends up before it.
+func transformPos(pos int, op Op) int {
+	ap, _ := Transform(&Insert{pos, ""}, op)
+	return ap.(*Insert).Pos
+}
+
+// TransformSelection transforms sel against the given ops, which are applied
+// sequentially.
+func TransformSelection(sel Selection, ops []Op) Selection {
+	for _, op := range ops {
+		sel = Selection{transformPos(sel.Start, op), transformPos(sel.End, op)}
+	}
+	return sel
+}
+
 type patch struct {
 	clientId uint32
 	ops      []Op
+	inverse  []Op   // undoes ops
+	undoOf   uint32 // if non-zero, the PatchId this patch reverts
+}
+
+// logRecord is the persisted form of a patch.
+type logRecord struct {
+	ClientId uint32
+	PatchId  uint32
+	OpStrs   []string
+	UndoOf   uint32
+}
+
+// checkpoint is the persisted value of a Text as of PatchId. Patches holds the
+// patches after PatchId that were retained by the last Compact, and the log
+// holds the patches after those.
+type checkpoint struct {
+	Value   string
+	PatchId uint32
+	Patches []logRecord `json:",omitempty"`
+}
+
+// readCheckpoint returns the checkpoint in snap, or an empty checkpoint if there
+// is none.
+func readCheckpoint(snap store.Blob) (*checkpoint, error) {
+	cp := &checkpoint{}
+	buf, err := snap.Get()
+	if err != nil {
+		return nil, err
+	}
+	if buf != nil {
+		if err := json.Unmarshal(buf, cp); err != nil {
+			return nil, err
+		}
+	}
+	return cp, nil
+}
+
+// replayCheckpoint calls f on each patch in cp and then in log, in order,
+// skipping any that precede the last patch seen.
+func replayCheckpoint(cp *checkpoint, log store.Log, f func(rec *logRecord) error) error {
+	lastPatchId := cp.PatchId
+	apply := func(rec *logRecord) error {
+		if rec.PatchId <= lastPatchId {
+			// We crashed after writing the checkpoint but before resetting the log.
+			return nil
+		}
+		if rec.PatchId != lastPatchId+1 {
+			return fmt.Errorf("unexpected PatchId: got %d, want %d", rec.PatchId, lastPatchId+1)
+		}
+		lastPatchId++
+		return f(rec)
+	}
+	for i := range cp.Patches {
+		if err := apply(&cp.Patches[i]); err != nil {
+			return err
+		}
+	}
+	return log.Replay(func(buf []byte) error {
+		var rec logRecord
+		if err := json.Unmarshal(buf, &rec); err != nil {
+			return err
+		}
+		return apply(&rec)
+	})
+}
+
+// writeCheckpoint replaces the checkpoint in snap with cp and then resets log.
+func writeCheckpoint(snap store.Blob, log store.Log, cp *checkpoint) error {
+	buf, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := snap.Put(buf); err != nil {
+		return err
+	}
+	return log.Reset()
 }
 
 // Text represents a string that supports OT operations.
-// TODO: Support cursors and rich text (using annotated ranges).
+// TODO: Support rich text (using annotated ranges).
 type Text struct {
-	patches     []patch
-	value       string
-	lastPatchId uint32
+	// Patches not yet discarded by Compact. patches[i] has PatchId
+	// firstPatchId+i+1.
+	patches      []patch
+	value        *rope
+	firstPatchId uint32
+	lastPatchId  uint32
+	// Persistence state. If log is nil, the Text is not persisted.
+	snap store.Blob
+	log  store.Log
+	// Client selections, relative to lastPatchId. Not persisted.
+	selections map[uint32]Selection
+	// Per-client stacks of PatchIds that can be undone or redone, in increasing
+	// order. Not persisted.
+	undoStacks map[uint32][]uint32
+	redoStacks map[uint32][]uint32
 }
 
 func NewText(s string) *Text {
-	return &Text{value: s}
+	return &Text{
+		value:      newRope(s),
+		selections: make(map[uint32]Selection),
+		undoStacks: make(map[uint32][]uint32),
+		redoStacks: make(map[uint32][]uint32),
+	}
+}
+
+// OpenText returns a Text backed by the given checkpoint and log, replaying any
+// patches in the log after the checkpoint. Subsequent patches are appended to
+// the log before being applied, and the checkpoint is replaced by Compact.
+func OpenText(snap store.Blob, log store.Log) (*Text, error) {
+	t := NewText("")
+	cp, err := readCheckpoint(snap)
+	if err != nil {
+		return nil, err
+	}
+	t.value = newRope(cp.Value)
+	t.firstPatchId, t.lastPatchId = cp.PatchId, cp.PatchId
+	err = replayCheckpoint(cp, log, func(rec *logRecord) error {
+		ops, err := DecodeOps(rec.OpStrs)
+		if err != nil {
+			return err
+		}
+		inverse, err := t.applyOps(ops)
+		if err != nil {
+			return err
+		}
+		t.commit(patch{rec.ClientId, ops, inverse, rec.UndoOf})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.snap, t.log = snap, log
+	return t, nil
 }
 
 func (t *Text) Value() string {
-	return t.value
+	return t.value.String()
+}
+
+// Close closes the underlying log, if any.
+func (t *Text) Close() error {
+	if t.log == nil {
+		return nil
+	}
+	return t.log.Close()
 }
 
 // PopulateSnapshot populates s.
 func (t *Text) PopulateSnapshot(s *common.Snapshot) error {
 	s.BasePatchId = t.lastPatchId
-	s.Text = t.value
+	s.Text = t.value.String()
+	clientIds := make([]int, 0, len(t.selections))
+	for clientId := range t.selections {
+		clientIds = append(clientIds, int(clientId))
+	}
+	sort.Ints(clientIds)
+	s.Selections = nil
+	for _, clientId := range clientIds {
+		sel := t.selections[uint32(clientId)]
+		s.Selections = append(s.Selections, common.Selection{
+			ClientId: uint32(clientId),
+			PatchId:  t.lastPatchId,
+			Start:    sel.Start,
+			End:      sel.End,
+		})
+	}
+	return nil
+}
+
+// SetSelection sets the selection for the given client. The selection in m is
+// relative to m.BasePatchId. Populates s with the selection relative to the
+// latest patch.
+func (t *Text) SetSelection(m *common.Select, s *common.Selection) error {
+	if err := t.checkBasePatchId(m.BasePatchId); err != nil {
+		return err
+	}
+	sel := Selection{m.Start, m.End}
+	for _, p := range t.patches[m.BasePatchId-t.firstPatchId:] {
+		if m.ClientId == p.clientId && p.undoOf == 0 {
+			// Note: Clients are responsible for buffering.
+			return errors.New("selection is not parented off server state")
+		}
+		sel = TransformSelection(sel, p.ops)
+	}
+	if sel.Start < 0 || sel.Start > sel.End || sel.End > t.value.len() {
+		return errors.New("out of bounds")
+	}
+	t.selections[m.ClientId] = sel
+	s.ClientId = m.ClientId
+	s.PatchId = t.lastPatchId
+	s.Start, s.End = sel.Start, sel.End
 	return nil
 }
 
-// ApplyUpdate applies u and populates c.
-func (t *Text) ApplyUpdate(u *common.Update, c *common.Change) error {
+// ClearSelection clears the selection for the given client, if any.
+func (t *Text) ClearSelection(clientId uint32) {
+	delete(t.selections, clientId)
+}
+
+// Replay calls f with the Change and Ack for each patch after basePatchId, in
+// order. The Ack is nil for patches created by Undo or Redo, which must be sent
+// to every client as a Change. Returns common.ErrResyncRequired if the patches
+// after basePatchId have been discarded.
+func (t *Text) Replay(basePatchId uint32, f func(c *common.Change, a *common.Ack)) error {
+	if err := t.checkBasePatchId(basePatchId); err != nil {
+		return err
+	}
+	for i := basePatchId; i < t.lastPatchId; i++ {
+		p := t.patch(i + 1)
+		var a *common.Ack
+		if p.undoOf == 0 {
+			a = &common.Ack{PatchId: i + 1}
+		}
+		f(&common.Change{ClientId: p.clientId, PatchId: i + 1, OpStrs: EncodeOps(p.ops)}, a)
+	}
+	return nil
+}
+
+// ApplyUpdate applies u and populates c and a. Returns
+// common.ErrResyncRequired if the patches after u.BasePatchId have been
+// discarded.
+func (t *Text) ApplyUpdate(u *common.Update, c *common.Change, a *common.Ack) error {
 	ops, err := DecodeOps(u.OpStrs)
 	if err != nil {
 		return err
 	}
+	if err := t.checkBasePatchId(u.BasePatchId); err != nil {
+		return err
+	}
 	// Transform against past ops as needed.
-	for i := u.BasePatchId + 1; i < uint32(len(t.patches)); i++ {
-		p := t.patches[i]
-		if u.ClientId == p.clientId {
+	for _, p := range t.patches[u.BasePatchId-t.firstPatchId:] {
+		// Patches created by Undo or Redo are sent to their client as Changes,
+		// so the client transforms against them like any other client's patch.
+		if u.ClientId == p.clientId && p.undoOf == 0 {
 			// Note: Clients are responsible for buffering.
 			return errors.New("patch is not parented off server state")
 		}
 		ops, _ = TransformPatch(ops, p.ops)
 	}
-	value := t.value
-	for _, op := range ops {
-		var err error
-		if value, err = op.Apply(value); err != nil {
-			return err
-		}
+	inverse, err := t.applyOps(ops)
+	if err != nil {
+		return err
 	}
-	t.patches = append(t.patches, patch{u.ClientId, ops})
-	t.value = value
-	t.lastPatchId++
+	// Now that the ops are known to be valid, store and broadcast them in
+	// minimal form, e.g. as one Insert rather than one per typed character.
+	ops, inverse = Compose(ops, nil), Compose(inverse, nil)
+	if err := t.record(patch{u.ClientId, ops, inverse, 0}); err != nil {
+		return err
+	}
+	t.undoStacks[u.ClientId] = append(t.undoStacks[u.ClientId], t.lastPatchId)
+	delete(t.redoStacks, u.ClientId)
 	c.PatchId = t.lastPatchId
 	c.OpStrs = EncodeOps(ops)
+	a.PatchId = t.lastPatchId
 	return nil
 }
 
+// Undo undoes patch m.PatchId, or the client's most recent patch if m.PatchId
+// is 0, by applying its inverse as a new patch from clientId. A client can only
+// undo its own patches, and each patch only once. Populates c. Returns
+// common.ErrNothingToUndo if the client has no patches to undo.
+func (t *Text) Undo(clientId uint32, m *common.Undo, c *common.Change) error {
+	stack := t.undoStacks[clientId]
+	i, ok := stackIndex(stack, m.PatchId)
+	if !ok && m.PatchId == 0 {
+		return common.ErrNothingToUndo
+	} else if !ok {
+		return fmt.Errorf("cannot undo patch: %d", m.PatchId)
+	}
+	if err := t.revert(clientId, stack[i], c); err != nil {
+		return err
+	}
+	t.undoStacks[clientId] = append(stack[:i], stack[i+1:]...)
+	t.redoStacks[clientId] = append(t.redoStacks[clientId], t.lastPatchId)
+	return nil
+}
+
+// Redo undoes patch m.PatchId, which must have been created by Undo for
+// clientId, or the client's most recent such patch if m.PatchId is 0. The redo
+// stack is cleared whenever the client applies a new update. Populates c.
+// Returns common.ErrNothingToUndo if the client has no patches to redo.
+func (t *Text) Redo(clientId uint32, m *common.Redo, c *common.Change) error {
+	stack := t.redoStacks[clientId]
+	i, ok := stackIndex(stack, m.PatchId)
+	if !ok && m.PatchId == 0 {
+		return common.ErrNothingToUndo
+	} else if !ok {
+		return fmt.Errorf("cannot redo patch: %d", m.PatchId)
+	}
+	if err := t.revert(clientId, stack[i], c); err != nil {
+		return err
+	}
+	t.redoStacks[clientId] = append(stack[:i], stack[i+1:]...)
+	t.undoStacks[clientId] = append(t.undoStacks[clientId], t.lastPatchId)
+	return nil
+}
+
+// revert applies the inverse of the given patch, transformed against all later
+// patches, as a new patch from clientId. Populates c.
+func (t *Text) revert(clientId, patchId uint32, c *common.Change) error {
+	ops, _ := TransformPatch(t.patch(patchId).inverse, t.opsSince(patchId))
+	inverse, err := t.applyOps(ops)
+	if err != nil {
+		return err
+	}
+	if err := t.record(patch{clientId, ops, inverse, patchId}); err != nil {
+		return err
+	}
+	c.PatchId = t.lastPatchId
+	c.OpStrs = EncodeOps(ops)
+	return nil
+}
+
+// opsSince returns minimal ops equivalent to all patches after patchId, applied
+// sequentially. A patch that is reverted by a later patch is dropped along with
+// the reverting patch, and the patches in between are rebased accordingly, so
+// that e.g. undoing two patches in a row restores the original text.
+func (t *Text) opsSince(patchId uint32) []Op {
+	type entry struct {
+		patchId uint32 // 0 for rebased patches
+		ops     []Op
+	}
+	var entries []entry
+	for i := patchId; i < t.lastPatchId; i++ {
+		p := t.patch(i + 1)
+		j := len(entries) - 1
+		for p.undoOf != 0 && j >= 0 && entries[j].patchId != p.undoOf {
+			j--
+		}
+		if p.undoOf == 0 || j < 0 {
+			entries = append(entries, entry{i + 1, p.ops})
+			continue
+		}
+		// p reverts entries[j], so drop both, rebasing the entries in between onto
+		// the state before entries[j].
+		var between []Op
+		for _, e := range entries[j+1:] {
+			between = append(between, e.ops...)
+		}
+		_, between = TransformPatch(t.patch(entries[j].patchId).inverse, between)
+		entries = append(entries[:j], entry{0, between})
+	}
+	var ops []Op
+	for _, e := range entries {
+		ops = append(ops, e.ops...)
+	}
+	return Compose(ops, nil)
+}
+
+// Compact discards the patches up to and including basePatchId, which should be
+// no newer than the BasePatchId of any connected client. Requests based on
+// discarded patches fail with common.ErrResyncRequired, and discarded patches
+// can no longer be undone. If the Text is persisted, Compact also writes a new
+// checkpoint as of basePatchId and resets the log.
+func (t *Text) Compact(basePatchId uint32) error {
+	if basePatchId > t.lastPatchId {
+		return fmt.Errorf("unknown BasePatchId: %d", basePatchId)
+	} else if basePatchId <= t.firstPatchId {
+		return nil
+	}
+	if t.log != nil {
+		// The checkpoint is as of basePatchId and holds the retained patches, so
+		// that clients can still resume from them after a restart. Its value is
+		// that of the previous checkpoint, which is as of firstPatchId, plus the
+		// discarded patches.
+		cp, err := readCheckpoint(t.snap)
+		if err != nil {
+			return err
+		}
+		value := newRope(cp.Value)
+		for _, p := range t.patches[:basePatchId-t.firstPatchId] {
+			for _, op := range p.ops {
+				_, err := applyOp(value, op)
+				assert(err == nil, err)
+			}
+		}
+		cp = &checkpoint{Value: value.String(), PatchId: basePatchId}
+		for i, p := range t.patches[basePatchId-t.firstPatchId:] {
+			cp.Patches = append(cp.Patches, logRecord{
+				ClientId: p.clientId,
+				PatchId:  basePatchId + uint32(i) + 1,
+				OpStrs:   EncodeOps(p.ops),
+				UndoOf:   p.undoOf,
+			})
+		}
+		if err := writeCheckpoint(t.snap, t.log, cp); err != nil {
+			return err
+		}
+	}
+	// Copy the retained patches, so that the discarded ones can be freed.
+	t.patches = append([]patch(nil), t.patches[basePatchId-t.firstPatchId:]...)
+	t.firstPatchId = basePatchId
+	for _, stacks := range []map[uint32][]uint32{t.undoStacks, t.redoStacks} {
+		for clientId, stack := range stacks {
+			i := sort.Search(len(stack), func(i int) bool { return stack[i] > basePatchId })
+			if i == len(stack) {
+				delete(stacks, clientId)
+			} else {
+				stacks[clientId] = stack[i:]
+			}
+		}
+	}
+	return nil
+}
+
+// checkBasePatchId returns an error if basePatchId is not a PatchId whose
+// successors are retained.
+func (t *Text) checkBasePatchId(basePatchId uint32) error {
+	if basePatchId > t.lastPatchId {
+		return fmt.Errorf("unknown BasePatchId: %d", basePatchId)
+	} else if basePatchId < t.firstPatchId {
+		return common.ErrResyncRequired
+	}
+	return nil
+}
+
+// patch returns the patch with the given PatchId, which must be retained.
+func (t *Text) patch(patchId uint32) *patch {
+	return &t.patches[patchId-t.firstPatchId-1]
+}
+
+// record appends the given patch, which has already been applied to the value,
+// to the log, if any, and then commits it. If the append fails, the patch is
+// undone.
+func (t *Text) record(p patch) error {
+	if t.log != nil {
+		buf, err := json.Marshal(&logRecord{
+			ClientId: p.clientId,
+			PatchId:  t.lastPatchId + 1,
+			OpStrs:   EncodeOps(p.ops),
+			UndoOf:   p.undoOf,
+		})
+		if err != nil {
+			t.undoOps(p.inverse)
+			return err
+		}
+		if err := t.log.Append(buf); err != nil {
+			t.undoOps(p.inverse)
+			return err
+		}
+	}
+	t.commit(p)
+	return nil
+}
+
+// commit records the given patch, which has already been applied to the value.
+func (t *Text) commit(p patch) {
+	t.patches = append(t.patches, p)
+	t.lastPatchId++
+	for id, sel := range t.selections {
+		t.selections[id] = TransformSelection(sel, p.ops)
+	}
+}
+
+// applyOps applies ops to the value and returns the ops that undo them. If an
+// op fails, the ops already applied are undone, leaving the value unchanged.
+func (t *Text) applyOps(ops []Op) ([]Op, error) {
+	inverse := make([]Op, len(ops))
+	for i, op := range ops {
+		inv, err := applyOp(t.value, op)
+		if err != nil {
+			t.undoOps(inverse[len(ops)-i:])
+			return nil, err
+		}
+		inverse[len(ops)-1-i] = inv
+	}
+	return inverse, nil
+}
+
+// undoOps applies the given inverse ops, which must succeed.
+func (t *Text) undoOps(inverse []Op) {
+	for _, op := range inverse {
+		_, err := applyOp(t.value, op)
+		assert(err == nil, err)
+	}
+}
+
+// applyOp applies op to r and returns the op that undoes it.
+func applyOp(r *rope, op Op) (Op, error) {
+	switch v := op.(type) {
+	case *Insert:
+		if err := r.insert(v.Pos, v.Value); err != nil {
+			return nil, err
+		}
+		return &Delete{v.Pos, utf16Len(v.Value)}, nil
+	case *Delete:
+		s, err := r.delete(v.Pos, v.Len)
+		if err != nil {
+			return nil, err
+		}
+		return &Insert{v.Pos, s}, nil
+	default:
+		panic(fmt.Sprintf("unexpected op type: %T", v))
+	}
+}
+
+// stackIndex returns the index of patchId in stack, or of the top of stack if
+// patchId is 0.
+func stackIndex(stack []uint32, patchId uint32) (int, bool) {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if patchId == 0 || stack[i] == patchId {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
 ////////////////////////////////////////
 // Internal helpers
 
+var (
+	errInvalidUTF8     = errors.New("invalid UTF-8")
+	errOutOfBounds     = errors.New("out of bounds")
+	errSplitsSurrogate = errors.New("position splits a surrogate pair")
+)
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16RuneLen(r)
+	}
+	return n
+}
+
+// utf16RuneLen returns the number of UTF-16 code units needed to encode r.
+func utf16RuneLen(r rune) int {
+	if r >= 0x10000 {
+		return 2 // surrogate pair
+	}
+	return 1
+}
+
+// byteOffset returns the byte offset in s of the given position, in UTF-16
+// code units.
+func byteOffset(s string, pos int) (int, error) {
+	if pos < 0 {
+		return 0, errOutOfBounds
+	}
+	n := 0
+	for i, r := range s {
+		if n == pos {
+			return i, nil
+		} else if n > pos {
+			return 0, errSplitsSurrogate
+		}
+		n += utf16RuneLen(r)
+	}
+	if n == pos {
+		return len(s), nil
+	} else if n > pos {
+		return 0, errSplitsSurrogate
+	}
+	return 0, errOutOfBounds
+}
+
 func maxInt(a, b int) int {
 	if a > b {
 		return a
@@ -1,12 +1,17 @@
 package ot_test
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
 	"runtime/debug"
+	"strings"
 	"testing"
+	"unicode/utf16"
 
 	"github.com/asadovsky/goatee/server/common"
 	"github.com/asadovsky/goatee/server/ot"
+	"github.com/asadovsky/goatee/server/store"
 )
 
 func fatal(t *testing.T, v ...interface{}) {
@@ -73,6 +78,38 @@ func TestApply(t *testing.T) {
 	eq(t, s, "fooo")
 }
 
+// Positions are in UTF-16 code units: "é" as "e" plus a combining acute accent
+// is 2 units, each CJK character is 1 unit, and each emoji is a surrogate pair.
+func TestApplyUnicode(t *testing.T) {
+	run := func(s, opStr, want string) {
+		got, err := decodeOp(t, opStr).Apply(s)
+		ok(t, err)
+		eq(t, got, want)
+	}
+	run("a😀b", "i,3,c", "a😀cb")
+	run("a😀b", "d,1,2", "ab")
+	run("😀😀", "i,2,中", "😀中😀")
+	run("中文", "i,1,😀", "中😀文")
+	run("中文", "d,1,1", "中")
+	run("éx", "d,1,1", "ex")
+	run("éx", "i,2,!", "é!x")
+
+	fail := func(s, opStr string) {
+		if _, err := decodeOp(t, opStr).Apply(s); err == nil {
+			fatalf(t, "expected error for %q on %q", opStr, s)
+		}
+	}
+	// Ops may not split a surrogate pair.
+	fail("😀", "i,1,x")
+	fail("a😀", "d,0,2")
+	fail("a😀", "d,2,1")
+	// Positions past the end are out of bounds, even if they are within the
+	// byte length.
+	fail("中文", "i,3,x")
+	fail("中文", "d,1,2")
+	fail("", "i,0,\xff")
+}
+
 func TestDecodeOp(t *testing.T) {
 	op := decodeOp(t, "i,2,bar")
 	eq(t, *op.(*ot.Insert), ot.Insert{Pos: 2, Value: "bar"})
@@ -81,6 +118,25 @@ func TestDecodeOp(t *testing.T) {
 	eq(t, *op.(*ot.Delete), ot.Delete{Pos: 5, Len: 2})
 }
 
+func TestInvert(t *testing.T) {
+	run := func(opStr, s, wantInverse string) {
+		op := decodeOp(t, opStr)
+		inv := op.Invert(s)
+		eq(t, inv.Encode(), wantInverse)
+		res, err := op.Apply(s)
+		ok(t, err)
+		res, err = inv.Apply(res)
+		ok(t, err)
+		eq(t, res, s)
+	}
+	run("i,2,bar", "food", "d,2,3")
+	run("i,0,", "", "d,0,0")
+	run("d,1,2", "food", "i,1,oo")
+	run("d,0,4", "food", "i,0,food")
+	run("i,1,😀中", "ab", "d,1,3")
+	run("d,1,3", "a😀中b", "i,1,😀中")
+}
+
 // Assumes DecodeOp and Op.Encode are tested.
 // TODO: Share tests between Go and JS, i.e. use data-driven tests.
 // TODO: Test TransformPatch.
@@ -152,11 +208,357 @@ func TestTextApplyUpdate(t *testing.T) {
 		&ot.Delete{Pos: 8, Len: 1},
 	})
 	var c common.Change
+	var a common.Ack
 	ok(t, text.ApplyUpdate(&common.Update{
 		BasePatchId: 0,
 		OpStrs:      opStrs,
-	}, &c))
+	}, &c, &a))
 	neq(t, c.PatchId, 0)
-	eq(t, c.OpStrs, opStrs)
+	// The ops are normalized by Compose.
+	eq(t, c.OpStrs, []string{"d,0,3", "d,2,1", "i,2,seball"})
+	eq(t, a.PatchId, c.PatchId)
 	eq(t, text.Value(), "baseball")
 }
+
+func applyUpdate(t *testing.T, text *ot.Text, clientId, basePatchId uint32, opStrs ...string) *common.Change {
+	var c common.Change
+	ok(t, text.ApplyUpdate(&common.Update{
+		ClientId:    clientId,
+		BasePatchId: basePatchId,
+		OpStrs:      opStrs,
+	}, &c, &common.Ack{}))
+	return &c
+}
+
+func TestTextApplyConcurrentUpdates(t *testing.T) {
+	text := ot.NewText("")
+	c := applyUpdate(t, text, 1, 0, "i,0,foo")
+	eq(t, c.PatchId, uint32(1))
+	// Client 2 has not yet seen patch 1.
+	c = applyUpdate(t, text, 2, 0, "i,0,bar")
+	eq(t, c.PatchId, uint32(2))
+	eq(t, c.OpStrs, []string{"i,3,bar"})
+	eq(t, text.Value(), "foobar")
+}
+
+func TestOpenText(t *testing.T) {
+	snap, log := store.NewMemBlob(), store.NewMemLog()
+	text, err := ot.OpenText(snap, log)
+	ok(t, err)
+	applyUpdate(t, text, 1, 0, "i,0,foo")
+	applyUpdate(t, text, 2, 0, "i,0,bar")
+	applyUpdate(t, text, 1, 2, "d,0,1")
+
+	// Simulate a restart by reopening the log.
+	text, err = ot.OpenText(snap, log)
+	ok(t, err)
+	var s common.Snapshot
+	ok(t, text.PopulateSnapshot(&s))
+	eq(t, s, common.Snapshot{Text: "oobar", BasePatchId: 3})
+
+	// A client that last saw patch 1 can continue.
+	c := applyUpdate(t, text, 3, 1, "i,3,!")
+	eq(t, c.PatchId, uint32(4))
+	eq(t, text.Value(), "oobar!")
+}
+
+func TestTransformSelection(t *testing.T) {
+	run := func(start, end int, opStr string, wantStart, wantEnd int) {
+		got := ot.TransformSelection(ot.Selection{Start: start, End: end}, []ot.Op{decodeOp(t, opStr)})
+		eq(t, got, ot.Selection{Start: wantStart, End: wantEnd})
+	}
+
+	// Insert before, at start of, inside, at end of, and after the range.
+	run(2, 4, "i,1,foo", 5, 7)
+	run(2, 4, "i,2,foo", 5, 7)
+	run(2, 4, "i,3,foo", 2, 7)
+	run(2, 4, "i,4,foo", 2, 7)
+	run(2, 4, "i,5,foo", 2, 4)
+	// Insert at a caret pushes the caret forward.
+	run(2, 2, "i,2,foo", 5, 5)
+
+	// Delete before, overlapping start of, inside, overlapping end of, covering,
+	// and after the range.
+	run(2, 4, "d,0,1", 1, 3)
+	run(2, 4, "d,0,2", 0, 2)
+	run(2, 5, "d,1,2", 1, 3)
+	run(2, 5, "d,3,1", 2, 4)
+	run(2, 5, "d,4,2", 2, 4)
+	run(2, 5, "d,1,5", 1, 1)
+	run(2, 4, "d,4,2", 2, 4)
+	run(2, 2, "d,1,1", 1, 1)
+}
+
+func TestTextSetSelection(t *testing.T) {
+	text := ot.NewText("foobar")
+	var s common.Selection
+	ok(t, text.SetSelection(&common.Select{ClientId: 1, Start: 3, End: 6}, &s))
+	eq(t, s, common.Selection{ClientId: 1, Start: 3, End: 6})
+
+	// Stored selections are transformed through applied patches.
+	applyUpdate(t, text, 2, 0, "i,0,__", "d,5,1")
+	var sn common.Snapshot
+	ok(t, text.PopulateSnapshot(&sn))
+	eq(t, sn.Text, "__fooar")
+	eq(t, sn.Selections, []common.Selection{{ClientId: 1, PatchId: 1, Start: 5, End: 7}})
+
+	// A selection relative to an old patch is transformed to the latest one.
+	ok(t, text.SetSelection(&common.Select{ClientId: 3, BasePatchId: 0, Start: 0, End: 3}, &s))
+	eq(t, s, common.Selection{ClientId: 3, PatchId: 1, Start: 2, End: 5})
+
+	// A client's own later patches cannot be skipped.
+	if err := text.SetSelection(&common.Select{ClientId: 2, BasePatchId: 0}, &s); err == nil {
+		fatal(t, "expected error")
+	}
+	if err := text.SetSelection(&common.Select{ClientId: 1, BasePatchId: 1, Start: 0, End: 8}, &s); err == nil {
+		fatal(t, "expected error")
+	}
+
+	text.ClearSelection(1)
+	ok(t, text.PopulateSnapshot(&sn))
+	eq(t, sn.Selections, []common.Selection{{ClientId: 3, PatchId: 1, Start: 2, End: 5}})
+}
+
+func undo(t *testing.T, text *ot.Text, clientId, patchId uint32) *common.Change {
+	var c common.Change
+	ok(t, text.Undo(clientId, &common.Undo{PatchId: patchId}, &c))
+	return &c
+}
+
+func redo(t *testing.T, text *ot.Text, clientId, patchId uint32) *common.Change {
+	var c common.Change
+	ok(t, text.Redo(clientId, &common.Redo{PatchId: patchId}, &c))
+	return &c
+}
+
+func TestTextUndoRedo(t *testing.T) {
+	text := ot.NewText("")
+	applyUpdate(t, text, 1, 0, "i,0,hello")
+	applyUpdate(t, text, 2, 1, "i,5, world")
+	applyUpdate(t, text, 1, 2, "d,0,1")
+	eq(t, text.Value(), "ello world")
+
+	// Clients undo their own patches, most recent first.
+	c := undo(t, text, 1, 0)
+	eq(t, *c, common.Change{PatchId: 4, OpStrs: []string{"i,0,h"}})
+	eq(t, text.Value(), "hello world")
+	// The inverse of patch 1 is transformed against later patches, and patch 3
+	// cancels out with its undo.
+	c = undo(t, text, 1, 0)
+	eq(t, *c, common.Change{PatchId: 5, OpStrs: []string{"d,0,5"}})
+	eq(t, text.Value(), " world")
+	eq(t, text.Undo(1, &common.Undo{}, &common.Change{}), common.ErrNothingToUndo)
+
+	// Redo reverts undo patches, most recent first.
+	c = redo(t, text, 1, 0)
+	eq(t, *c, common.Change{PatchId: 6, OpStrs: []string{"i,0,hello"}})
+	eq(t, text.Value(), "hello world")
+
+	// Client 2, which has not seen patches 3 through 6, can still apply updates.
+	applyUpdate(t, text, 2, 2, "i,11,!")
+	eq(t, text.Value(), "hello world!")
+
+	// Client 1 can also update against a base older than its undo patches, and
+	// doing so clears its redo stack.
+	applyUpdate(t, text, 1, 4, "i,5,>")
+	eq(t, text.Value(), "hello> world!")
+	eq(t, text.Redo(1, &common.Redo{}, &common.Change{}), common.ErrNothingToUndo)
+
+	// A specific patch can be undone, as long as it belongs to the client and
+	// has not already been undone.
+	c = undo(t, text, 2, 2)
+	eq(t, *c, common.Change{PatchId: 9, OpStrs: []string{"d,6,6"}})
+	eq(t, text.Value(), "hello>!")
+	if err := text.Undo(2, &common.Undo{PatchId: 2}, &common.Change{}); err == nil {
+		fatal(t, "expected error")
+	}
+	if err := text.Undo(1, &common.Undo{PatchId: 7}, &common.Change{}); err == nil {
+		fatal(t, "expected error")
+	}
+	if err := text.Redo(2, &common.Redo{PatchId: 5}, &common.Change{}); err == nil {
+		fatal(t, "expected error")
+	}
+	c = redo(t, text, 2, 9)
+	eq(t, *c, common.Change{PatchId: 10, OpStrs: []string{"i,6, world"}})
+	eq(t, text.Value(), "hello> world!")
+}
+
+func TestOpenTextWithUndo(t *testing.T) {
+	snap, log := store.NewMemBlob(), store.NewMemLog()
+	text, err := ot.OpenText(snap, log)
+	ok(t, err)
+	applyUpdate(t, text, 1, 0, "i,0,foo")
+	undo(t, text, 1, 1)
+
+	text, err = ot.OpenText(snap, log)
+	ok(t, err)
+	eq(t, text.Value(), "")
+	// Undo patches are replayed as Changes, even to their own client.
+	var got []string
+	ok(t, text.Replay(0, func(c *common.Change, a *common.Ack) {
+		got = append(got, fmt.Sprintf("%d:%v", c.PatchId, a != nil))
+	}))
+	eq(t, got, []string{"1:true", "2:false"})
+	// Client 1 may update against a base that predates its undo patch.
+	applyUpdate(t, text, 1, 1, "i,3,bar")
+	eq(t, text.Value(), "bar")
+}
+
+func TestTextCompact(t *testing.T) {
+	snap, log := store.NewMemBlob(), store.NewMemLog()
+	text, err := ot.OpenText(snap, log)
+	ok(t, err)
+	applyUpdate(t, text, 1, 0, "i,0,foo")
+	applyUpdate(t, text, 2, 1, "i,3,bar")
+	applyUpdate(t, text, 1, 2, "i,6,baz")
+	var s common.Selection
+	ok(t, text.SetSelection(&common.Select{ClientId: 3, BasePatchId: 1, Start: 0, End: 3}, &s))
+	ok(t, text.Compact(2))
+	// Compacting to an older PatchId is a no-op.
+	ok(t, text.Compact(1))
+	eq(t, text.Value(), "foobarbaz")
+
+	// Requests based on discarded patches require a resync.
+	resync := func(err error) {
+		if err != common.ErrResyncRequired {
+			fatalf(t, "got %v, want %v", err, common.ErrResyncRequired)
+		}
+	}
+	u := &common.Update{ClientId: 2, BasePatchId: 1, OpStrs: []string{"i,0,!"}}
+	resync(text.ApplyUpdate(u, &common.Change{}, &common.Ack{}))
+	resync(text.Replay(1, func(c *common.Change, a *common.Ack) {}))
+	resync(text.SetSelection(&common.Select{ClientId: 3, BasePatchId: 1}, &s))
+	var got []uint32
+	ok(t, text.Replay(2, func(c *common.Change, a *common.Ack) {
+		got = append(got, c.PatchId)
+	}))
+	eq(t, got, []uint32{3})
+	c := applyUpdate(t, text, 2, 2, "i,0,!")
+	eq(t, c.OpStrs, []string{"i,0,!"})
+
+	// Discarded patches can no longer be undone.
+	if err := text.Undo(1, &common.Undo{PatchId: 1}, &common.Change{}); err == nil {
+		fatal(t, "expected error")
+	}
+	undo(t, text, 1, 0)
+	eq(t, text.Value(), "!foobar")
+	if err := text.Undo(1, &common.Undo{}, &common.Change{}); err != common.ErrNothingToUndo {
+		fatalf(t, "got %v, want %v", err, common.ErrNothingToUndo)
+	}
+
+	// The compacted state survives a restart.
+	ok(t, text.Compact(5))
+	text, err = ot.OpenText(snap, log)
+	ok(t, err)
+	var sn common.Snapshot
+	ok(t, text.PopulateSnapshot(&sn))
+	eq(t, sn, common.Snapshot{Text: "!foobar", BasePatchId: 5})
+	resync(text.Replay(4, func(c *common.Change, a *common.Ack) {}))
+	applyUpdate(t, text, 2, 5, "i,7,?")
+	text, err = ot.OpenText(snap, log)
+	ok(t, err)
+	eq(t, text.Value(), "!foobar?")
+}
+
+func TestTextUnicode(t *testing.T) {
+	text := ot.NewText("")
+	applyUpdate(t, text, 1, 0, "i,0,中文")
+	// Concurrent inserts are transformed by their length in UTF-16 code units.
+	applyUpdate(t, text, 2, 0, "i,0,😀")
+	c := applyUpdate(t, text, 3, 0, "i,0,e\u0301")
+	eq(t, c.OpStrs, []string{"i,4,e\u0301"})
+	eq(t, text.Value(), "中文😀e\u0301")
+	// A delete concurrent with the inserts shifts past them.
+	c = applyUpdate(t, text, 4, 1, "d,1,1")
+	eq(t, c.OpStrs, []string{"d,1,1"})
+	eq(t, text.Value(), "中😀e\u0301")
+
+	var s common.Selection
+	ok(t, text.SetSelection(&common.Select{ClientId: 5, BasePatchId: 4, Start: 3, End: 5}, &s))
+	if err := text.SetSelection(&common.Select{ClientId: 5, BasePatchId: 4, Start: 3, End: 6}, &s); err == nil {
+		fatal(t, "expected error")
+	}
+
+	c = undo(t, text, 2, 0)
+	eq(t, c.OpStrs, []string{"d,1,2"})
+	eq(t, text.Value(), "中e\u0301")
+}
+
+// randOp returns a random op for s, which may be out of bounds or split a
+// surrogate pair.
+func randOp(rng *rand.Rand, s string) ot.Op {
+	n := len(utf16.Encode([]rune(s)))
+	pos := rng.Intn(n + 2)
+	if rng.Intn(3) > 0 {
+		values := []string{"a", "foo", "中文", "😀", strings.Repeat("xy😀", rng.Intn(300))}
+		return &ot.Insert{Pos: pos, Value: values[rng.Intn(len(values))]}
+	}
+	return &ot.Delete{Pos: pos, Len: rng.Intn(n/4 + 2)}
+}
+
+// TestTextRandomOps checks Text against Op.Apply on strings, for documents
+// large enough to span many rope chunks.
+func TestTextRandomOps(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	text, s := ot.NewText(""), ""
+	patchId := uint32(0)
+	for i := 0; i < 2000; i++ {
+		// Apply two ops per update, to check that a failed second op leaves the
+		// text unchanged.
+		a := randOp(rng, s)
+		want, err := a.Apply(s)
+		if err != nil {
+			continue
+		}
+		b := randOp(rng, want)
+		if want, err = b.Apply(want); err != nil {
+			want = s
+		}
+		u := &common.Update{ClientId: 1, BasePatchId: patchId, OpStrs: ot.EncodeOps([]ot.Op{a, b})}
+		if gotErr := text.ApplyUpdate(u, &common.Change{}, &common.Ack{}); (gotErr != nil) != (err != nil) {
+			fatalf(t, "%v, %v: got error %v, want %v", a, b, gotErr, err)
+		} else if gotErr == nil {
+			patchId++
+		}
+		s = want
+		eq(t, text.Value(), s)
+	}
+}
+
+// BenchmarkApply measures the cost of inserting and then deleting one
+// character at a random position in a document of the given size, with
+// Op.Apply on strings and with Text.ApplyUpdate.
+func BenchmarkApply(b *testing.B) {
+	for _, n := range []int{1e4, 1e5, 1e6} {
+		rng := rand.New(rand.NewSource(0))
+		s := strings.Repeat("x", n)
+		b.Run(fmt.Sprintf("string/n=%d", n), func(b *testing.B) {
+			s := s
+			for i := 0; i < b.N; i++ {
+				pos := rng.Intn(n)
+				s, _ = (&ot.Insert{Pos: pos, Value: "y"}).Apply(s)
+				s, _ = (&ot.Delete{Pos: pos, Len: 1}).Apply(s)
+			}
+		})
+		b.Run(fmt.Sprintf("text/n=%d", n), func(b *testing.B) {
+			text := ot.NewText(s)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pos := rng.Intn(n)
+				u := &common.Update{
+					ClientId:    1,
+					BasePatchId: uint32(2 * i),
+					OpStrs:      []string{fmt.Sprintf("i,%d,y", pos)},
+				}
+				if err := text.ApplyUpdate(u, &common.Change{}, &common.Ack{}); err != nil {
+					b.Fatal(err)
+				}
+				u.BasePatchId++
+				u.OpStrs = []string{fmt.Sprintf("d,%d,1", pos)}
+				if err := text.ApplyUpdate(u, &common.Change{}, &common.Ack{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
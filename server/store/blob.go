@@ -0,0 +1,95 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Blob is a value that is durably stored and atomically replaced, e.g. a
+// document snapshot.
+type Blob interface {
+	// Get returns the stored value, or nil if no value has been stored.
+	Get() ([]byte, error)
+	// Put durably and atomically replaces the stored value.
+	Put(buf []byte) error
+}
+
+////////////////////////////////////////
+// FileBlob
+
+// FileBlob is a Blob backed by a file.
+type FileBlob struct {
+	path string
+}
+
+var _ Blob = (*FileBlob)(nil)
+
+// NewFileBlob returns a Blob backed by the file at the given path.
+func NewFileBlob(path string) *FileBlob {
+	return &FileBlob{path: path}
+}
+
+// Get returns the stored value, or nil if no value has been stored.
+func (b *FileBlob) Get() ([]byte, error) {
+	buf, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return buf, err
+}
+
+// Put durably and atomically replaces the stored value. It writes to a
+// temporary file and then renames it, so readers never see a partial value.
+func (b *FileBlob) Put(buf []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), b.path)
+}
+
+////////////////////////////////////////
+// MemBlob
+
+// MemBlob is an in-memory Blob, useful for tests.
+type MemBlob struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+var _ Blob = (*MemBlob)(nil)
+
+// NewMemBlob returns a new MemBlob.
+func NewMemBlob() *MemBlob {
+	return &MemBlob{}
+}
+
+// Get returns the stored value, or nil if no value has been stored.
+func (b *MemBlob) Get() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf, nil
+}
+
+// Put replaces the stored value.
+func (b *MemBlob) Put(buf []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append([]byte(nil), buf...)
+	return nil
+}
@@ -0,0 +1,32 @@
+package store
+
+import "errors"
+
+// FailNextWrite makes the next write to l write only the first n bytes and
+// then fail.
+func FailNextWrite(l *FileLog, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f = &failingFile{file: l.f, n: n}
+}
+
+type failingFile struct {
+	file
+	n    int
+	done bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.done {
+		return f.file.Write(p)
+	}
+	f.done = true
+	if f.n > len(p) {
+		f.n = len(p)
+	}
+	n, err := f.file.Write(p[:f.n])
+	if err != nil {
+		return n, err
+	}
+	return n, errors.New("write failed")
+}
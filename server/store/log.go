@@ -0,0 +1,219 @@
+// Package store provides durable storage for document state.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Log is an append-only log of records. Records must not contain newlines;
+// JSON-encoded values satisfy this requirement.
+type Log interface {
+	// Append durably appends rec to the log.
+	Append(rec []byte) error
+	// Replay calls f on each record in the log, in order.
+	Replay(f func(rec []byte) error) error
+	// Reset durably discards all records, e.g. after they have been folded
+	// into a snapshot.
+	Reset() error
+	// Close closes the log.
+	Close() error
+}
+
+var errNewline = errors.New("record contains newline")
+
+////////////////////////////////////////
+// FileLog
+
+// file is the subset of *os.File used by FileLog. Tests may substitute a file
+// that fails.
+type file interface {
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileLog is a Log backed by a file, with one record per line.
+type FileLog struct {
+	mu   sync.Mutex
+	f    file
+	path string
+	// err is set if a failed append could not be rolled back, in which case
+	// the file may end with a partial record and further appends are refused.
+	err error
+}
+
+var _ Log = (*FileLog)(nil)
+
+// OpenFileLog opens the log at the given path, creating it if needed. If the
+// last record was only partially written (e.g. due to a crash), it is
+// discarded.
+func OpenFileLog(path string) (*FileLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Find the end of the last complete record.
+	var end int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		end += int64(len(line))
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLog{f: f, path: path}, nil
+}
+
+// Append durably appends rec to the log.
+func (l *FileLog) Append(rec []byte) error {
+	if bytes.IndexByte(rec, '\n') != -1 {
+		return errNewline
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	off, err := l.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = l.f.Write(append(rec, '\n')); err == nil {
+		if err = l.f.Sync(); err == nil {
+			return nil
+		}
+	}
+	// Discard whatever was written, so that the next record does not follow a
+	// partial one.
+	if terr := l.truncate(off); terr != nil {
+		l.err = terr
+	}
+	return err
+}
+
+// truncate truncates the file to the given size and moves the write offset to
+// the end. Callers must hold l.mu.
+func (l *FileLog) truncate(size int64) error {
+	if err := l.f.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := l.f.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Replay calls f on each record in the log, in order.
+func (l *FileLog) Replay(f func(rec []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rf, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	r := bufio.NewReader(rf)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Ignore any trailing partial record, e.g. one being written
+			// concurrently.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f(line[:len(line)-1]); err != nil {
+			return err
+		}
+	}
+}
+
+// Reset durably discards all records.
+func (l *FileLog) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.truncate(0); err != nil {
+		return err
+	}
+	l.err = nil
+	return nil
+}
+
+// Close closes the log.
+func (l *FileLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+////////////////////////////////////////
+// MemLog
+
+// MemLog is an in-memory Log, useful for tests.
+type MemLog struct {
+	mu   sync.Mutex
+	recs [][]byte
+}
+
+var _ Log = (*MemLog)(nil)
+
+// NewMemLog returns a new MemLog.
+func NewMemLog() *MemLog {
+	return &MemLog{}
+}
+
+// Append appends rec to the log.
+func (l *MemLog) Append(rec []byte) error {
+	if bytes.IndexByte(rec, '\n') != -1 {
+		return errNewline
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recs = append(l.recs, append([]byte(nil), rec...))
+	return nil
+}
+
+// Replay calls f on each record in the log, in order.
+func (l *MemLog) Replay(f func(rec []byte) error) error {
+	l.mu.Lock()
+	recs := l.recs
+	l.mu.Unlock()
+	for _, rec := range recs {
+		if err := f(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset discards all records.
+func (l *MemLog) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recs = nil
+	return nil
+}
+
+// Close is a no-op.
+func (l *MemLog) Close() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"testing"
+
+	"github.com/asadovsky/goatee/server/store"
+)
+
+func fatal(t *testing.T, v ...interface{}) {
+	debug.PrintStack()
+	t.Fatal(v...)
+}
+
+func fatalf(t *testing.T, format string, v ...interface{}) {
+	debug.PrintStack()
+	t.Fatalf(format, v...)
+}
+
+func ok(t *testing.T, err error) {
+	if err != nil {
+		fatal(t, err)
+	}
+}
+
+func eq(t *testing.T, got, want interface{}) {
+	if !reflect.DeepEqual(got, want) {
+		fatalf(t, "got %v, want %v", got, want)
+	}
+}
+
+func records(t *testing.T, l store.Log) []string {
+	res := []string{}
+	ok(t, l.Replay(func(rec []byte) error {
+		res = append(res, string(rec))
+		return nil
+	}))
+	return res
+}
+
+func testLog(t *testing.T, l store.Log) {
+	eq(t, records(t, l), []string{})
+	ok(t, l.Append([]byte("foo")))
+	ok(t, l.Append([]byte("")))
+	ok(t, l.Append([]byte("bar")))
+	eq(t, records(t, l), []string{"foo", "", "bar"})
+	if err := l.Append([]byte("a\nb")); err == nil {
+		fatal(t, "expected error")
+	}
+	eq(t, records(t, l), []string{"foo", "", "bar"})
+}
+
+func testReset(t *testing.T, l store.Log) {
+	ok(t, l.Append([]byte("foo")))
+	ok(t, l.Reset())
+	eq(t, records(t, l), []string{})
+	ok(t, l.Append([]byte("bar")))
+	eq(t, records(t, l), []string{"bar"})
+}
+
+func TestMemLog(t *testing.T) {
+	testLog(t, store.NewMemLog())
+	testReset(t, store.NewMemLog())
+}
+
+func TestFileLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	l, err := store.OpenFileLog(path)
+	ok(t, err)
+	testLog(t, l)
+	ok(t, l.Close())
+
+	// Reopen, and verify that records are retained.
+	l, err = store.OpenFileLog(path)
+	ok(t, err)
+	eq(t, records(t, l), []string{"foo", "", "bar"})
+	ok(t, l.Append([]byte("baz")))
+	eq(t, records(t, l), []string{"foo", "", "bar", "baz"})
+	testReset(t, l)
+	ok(t, l.Close())
+
+	l, err = store.OpenFileLog(path)
+	ok(t, err)
+	eq(t, records(t, l), []string{"bar"})
+	ok(t, l.Close())
+}
+
+func TestFileLogDiscardsPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	ok(t, os.WriteFile(path, []byte("foo\nba"), 0644))
+	l, err := store.OpenFileLog(path)
+	ok(t, err)
+	eq(t, records(t, l), []string{"foo"})
+	ok(t, l.Append([]byte("bar")))
+	eq(t, records(t, l), []string{"foo", "bar"})
+	ok(t, l.Close())
+}
+
+func TestFileLogRollsBackFailedAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	l, err := store.OpenFileLog(path)
+	ok(t, err)
+	ok(t, l.Append([]byte("foo")))
+	store.FailNextWrite(l, 2)
+	if err := l.Append([]byte("bar")); err == nil {
+		fatal(t, "expected error")
+	}
+	ok(t, l.Append([]byte("baz")))
+	eq(t, records(t, l), []string{"foo", "baz"})
+	ok(t, l.Close())
+
+	l, err = store.OpenFileLog(path)
+	ok(t, err)
+	eq(t, records(t, l), []string{"foo", "baz"})
+	ok(t, l.Close())
+}
+
+func testBlob(t *testing.T, b store.Blob) {
+	buf, err := b.Get()
+	ok(t, err)
+	eq(t, buf, []byte(nil))
+	ok(t, b.Put([]byte("foo")))
+	ok(t, b.Put([]byte("bar")))
+	buf, err = b.Get()
+	ok(t, err)
+	eq(t, string(buf), "bar")
+}
+
+func TestMemBlob(t *testing.T) {
+	testBlob(t, store.NewMemBlob())
+}
+
+func TestFileBlob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blob")
+	testBlob(t, store.NewFileBlob(path))
+	buf, err := store.NewFileBlob(path).Get()
+	ok(t, err)
+	eq(t, string(buf), "bar")
+}